@@ -28,3 +28,29 @@ type Adapter interface {
 	// RemoteAddress returns the remote address (example: tcp:127.0.0.1:7000)
 	RemoteAddress() string
 }
+
+// BufferedAdapter is an Adapter that can collect multiple messages
+// in an internal buffer and write them at once to the underline connection.
+// It is used by the write batching of a NetworkConnection
+type BufferedAdapter interface {
+	Adapter
+
+	// BufferMessage writes the given message into the internal buffer
+	// without flushing it to the underline connection
+	BufferMessage(m *Message) error
+
+	// Flush writes all buffered messages to the underline connection
+	Flush() error
+}
+
+// FrameAdapter is an Adapter that reports the frames as they are read from
+// and written to the underline connection.
+// It is used by the frame capture (see Capture.Adapter)
+type FrameAdapter interface {
+	Adapter
+
+	// OnFrame registers the handler that is called with every frame that was read (Receive)
+	// or written (Send). The handler must not modify or retain the frame.
+	// It has to be registered before the adapter is used
+	OnFrame(handler func(op PipeOperation, frame []byte))
+}
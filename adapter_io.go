@@ -2,11 +2,24 @@ package go2p
 
 import (
 	"io"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/v-braun/awaiter"
 )
 
+// writeBatchQueueSize is the number of messages that can be queued
+// for the write loop when write batching is enabled
+const writeBatchQueueSize = 64
+
+// writeBatching configures the coalescing of outgoing messages in the adapter write loop
+type writeBatching struct {
+	// maxBytes flush the batch when the buffered payloads reach this size
+	maxBytes int
+	// maxDelay is the time the write loop waits for more messages before flushing
+	maxDelay time.Duration
+}
+
 type adapterIO struct {
 	receive chan *Message
 	send    chan *Message
@@ -16,9 +29,12 @@ type adapterIO struct {
 	adapter Adapter
 
 	emitter *eventEmitter
+
+	batching  *writeBatching
+	lastBatch int
 }
 
-func newAdapterIO(adapter Adapter) *adapterIO {
+func newAdapterIO(adapter Adapter, batching *writeBatching) *adapterIO {
 	io := new(adapterIO)
 	io.receive = make(chan *Message)
 	io.send = make(chan *Message)
@@ -26,6 +42,11 @@ func newAdapterIO(adapter Adapter) *adapterIO {
 	io.adapter = adapter
 	io.emitter = newEventEmitter()
 
+	if _, ok := adapter.(BufferedAdapter); ok && batching != nil {
+		io.batching = batching
+		io.send = make(chan *Message, writeBatchQueueSize)
+	}
+
 	return io
 }
 
@@ -42,6 +63,9 @@ func (io *adapterIO) start() {
 			case io.receive <- m:
 				continue
 			case <-io.awaiter.CancelRequested():
+				// a local stop while a message is pending ends the loop without a read error,
+				// the disconnect is reported as if the closed adapter failed the next read
+				io.handleError(DisconnectedError, "read")
 				return
 			}
 		}
@@ -51,9 +75,12 @@ func (io *adapterIO) start() {
 		for {
 			select {
 			case m := <-io.send:
-				err := io.adapter.WriteMessage(m)
+				err := io.write(m)
 				if err != nil {
-					io.handleError(err, "write")
+					// the adapter fails as well when it was closed by a local stop
+					if !io.awaiter.IsCancelRequested() {
+						io.handleError(err, "write")
+					}
 					return
 				}
 
@@ -65,6 +92,62 @@ func (io *adapterIO) start() {
 	})
 }
 
+func (io *adapterIO) write(m *Message) error {
+	if io.batching == nil {
+		return io.adapter.WriteMessage(m)
+	}
+
+	return io.writeBatch(io.adapter.(BufferedAdapter), m)
+}
+
+// writeBatch buffers the given message and all messages that are already queued
+// and flushes them at once.
+// The loop lingers up to maxDelay for more messages only if the previous batch
+// contained more than one message, so single messages are not delayed
+func (io *adapterIO) writeBatch(adapter BufferedAdapter, m *Message) error {
+	size := 0
+	count := 0
+	var timer *time.Timer
+
+	for m != nil {
+		if err := adapter.BufferMessage(m); err != nil {
+			return err
+		}
+
+		size += len(m.payload)
+		count++
+		m = nil
+
+		if size >= io.batching.maxBytes {
+			break
+		}
+
+		select {
+		case m = <-io.send:
+			continue
+		default:
+		}
+
+		if io.batching.maxDelay <= 0 || io.lastBatch <= 1 {
+			break
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(io.batching.maxDelay)
+			defer timer.Stop()
+		}
+
+		select {
+		case m = <-io.send:
+		case <-timer.C:
+		case <-io.awaiter.CancelRequested():
+		}
+	}
+
+	io.lastBatch = count
+	return adapter.Flush()
+}
+
 func isDisconnectErr(err error) bool {
 	if err == DisconnectedError || err == io.EOF {
 		return true
@@ -78,6 +161,11 @@ func (io *adapterIO) handleError(err error, src string) {
 		return
 	}
 
+	if _, ok := err.(*MiddlewareError); ok {
+		io.emitter.EmitAsync("error", err)
+		return
+	}
+
 	io.emitter.EmitAsync("error", errors.Wrapf(err, "error during %s", src))
 }
 
@@ -0,0 +1,91 @@
+package go2p
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTCPAdapterPair(t testing.TB) (Adapter, Adapter) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewAdapter(conn), NewAdapter(<-accepted)
+}
+
+func sendAndReceive(t testing.TB, batching *writeBatching, count int, onMessage func(idx int, m *Message)) {
+	local, remote := newTCPAdapterPair(t)
+	defer remote.Close()
+
+	io := newAdapterIO(local, batching)
+	io.start()
+	defer func() {
+		io.awaiter.Cancel()
+		local.Close()
+		io.awaiter.AwaitSync()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < count; i++ {
+			m, err := remote.ReadMessage()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			onMessage(i, m)
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		err := io.sendMsg(NewMessageFromString(fmt.Sprintf("msg %d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	<-done
+}
+
+func TestWriteBatching(t *testing.T) {
+	batching := &writeBatching{maxBytes: 64, maxDelay: time.Millisecond}
+	sendAndReceive(t, batching, 100, func(idx int, m *Message) {
+		assert.Equal(t, fmt.Sprintf("msg %d", idx), m.PayloadGetString())
+	})
+}
+
+func benchmarkWriteSmallMessages(b *testing.B, batching *writeBatching) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	sendAndReceive(b, batching, b.N, func(idx int, m *Message) {})
+}
+
+func BenchmarkWriteSmallMessages(b *testing.B) {
+	benchmarkWriteSmallMessages(b, nil)
+}
+
+func BenchmarkWriteSmallMessagesBatched(b *testing.B) {
+	benchmarkWriteSmallMessages(b, &writeBatching{maxBytes: 64 * 1024, maxDelay: 0})
+}
+
+func BenchmarkWriteSmallMessagesBatchedDelay(b *testing.B) {
+	benchmarkWriteSmallMessages(b, &writeBatching{maxBytes: 64 * 1024, maxDelay: 100 * time.Microsecond})
+}
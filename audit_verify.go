@@ -0,0 +1,165 @@
+package go2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// AuditReport is the result of a successful VerifyAudit
+type AuditReport struct {
+	// Files is the number of verified files
+	Files int
+	// Records is the number of verified records
+	Records uint64
+	// FirstSeq is the sequence number of the first record
+	FirstSeq uint64
+	// LastSeq is the sequence number of the last record
+	LastSeq uint64
+	// LastHash is the hash of the last record
+	LastHash string
+}
+
+// AuditVerifyError describes the first problem that VerifyAudit found
+type AuditVerifyError struct {
+	// File is the name of the audit file
+	File string
+	// Line is the line within the file, starting at 1
+	Line int
+	// Seq is the sequence number of the record, if it could be read
+	Seq    uint64
+	Reason string
+}
+
+func (e *AuditVerifyError) Error() string {
+	return fmt.Sprintf("audit log verification failed (file: %s, line: %d, seq: %d): %s", e.File, e.Line, e.Seq, e.Reason)
+}
+
+// VerifyAudit checks all audit files of dir written by the Audit middleware.
+//
+// It recomputes the hash of each record and checks that it is chained to the previous record
+// and that the sequence numbers have no gaps, also across files.
+// Each line has to be the exact encoding that was hashed, lines with duplicate or additional keys are rejected.
+// The log has to start with seq 1, a log whose oldest files were removed is reported as truncated
+// (use VerifyAuditFrom for a log that was pruned on purpose).
+// The first problem is returned as *AuditVerifyError.
+//
+// The hash chain does not protect against a rewrite of the whole log with recomputed hashes,
+// neither against removed records at the end of the log.
+// Both can only be detected by comparing the returned LastSeq and LastHash
+// with an Auditor.Head that was stored outside of the audit dir
+func VerifyAudit(dir string) (*AuditReport, error) {
+	return VerifyAuditFrom(dir, 1, "")
+}
+
+// VerifyAuditFrom checks the audit files of dir like VerifyAudit,
+// but expects the log to start with the record seq that is chained to the hash prev.
+// Use the seq and hash of the last removed record (or a stored Auditor.Head)
+// to verify a log whose oldest files were removed
+func VerifyAuditFrom(dir string, seq uint64, prev string) (*AuditReport, error) {
+	if seq == 0 {
+		return nil, errors.New("the first seq of an audit log is 1")
+	}
+
+	files, err := auditFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// the expected start is verified like the record before the first one
+	report := new(AuditReport)
+	report.LastSeq = seq - 1
+	report.LastHash = prev
+	for _, file := range files {
+		if err := verifyAuditFile(file, report); err != nil {
+			return report, err
+		}
+		report.Files++
+	}
+
+	return report, nil
+}
+
+func verifyAuditFile(file auditFile, report *AuditReport) error {
+	f, err := os.Open(file.path)
+	if err != nil {
+		return errors.Wrap(err, "could not open audit file")
+	}
+	defer f.Close()
+
+	name := filepath.Base(file.path)
+	fail := func(line int, seq uint64, reason string, args ...interface{}) error {
+		return &AuditVerifyError{File: name, Line: line, Seq: seq, Reason: fmt.Sprintf(reason, args...)}
+	}
+
+	torn, err := auditTornTail(f)
+	if err != nil {
+		return errors.Wrap(err, "could not read audit file")
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			if torn > 0 && len(scanner.Bytes()) == torn {
+				return fail(line, 0, "torn record at the end of the file (%d bytes)", torn)
+			}
+			return fail(line, 0, "invalid record: %v", err)
+		}
+
+		// the hash covers the marshalled record, so the line has to be exactly that encoding,
+		// otherwise other readers could see values (e.g. of duplicate keys) that are not hashed
+		canonical, err := json.Marshal(record)
+		if err != nil || !bytes.Equal(canonical, scanner.Bytes()) {
+			return fail(line, record.Seq, "record is not in its canonical encoding")
+		}
+
+		if line == 1 && record.Seq != file.first {
+			return fail(line, record.Seq, "file starts with seq %d", record.Seq)
+		}
+
+		if report.Records == 0 {
+			report.FirstSeq = record.Seq
+			if record.Seq != report.LastSeq+1 {
+				return fail(line, record.Seq, "truncated log starts at seq %d instead of %d", record.Seq, report.LastSeq+1)
+			}
+			if record.Prev != report.LastHash {
+				return fail(line, record.Seq, "first record is not chained to the expected previous hash")
+			}
+		} else {
+			if record.Seq != report.LastSeq+1 {
+				return fail(line, record.Seq, "gap after seq %d", report.LastSeq)
+			}
+			if record.Prev != report.LastHash {
+				return fail(line, record.Seq, "record is not chained to seq %d", report.LastSeq)
+			}
+		}
+
+		hash, err := record.computeHash()
+		if err != nil {
+			return fail(line, record.Seq, "could not hash record: %v", err)
+		}
+		if hash != record.Hash {
+			return fail(line, record.Seq, "hash mismatch")
+		}
+
+		report.Records++
+		report.LastSeq = record.Seq
+		report.LastHash = record.Hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fail(line+1, 0, "could not read file: %v", err)
+	}
+
+	return nil
+}
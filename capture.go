@@ -0,0 +1,267 @@
+package go2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/emirpasic/gods/maps/hashmap"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CaptureKind is the type of a captured record
+type CaptureKind string
+
+const (
+	// CaptureFrame is a raw frame as it was read from or written to the connection
+	CaptureFrame CaptureKind = "frame"
+	// CaptureMessage is a decoded message as it was seen by the capture middleware
+	CaptureMessage CaptureKind = "message"
+)
+
+// CaptureRecord is one line of a capture file
+type CaptureRecord struct {
+	Time time.Time   `json:"time"`
+	Kind CaptureKind `json:"kind"`
+	// Direction is "send" or "receive"
+	Direction string `json:"direction"`
+	// Peer is the remote address of the peer
+	Peer string `json:"peer"`
+	// Frame contains the bytes of a CaptureFrame record
+	Frame []byte `json:"frame,omitempty"`
+	// Message contains the message of a CaptureMessage record
+	Message *CapturedMessage `json:"message,omitempty"`
+}
+
+// CapturedMessage is a decoded message within a capture file
+type CapturedMessage struct {
+	ID        string          `json:"id"`
+	Origin    string          `json:"origin,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Priority  Priority        `json:"priority"`
+	Deadline  time.Time       `json:"deadline"`
+	Metadata  json.RawMessage `json:"metadata"`
+	Payload   []byte          `json:"payload"`
+}
+
+// Capture writes captured frames and messages into a JSONL file.
+// One Capture can be shared by the adapter wrappers and middlewares of a NetworkConnection.
+// Errors during the capture are logged and do not interrupt the traffic
+type Capture struct {
+	mutex *sync.Mutex
+	file  *os.File
+	log   *logrus.Entry
+	now   func() time.Time
+}
+
+// NewCapture creates (or truncates) the capture file at path
+func NewCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create capture file")
+	}
+
+	c := new(Capture)
+	c.mutex = new(sync.Mutex)
+	c.file = file
+	c.log = newLogger("capture")
+	c.now = time.Now
+
+	return c, nil
+}
+
+// Close closes the capture file, records after Close are discarded
+func (c *Capture) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return nil
+	}
+
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// Operator wraps the operator so the frames of all its connections are captured (see Adapter)
+func (c *Capture) Operator(op PeerOperator) PeerOperator {
+	return &captureOperator{PeerOperator: op, capture: c}
+}
+
+// Adapter captures all frames that are read and written by the adapter.
+// The frames are the bytes as they are on the wire, after all middlewares.
+// Only a FrameAdapter (like the TCP adapter) reports its frames,
+// other adapters are returned without capturing frames
+func (c *Capture) Adapter(adapter Adapter) Adapter {
+	remote := adapter.RemoteAddress()
+	framed, ok := adapter.(FrameAdapter)
+	if !ok {
+		c.log.WithField("remote", remote).Warn("adapter does not report frames, frames are not captured")
+		return adapter
+	}
+
+	framed.OnFrame(func(op PipeOperation, frame []byte) {
+		c.captureFrame(op, remote, frame)
+	})
+
+	return adapter
+}
+
+// Middleware creates a middleware that captures the decoded messages
+// as they pass its position in the middleware stack.
+// Placed between Routes and Headers the records contain the route of the messages
+func (c *Capture) Middleware() (string, MiddlewareFunc) {
+	return "capture", func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		remote := ""
+		if peer != nil {
+			remote = peer.RemoteAddress()
+		}
+
+		c.captureMessage(pipe.Operation(), remote, msg)
+		return Next, nil
+	}
+}
+
+func (c *Capture) captureFrame(op PipeOperation, peer string, frame []byte) {
+	c.write(&CaptureRecord{Kind: CaptureFrame, Direction: captureDirection(op), Peer: peer, Frame: frame})
+}
+
+func (c *Capture) captureMessage(op PipeOperation, peer string, m *Message) {
+	annotations, ok := m.metadata.(*hashmap.Map)
+	if !ok {
+		c.log.Warn("could not encode message metadata")
+		return
+	}
+
+	metadata, err := annotations.ToJSON()
+	if err != nil {
+		c.log.WithError(err).Warn("could not encode message metadata")
+		return
+	}
+
+	c.write(&CaptureRecord{
+		Kind:      CaptureMessage,
+		Direction: captureDirection(op),
+		Peer:      peer,
+		Message: &CapturedMessage{
+			ID:        m.ID(),
+			Origin:    m.origin,
+			CreatedAt: m.createdAt,
+			Priority:  m.priority,
+			Deadline:  m.deadline,
+			Metadata:  metadata,
+			Payload:   m.payload,
+		},
+	})
+}
+
+func (c *Capture) write(record *CaptureRecord) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.file == nil {
+		return
+	}
+
+	record.Time = c.now().UTC()
+	line, err := json.Marshal(record)
+	if err != nil {
+		c.log.WithError(err).Warn("could not encode capture record")
+		return
+	}
+
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		c.log.WithError(err).Warn("could not write capture record")
+	}
+}
+
+func captureDirection(op PipeOperation) string {
+	if op == Receive {
+		return "receive"
+	}
+
+	return "send"
+}
+
+// ReadCapture reads all records of a capture file
+func ReadCapture(path string) ([]*CaptureRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open capture file")
+	}
+	defer file.Close()
+
+	var records []*CaptureRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxDecompressedSize)
+	for scanner.Scan() {
+		record := new(CaptureRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return nil, errors.Wrapf(err, "invalid capture record %d", len(records)+1)
+		}
+
+		records = append(records, record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read capture file")
+	}
+
+	return records, nil
+}
+
+// Decode returns the message of the record, decoded from the frame or the captured message
+func (r *CaptureRecord) Decode() (*Message, error) {
+	m := NewMessage()
+
+	if r.Kind == CaptureFrame {
+		err := m.ReadFromReader(bufio.NewReader(bytes.NewReader(r.Frame)))
+		return m, errors.Wrap(err, "invalid captured frame")
+	}
+
+	if r.Message == nil {
+		return nil, errors.New("record without message")
+	}
+
+	id, err := uuid.Parse(r.Message.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid captured message id")
+	}
+
+	metadata := hashmap.New()
+	if len(r.Message.Metadata) > 0 {
+		if err := metadata.FromJSON(r.Message.Metadata); err != nil {
+			return nil, errors.Wrap(err, "invalid captured metadata")
+		}
+	}
+
+	m.id = id
+	m.origin = r.Message.Origin
+	m.createdAt = r.Message.CreatedAt
+	m.SetPriority(r.Message.Priority)
+	m.deadline = r.Message.Deadline
+	m.metadata = metadata
+	m.payload = r.Message.Payload
+	if m.payload == nil {
+		m.payload = []byte{}
+	}
+
+	return m, nil
+}
+
+type captureOperator struct {
+	PeerOperator
+	capture *Capture
+}
+
+func (o *captureOperator) OnPeer(handler func(p Adapter)) {
+	o.PeerOperator.OnPeer(func(p Adapter) {
+		handler(o.capture.Adapter(p))
+	})
+}
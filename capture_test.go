@@ -0,0 +1,165 @@
+package go2p
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCapture(t *testing.T) (*Capture, string, func()) {
+	dir, err := ioutil.TempDir("", "go2p-capture")
+	assert.NoError(t, err)
+
+	path := filepath.Join(dir, "session.jsonl")
+	capture, err := NewCapture(path)
+	assert.NoError(t, err)
+
+	return capture, path, func() { os.RemoveAll(dir) }
+}
+
+func TestCaptureMiddleware(t *testing.T) {
+	capture, path, cleanup := newTestCapture(t)
+	defer cleanup()
+
+	msg := NewMessageRoutedFromString("cmd/restart", "now")
+	msg.SetPriority(PriorityControl)
+	msg.SetTTL(time.Minute)
+	m := NewMiddleware(capture.Middleware())
+	assert.NoError(t, processMiddleware(Receive, msg, m))
+	assert.NoError(t, processMiddleware(Send, NewMessageFromString("reply"), m))
+	assert.NoError(t, capture.Close())
+	assert.NoError(t, processMiddleware(Send, NewMessageFromString("discarded"), m))
+
+	records, err := ReadCapture(path)
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, CaptureMessage, records[0].Kind)
+	assert.Equal(t, "receive", records[0].Direction)
+	assert.Equal(t, "send", records[1].Direction)
+
+	decoded, err := records[0].Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, msg.ID(), decoded.ID())
+	assert.Equal(t, "now", decoded.PayloadGetString())
+	assert.Equal(t, PriorityControl, decoded.Priority())
+	assert.True(t, msg.Deadline().Equal(decoded.Deadline()))
+	route, _ := decoded.Metadata().Get(annotationKey)
+	assert.Equal(t, "cmd/restart", route)
+}
+
+func TestCaptureAdapter(t *testing.T) {
+	capture, path, cleanup := newTestCapture(t)
+	defer cleanup()
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	adapter := capture.Adapter(NewAdapter(local))
+	other := NewAdapter(remote)
+	_, buffered := adapter.(BufferedAdapter)
+	assert.True(t, buffered)
+
+	incoming := NewMessageFromString("incoming")
+	incoming.origin = "remote"
+	incoming.Metadata().Put("a", "1")
+	incoming.Metadata().Put("b", "2")
+	wire := make(chan []byte, 1)
+	go func() {
+		writer := bufio.NewWriter(remote)
+		frame, err := incoming.writeFrame(writer)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Flush())
+		wire <- frame
+	}()
+
+	read, err := adapter.ReadMessage()
+	assert.NoError(t, err)
+	go func() {
+		assert.NoError(t, adapter.WriteMessage(read))
+	}()
+	echo, err := other.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "incoming", echo.PayloadGetString())
+	assert.NoError(t, capture.Close())
+
+	records, err := ReadCapture(path)
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+	assert.Equal(t, CaptureFrame, records[0].Kind)
+	assert.Equal(t, "receive", records[0].Direction)
+	assert.Equal(t, "pipe:pipe", records[0].Peer)
+	assert.Equal(t, <-wire, records[0].Frame)
+	assert.Equal(t, "send", records[1].Direction)
+
+	decoded, err := records[1].Decode()
+	assert.NoError(t, err)
+	assert.Equal(t, incoming.ID(), decoded.ID())
+	assert.Equal(t, "remote", decoded.Origin())
+	assert.Equal(t, "incoming", decoded.PayloadGetString())
+}
+
+func TestCaptureAdapterWithoutFrames(t *testing.T) {
+	capture, path, cleanup := newTestCapture(t)
+	defer cleanup()
+
+	inner := new(MockAdapter)
+	inner.On("RemoteAddress").Return("tcp:127.0.0.1:4000")
+	assert.Equal(t, inner, capture.Adapter(inner))
+	assert.NoError(t, capture.Close())
+
+	records, err := ReadCapture(path)
+	assert.NoError(t, err)
+	assert.Len(t, records, 0)
+}
+
+func TestReplayAdapter(t *testing.T) {
+	start := time.Now().UTC()
+	record := func(offset time.Duration, direction string, peer string, payload string) *CaptureRecord {
+		m := NewMessageFromString(payload)
+		return &CaptureRecord{Time: start.Add(offset), Kind: CaptureMessage, Direction: direction, Peer: peer,
+			Message: &CapturedMessage{ID: m.ID(), CreatedAt: m.createdAt, Priority: PriorityNormal, Payload: m.payload}}
+	}
+	records := []*CaptureRecord{
+		record(0, "receive", "a", "first"),
+		record(10*time.Millisecond, "send", "a", "reply"),
+		record(50*time.Millisecond, "receive", "b", "other"),
+		record(200*time.Millisecond, "receive", "a", "second"),
+	}
+
+	adapter := newReplayAdapter(records, ReplayConfig{Peer: "a", Speed: 4})
+	begin := time.Now()
+	for _, expected := range []string{"first", "second"} {
+		m, err := adapter.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, m.PayloadGetString())
+	}
+	elapsed := time.Since(begin)
+	assert.True(t, elapsed >= 50*time.Millisecond, elapsed.String())
+	assert.True(t, elapsed < 150*time.Millisecond, elapsed.String())
+
+	select {
+	case <-adapter.Done():
+	default:
+		assert.Fail(t, "replay not done")
+	}
+
+	assert.NoError(t, adapter.WriteMessage(NewMessageFromString("answer")))
+	assert.Len(t, adapter.Sent(), 1)
+
+	go adapter.Close()
+	_, err := adapter.ReadMessage()
+	assert.Equal(t, DisconnectedError, err)
+
+	adapter = newReplayAdapter(records, ReplayConfig{NoDelay: true})
+	begin = time.Now()
+	for i := 0; i < 3; i++ {
+		_, err := adapter.ReadMessage()
+		assert.NoError(t, err)
+	}
+	assert.True(t, time.Since(begin) < 50*time.Millisecond)
+}
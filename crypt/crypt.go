@@ -85,8 +85,14 @@ func (pk *PrivKey) calcBytes() {
 
 // Decrypt returns decrypted data that was encrypted with the given pub key
 func (pk *PrivKey) Decrypt(pub *PubKey, encryptedData []byte) ([]byte, error) {
-	if len(encryptedData) < encryptedPassLen {
-		return nil, errors.Errorf("unexpected data length, min: %d, current: %d", encryptedPassLen, len(encryptedData))
+	return pk.DecryptWithAAD(pub, encryptedData, nil)
+}
+
+// DecryptWithAAD returns decrypted data that was encrypted with the given pub key
+// and the same additional authenticated data
+func (pk *PrivKey) DecryptWithAAD(pub *PubKey, encryptedData []byte, aad []byte) ([]byte, error) {
+	if len(encryptedData) < encryptedPassLen+nonceLen {
+		return nil, errors.Errorf("unexpected data length, min: %d, current: %d", encryptedPassLen+nonceLen, len(encryptedData))
 	}
 
 	encryptedPass := encryptedData[:encryptedPassLen]
@@ -97,7 +103,7 @@ func (pk *PrivKey) Decrypt(pub *PubKey, encryptedData []byte) ([]byte, error) {
 
 	nonce := encryptedData[encryptedPassLen : encryptedPassLen+nonceLen]
 	encryptedData = encryptedData[encryptedPassLen+nonceLen:]
-	decryptedData, err := dec(decryptedPass, nonce, encryptedData)
+	decryptedData, err := dec(decryptedPass, nonce, encryptedData, aad)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed decrypt data")
 	}
@@ -141,19 +147,19 @@ func hash(data []byte) []byte {
 	return d
 }
 
-func enc(pass []byte, nonce []byte, data []byte) []byte {
+func enc(pass []byte, nonce []byte, data []byte, aad []byte) []byte {
 	block, err := aes.NewCipher(pass)
 	must.NoError(err, "unexpected error during create cipher")
 
 	aead, err := cipher.NewGCM(block)
 	must.NoError(err, "unexpected error during create gcm")
 
-	encryptedData := aead.Seal(nil, nonce, data, nil)
+	encryptedData := aead.Seal(nil, nonce, data, aad)
 
 	return encryptedData
 }
 
-func dec(pass []byte, nonce []byte, data []byte) ([]byte, error) {
+func dec(pass []byte, nonce []byte, data []byte, aad []byte) ([]byte, error) {
 	block, err := aes.NewCipher(pass)
 	if err != nil {
 		return nil, err
@@ -164,7 +170,7 @@ func dec(pass []byte, nonce []byte, data []byte) ([]byte, error) {
 		return nil, err
 	}
 
-	decryptedData, err := aesgcm.Open(nil, nonce, data, nil)
+	decryptedData, err := aesgcm.Open(nil, nonce, data, aad)
 	if err != nil {
 		return nil, err
 	}
@@ -184,12 +190,18 @@ func genNonce() []byte {
 // Encrypt hash the data, encrypt the data with the hash, encrypt the hash with pk
 // and store the encrypted hash with the nonce within the data
 func (pk *PubKey) Encrypt(priv *PrivKey, decrypted []byte) ([]byte, error) {
+	return pk.EncryptWithAAD(priv, decrypted, nil)
+}
+
+// EncryptWithAAD works like Encrypt and additionally authenticates aad.
+// The aad is not part of the result, the receiver must provide the same aad to decrypt
+func (pk *PubKey) EncryptWithAAD(priv *PrivKey, decrypted []byte, aad []byte) ([]byte, error) {
 	hash := hash(decrypted)
 
 	nonce := genNonce()
 
 	decryptedPass := hash // use the hash of the msg as its pass
-	encryptedData := enc(decryptedPass, nonce, decrypted)
+	encryptedData := enc(decryptedPass, nonce, decrypted, aad)
 
 	encryptedPass, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, pk.pub, decryptedPass, nil)
 	if err != nil {
@@ -48,3 +48,21 @@ func TestDecryptNegative(t *testing.T) {
 	_, err = pk1.Decrypt(&pk2.PubKey, encryptedData)
 	assert.Error(t, err)
 }
+
+func TestEncryptWithAAD(t *testing.T) {
+	pk1 := Generate()
+	pk2 := Generate()
+
+	encryptedData, err := pk1.PubKey.EncryptWithAAD(pk2, []byte("hello"), []byte("seq:1"))
+	assert.NoError(t, err)
+
+	decrypted, err := pk1.DecryptWithAAD(&pk2.PubKey, encryptedData, []byte("seq:1"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(decrypted))
+
+	_, err = pk1.DecryptWithAAD(&pk2.PubKey, encryptedData, []byte("seq:2"))
+	assert.Error(t, err)
+
+	_, err = pk1.Decrypt(&pk2.PubKey, encryptedData)
+	assert.Error(t, err)
+}
@@ -0,0 +1,53 @@
+package go2p
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorRoute is the route of the error replies sent by middlewares that reject messages (see ACL).
+// Register a handler for this route in the RoutingTable to receive them
+const ErrorRoute = "go2p/error"
+
+// ErrorReply is the content of a message sent to the ErrorRoute
+type ErrorReply struct {
+	// Kind is the name of the middleware that rejected the message
+	Kind string `json:"kind"`
+	// Route is the route of the rejected message
+	Route string `json:"route"`
+	// MessageID is the id of the rejected message
+	MessageID string `json:"messageId"`
+	// Error describes why the message was rejected
+	Error string `json:"error"`
+}
+
+// ParseErrorReply reads the ErrorReply from a message received on the ErrorRoute
+func ParseErrorReply(msg *Message) (*ErrorReply, error) {
+	reply := new(ErrorReply)
+	if err := json.Unmarshal(msg.PayloadGet(), reply); err != nil {
+		return nil, errors.Wrap(err, "invalid error reply")
+	}
+
+	return reply, nil
+}
+
+// sendErrorReply sends an ErrorReply for the rejected message back to the peer.
+// No reply is sent for rejected error replies to avoid loops
+func sendErrorReply(pipe *Pipe, kind string, route string, rejected *Message, cause error) error {
+	if route == ErrorRoute {
+		return nil
+	}
+
+	content, err := json.Marshal(&ErrorReply{
+		Kind:      kind,
+		Route:     route,
+		MessageID: rejected.ID(),
+		Error:     cause.Error(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not serialize error reply")
+	}
+
+	return pipe.Send(NewMessageRoutedFromData(ErrorRoute, content))
+}
@@ -1,18 +1,13 @@
 module github.com/v-braun/go2p
 
-go 1.12
+go 1.22
 
 require (
-	github.com/azer/logger v1.0.0 // indirect
-	github.com/azer/yolo v0.0.0-20180819171155-df2a2bdacdd0 // indirect
 	github.com/emirpasic/gods v1.12.0
 	github.com/fatih/color v1.7.0
-	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/flynn/noise v1.0.0
 	github.com/google/uuid v1.1.1
-	github.com/gorilla/websocket v1.4.1 // indirect
-	github.com/mattn/go-colorable v0.1.2 // indirect
-	github.com/mattn/go-isatty v0.0.9 // indirect
-	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
+	github.com/klauspost/compress v1.18.0
 	github.com/olebedev/emitter v0.0.0-20190110104742-e8d1457e6aee
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
 	github.com/pkg/errors v0.8.1
@@ -21,5 +16,24 @@ require (
 	github.com/v-braun/awaiter v0.0.0-20190702174054-2d2c95947d12
 	github.com/v-braun/go-must v0.0.0-20190710195319-bad755225388
 	github.com/x-cray/logrus-prefixed-formatter v0.5.2
-	golang.org/x/crypto v0.0.0-20190909091759-094676da4a83 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
+)
+
+require (
+	github.com/azer/is-terminal v1.0.0 // indirect
+	github.com/azer/logger v1.0.0 // indirect
+	github.com/azer/yolo v0.0.0-20180819171155-df2a2bdacdd0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/fsnotify/fsnotify v1.4.7 // indirect
+	github.com/gorilla/websocket v1.4.1 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/mattn/go-colorable v0.1.2 // indirect
+	github.com/mattn/go-isatty v0.0.9 // indirect
+	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.1 // indirect
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf // indirect
+	golang.org/x/text v0.3.6 // indirect
 )
@@ -0,0 +1,368 @@
+package go2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// jsonSchema is a compiled subset of JSON Schema.
+//
+// Supported keywords: type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum and exclusiveMaximum.
+// Annotations (see jsonSchemaAnnotations) are ignored, all other keywords
+// are rejected when the schema is compiled, so a schema is never checked partially
+type jsonSchema struct {
+	types                []string
+	enum                 []interface{}
+	constValue           interface{}
+	hasConst             bool
+	properties           map[string]*jsonSchema
+	required             []string
+	additionalProperties *jsonSchema
+	noAdditional         bool
+	items                *jsonSchema
+	minItems             *int
+	maxItems             *int
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+}
+
+var jsonSchemaTypes = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true,
+	"integer": true, "boolean": true, "null": true,
+}
+
+// jsonSchemaAnnotations are keywords without an effect on the validation
+var jsonSchemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "default": true, "examples": true,
+}
+
+func compileJSONSchema(data []byte) (*jsonSchema, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.Wrap(err, "invalid json schema")
+	}
+
+	return compileJSONSchemaValue(raw, "$")
+}
+
+func compileJSONSchemaValue(raw interface{}, path string) (*jsonSchema, error) {
+	s := new(jsonSchema)
+
+	if allow, ok := raw.(bool); ok {
+		if !allow {
+			s.types = []string{}
+		}
+		return s, nil
+	}
+
+	def, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.Errorf("%s: schema must be an object", path)
+	}
+
+	var err error
+	for key, value := range def {
+		switch key {
+		case "type":
+			s.types, err = compileSchemaTypes(value, path)
+		case "enum":
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, errors.Errorf("%s: enum must be an array", path)
+			}
+			s.enum = list
+		case "const":
+			s.constValue = value
+			s.hasConst = true
+		case "properties":
+			props, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, errors.Errorf("%s: properties must be an object", path)
+			}
+			s.properties = make(map[string]*jsonSchema)
+			for name, prop := range props {
+				if s.properties[name], err = compileJSONSchemaValue(prop, path+"."+name); err != nil {
+					return nil, err
+				}
+			}
+		case "required":
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, errors.Errorf("%s: required must be an array", path)
+			}
+			for _, name := range list {
+				str, ok := name.(string)
+				if !ok {
+					return nil, errors.Errorf("%s: required must contain strings", path)
+				}
+				s.required = append(s.required, str)
+			}
+		case "additionalProperties":
+			if allow, ok := value.(bool); ok {
+				s.noAdditional = !allow
+			} else {
+				s.additionalProperties, err = compileJSONSchemaValue(value, path+".*")
+			}
+		case "items":
+			s.items, err = compileJSONSchemaValue(value, path+"[]")
+		case "minItems":
+			s.minItems, err = schemaInt(value, key, path)
+		case "maxItems":
+			s.maxItems, err = schemaInt(value, key, path)
+		case "minLength":
+			s.minLength, err = schemaInt(value, key, path)
+		case "maxLength":
+			s.maxLength, err = schemaInt(value, key, path)
+		case "pattern":
+			str, ok := value.(string)
+			if !ok {
+				return nil, errors.Errorf("%s: pattern must be a string", path)
+			}
+			if s.pattern, err = regexp.Compile(str); err != nil {
+				return nil, errors.Wrapf(err, "%s: invalid pattern", path)
+			}
+		case "minimum":
+			s.minimum, err = schemaNumber(value, key, path)
+		case "maximum":
+			s.maximum, err = schemaNumber(value, key, path)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = schemaNumber(value, key, path)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = schemaNumber(value, key, path)
+		default:
+			if !jsonSchemaAnnotations[key] {
+				return nil, errors.Errorf("%s: unsupported keyword %q", path, key)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func compileSchemaTypes(value interface{}, path string) ([]string, error) {
+	var types []string
+	switch v := value.(type) {
+	case string:
+		types = []string{v}
+	case []interface{}:
+		for _, t := range v {
+			str, ok := t.(string)
+			if !ok {
+				return nil, errors.Errorf("%s: type must contain strings", path)
+			}
+			types = append(types, str)
+		}
+	default:
+		return nil, errors.Errorf("%s: type must be a string or an array", path)
+	}
+
+	for _, t := range types {
+		if !jsonSchemaTypes[t] {
+			return nil, errors.Errorf("%s: unknown type %s", path, t)
+		}
+	}
+
+	return types, nil
+}
+
+func schemaNumber(value interface{}, key string, path string) (*float64, error) {
+	number, ok := value.(float64)
+	if !ok {
+		return nil, errors.Errorf("%s: %s must be a number", path, key)
+	}
+
+	return &number, nil
+}
+
+func schemaInt(value interface{}, key string, path string) (*int, error) {
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != math.Trunc(number) {
+		return nil, errors.Errorf("%s: %s must be a non negative integer", path, key)
+	}
+
+	result := int(number)
+	return &result, nil
+}
+
+// validate checks the json document against the schema
+func (s *jsonSchema) validate(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return errors.Wrap(err, "invalid json")
+	}
+	if decoder.More() {
+		return errors.New("invalid json: unexpected data after the document")
+	}
+
+	return s.validateValue(value, "$")
+}
+
+func (s *jsonSchema) validateValue(value interface{}, path string) error {
+	if s.types != nil && !s.matchesType(value) {
+		return errors.Errorf("%s: expected %v, got %s", path, s.types, jsonTypeOf(value))
+	}
+
+	if s.hasConst && !reflect.DeepEqual(s.constValue, value) {
+		return errors.Errorf("%s: expected %v", path, s.constValue)
+	}
+
+	if s.enum != nil && !containsValue(s.enum, value) {
+		return errors.Errorf("%s: value not in %v", path, s.enum)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return s.validateObject(v, path)
+	case []interface{}:
+		return s.validateArray(v, path)
+	case string:
+		return s.validateString(v, path)
+	case float64:
+		return s.validateNumber(v, path)
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) validateObject(object map[string]interface{}, path string) error {
+	for _, name := range s.required {
+		if _, found := object[name]; !found {
+			return errors.Errorf("%s: missing property %s", path, name)
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if prop, found := s.properties[name]; found {
+			if err := prop.validateValue(object[name], path+"."+name); err != nil {
+				return err
+			}
+		} else if s.noAdditional {
+			return errors.Errorf("%s: unexpected property %s", path, name)
+		} else if s.additionalProperties != nil {
+			if err := s.additionalProperties.validateValue(object[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) validateArray(array []interface{}, path string) error {
+	if s.minItems != nil && len(array) < *s.minItems {
+		return errors.Errorf("%s: expected at least %d items", path, *s.minItems)
+	}
+	if s.maxItems != nil && len(array) > *s.maxItems {
+		return errors.Errorf("%s: expected at most %d items", path, *s.maxItems)
+	}
+
+	if s.items != nil {
+		for i, item := range array {
+			if err := s.items.validateValue(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) validateString(str string, path string) error {
+	length := utf8.RuneCountInString(str)
+	if s.minLength != nil && length < *s.minLength {
+		return errors.Errorf("%s: expected at least %d characters", path, *s.minLength)
+	}
+	if s.maxLength != nil && length > *s.maxLength {
+		return errors.Errorf("%s: expected at most %d characters", path, *s.maxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		return errors.Errorf("%s: does not match %s", path, s.pattern)
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) validateNumber(number float64, path string) error {
+	if s.minimum != nil && number < *s.minimum {
+		return errors.Errorf("%s: expected >= %v", path, *s.minimum)
+	}
+	if s.maximum != nil && number > *s.maximum {
+		return errors.Errorf("%s: expected <= %v", path, *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && number <= *s.exclusiveMinimum {
+		return errors.Errorf("%s: expected > %v", path, *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && number >= *s.exclusiveMaximum {
+		return errors.Errorf("%s: expected < %v", path, *s.exclusiveMaximum)
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) matchesType(value interface{}) bool {
+	actual := jsonTypeOf(value)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONSchema(t *testing.T) {
+	validate, err := JSONSchema([]byte(`{
+		"type": "object",
+		"required": ["name", "port"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 8, "pattern": "^[a-z]+$"},
+			"port": {"type": "integer", "minimum": 1, "exclusiveMaximum": 65536},
+			"mode": {"enum": ["fast", "safe"]},
+			"version": {"const": 1},
+			"ratio": {"type": ["number", "null"], "maximum": 1, "exclusiveMinimum": 0},
+			"tags": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 2},
+			"labels": {"type": "object", "additionalProperties": {"type": "string"}}
+		}
+	}`))
+	assert.NoError(t, err)
+
+	valid := []string{
+		`{"name": "node", "port": 80}`,
+		`{"name": "node", "port": 65535, "mode": "safe", "version": 1, "ratio": 0.5}`,
+		`{"name": "node", "port": 80, "ratio": null, "tags": ["a", "b"], "labels": {"a": "b"}}`,
+	}
+	for _, doc := range valid {
+		assert.NoError(t, validate([]byte(doc)), doc)
+	}
+
+	invalid := []string{
+		`not json`,
+		`{"name": "node", "port": 80} {}`,
+		`[]`,
+		`{"name": "node"}`,
+		`{"name": "", "port": 80}`,
+		`{"name": "toolongname", "port": 80}`,
+		`{"name": "Node", "port": 80}`,
+		`{"name": "node", "port": 80.5}`,
+		`{"name": "node", "port": 0}`,
+		`{"name": "node", "port": 65536}`,
+		`{"name": "node", "port": 80, "mode": "slow"}`,
+		`{"name": "node", "port": 80, "version": 2}`,
+		`{"name": "node", "port": 80, "ratio": 0}`,
+		`{"name": "node", "port": 80, "ratio": 1.5}`,
+		`{"name": "node", "port": 80, "tags": []}`,
+		`{"name": "node", "port": 80, "tags": ["a", "b", "c"]}`,
+		`{"name": "node", "port": 80, "tags": [1]}`,
+		`{"name": "node", "port": 80, "labels": {"a": 1}}`,
+		`{"name": "node", "port": 80, "other": true}`,
+	}
+	for _, doc := range invalid {
+		assert.Error(t, validate([]byte(doc)), doc)
+	}
+}
+
+func TestJSONSchemaInvalid(t *testing.T) {
+	schemas := []string{
+		`not json`,
+		`[]`,
+		`{"type": "text"}`,
+		`{"type": 1}`,
+		`{"required": "name"}`,
+		`{"minLength": -1}`,
+		`{"maximum": "1"}`,
+		`{"pattern": "["}`,
+		`{"properties": {"name": 1}}`,
+		`{"$ref": "#/definitions/name"}`,
+		`{"anyOf": [{"type": "string"}]}`,
+		`{"properties": {"name": {"format": "email"}}}`,
+		`{"items": {"not": {"type": "null"}}}`,
+	}
+
+	for _, schema := range schemas {
+		_, err := JSONSchema([]byte(schema))
+		assert.Error(t, err, schema)
+	}
+
+	assert.Panics(t, func() { MustJSONSchema(`{"type": "text"}`) })
+	assert.Error(t, MustJSONSchema(`false`)([]byte(`{}`)))
+	assert.NoError(t, MustJSONSchema(`true`)([]byte(`{}`)))
+
+	_, err := JSONSchema([]byte(`{"$schema": "http://json-schema.org/draft-07/schema#", "title": "t", "description": "d", "type": "object"}`))
+	assert.NoError(t, err)
+}
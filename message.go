@@ -6,6 +6,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/v-braun/go-must"
 
@@ -26,16 +27,31 @@ func handleReadWriteErr(err error, msg string) error {
 		if strings.Contains(netErrMsg, "use of closed network connection") {
 			return DisconnectedError
 		}
+		if strings.Contains(netErrMsg, "connection reset by peer") {
+			return DisconnectedError
+		}
 	}
 
 	return errors.Wrap(err, msg)
 }
 
+// maxPayloadSize limits the payload of a frame,
+// larger frames are rejected before they are read
+const maxPayloadSize = 256 << 20
+
 // Message represents a p2p message
 type Message struct {
-	payload  []byte
-	metadata maps.Map
-	localID  string
+	payload   []byte
+	metadata  maps.Map
+	id        uuid.UUID
+	createdAt time.Time
+	origin    string
+	priority  Priority
+	deadline  time.Time
+	// control is the name of the middleware a control message is addressed to
+	control string
+	// encoding is the compression of the payload (see Compress)
+	encoding CompressionAlgorithm
 }
 
 // NewMessageFromString creates a new Message from the given string
@@ -55,15 +71,86 @@ func NewMessage() *Message {
 	m := new(Message)
 	m.payload = []byte{}
 	m.metadata = hashmap.New()
-	m.localID = uuid.New().String()
+	m.id = uuid.New()
+	m.createdAt = time.Now()
+	m.priority = PriorityNormal
 	return m
 }
 
+// Clone returns a copy of the message with its own payload and metadata.
+// The copy keeps the id, origin, priority and deadline,
+// so forwarded messages can still be recognized by the receivers
+func (m *Message) Clone() *Message {
+	c := new(Message)
+	*c = *m
+	c.payload = append([]byte{}, m.payload...)
+	c.metadata = hashmap.New()
+	for _, key := range m.metadata.Keys() {
+		value, _ := m.metadata.Get(key)
+		c.metadata.Put(key, value)
+	}
+
+	return c
+}
+
 // Metadata returns a map of metadata assigned to this message
 func (m *Message) Metadata() maps.Map {
 	return m.metadata
 }
 
+// ID returns the globally unique id of the message.
+// The id is assigned on creation and transmitted within the message envelope
+func (m *Message) ID() string {
+	return m.id.String()
+}
+
+// CreatedAt returns the time when the message was created by its origin
+func (m *Message) CreatedAt() time.Time {
+	return m.createdAt
+}
+
+// Origin returns the identity of the NetworkConnection that sent the message first.
+// The value is empty until the message was sent
+func (m *Message) Origin() string {
+	return m.origin
+}
+
+// Priority returns the send priority of the message
+func (m *Message) Priority() Priority {
+	return m.priority
+}
+
+// SetPriority sets the send priority of the message.
+// Messages with a higher priority are preferred by the peer send loop
+// but lower priorities still get their share of the bandwidth.
+// Messages that middlewares send with Pipe.Send bypass the send queue, their priority is ignored.
+// Values out of range are clamped to PriorityControl or PriorityBulk
+func (m *Message) SetPriority(priority Priority) {
+	m.priority = priority.clamp()
+}
+
+// Deadline returns the time after that the message should be dropped.
+// A zero value means the message does not expire
+func (m *Message) Deadline() time.Time {
+	return m.deadline
+}
+
+// SetDeadline sets the time after that the message is useless for the receiver.
+// Expired messages are dropped before they are written and discarded on receive
+func (m *Message) SetDeadline(deadline time.Time) {
+	m.deadline = deadline
+}
+
+// SetTTL sets the deadline of the message relative to its creation time
+func (m *Message) SetTTL(ttl time.Duration) {
+	m.deadline = m.createdAt.Add(ttl)
+}
+
+// Expired returns true if the deadline of the message has passed
+func (m *Message) Expired() bool {
+	return !m.deadline.IsZero() && time.Now().After(m.deadline)
+}
+
 // ReadFromConn read all data from the given conn object into the payload
 // of the message instance
 func (m *Message) ReadFromConn(c net.Conn) error {
@@ -72,56 +159,103 @@ func (m *Message) ReadFromConn(c net.Conn) error {
 	return err
 }
 
-// ReadFromReader read all data from the given reader object into the payload
-// of the message instance
+// ReadFromReader read all data from the given reader object into the envelope
+// and payload of the message instance
 func (m *Message) ReadFromReader(reader *bufio.Reader) error {
+	_, err := m.readFrame(reader)
+	return err
+}
+
+// readFrame reads the envelope and payload from the given reader
+// and returns the frame as it was read
+func (m *Message) readFrame(reader *bufio.Reader) ([]byte, error) {
 	must.ArgNotNil(reader, "reader")
 
-	sizeBuffer := make([]byte, 4)
+	sizeBuffer := make([]byte, 8)
 
 	if err := read(reader, len(sizeBuffer), sizeBuffer, "failed read size"); err != nil {
-		return err
+		return nil, err
+	}
+
+	envelopeSize := int(binary.BigEndian.Uint32(sizeBuffer[:4]))
+	size := int(binary.BigEndian.Uint32(sizeBuffer[4:]))
+	if envelopeSize > maxEnvelopeSize || size > maxPayloadSize {
+		return nil, errors.Errorf("frame too large (envelope: %d, payload: %d)", envelopeSize, size)
+	}
+
+	frame := make([]byte, len(sizeBuffer)+envelopeSize+size)
+	copy(frame, sizeBuffer)
+	envelopeBuffer := frame[len(sizeBuffer) : len(sizeBuffer)+envelopeSize]
+
+	if err := read(reader, envelopeSize, envelopeBuffer, "failed read envelope"); err != nil {
+		return nil, err
 	}
 
-	size := int(binary.BigEndian.Uint32(sizeBuffer))
+	if err := m.unmarshalEnvelope(envelopeBuffer); err != nil {
+		return nil, err
+	}
 
-	payloadBuffer := make([]byte, size)
+	payloadBuffer := frame[len(sizeBuffer)+envelopeSize:]
 
 	if err := read(reader, size, payloadBuffer, "failed read payload"); err != nil {
-		return err
+		return nil, err
 	}
 
-	m.payload = payloadBuffer
+	m.payload = payloadBuffer[:size:size]
 
-	return nil
+	return frame, nil
 }
 
-// WriteIntoConn writes the message payload into the given conn instance
+// WriteIntoConn writes the message envelope and payload into the given conn instance
 func (m *Message) WriteIntoConn(c net.Conn) error {
 	writer := bufio.NewWriter(c)
 	err := m.WriteIntoWriter(writer)
 	return err
 }
 
-// WriteIntoWriter writes the message payload into the given writer instance
+// WriteIntoWriter writes the message envelope and payload into the given writer instance
 func (m *Message) WriteIntoWriter(writer *bufio.Writer) error {
+	if err := m.writeInto(writer); err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+// writeInto writes the message envelope and payload into the given writer
+// without flushing it
+func (m *Message) writeInto(writer *bufio.Writer) error {
+	_, err := m.writeFrame(writer)
+	return err
+}
+
+// writeFrame writes the message envelope and payload into the given writer
+// without flushing it and returns the frame as it was written
+func (m *Message) writeFrame(writer *bufio.Writer) ([]byte, error) {
 	must.ArgNotNil(writer, "writer")
 
 	payload := m.payload
+	if len(payload) > maxPayloadSize {
+		return nil, errors.Errorf("payload exceeds %d bytes (len: %d)", maxPayloadSize, len(payload))
+	}
 
-	size := uint32(len(payload))
-	sizeBuffer := make([]byte, 4)
+	envelope, err := m.marshalEnvelope()
+	if err != nil {
+		return nil, err
+	}
 
-	binary.BigEndian.PutUint32(sizeBuffer, size)
+	frame := make([]byte, 8+len(envelope)+len(payload))
 
-	if err := write(writer, sizeBuffer, "failed write size buffer"); err != nil {
-		return err
-	}
-	if err := write(writer, payload, "failed write payload"); err != nil {
-		return err
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(envelope)))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	copy(frame[8:], envelope)
+	copy(frame[8+len(envelope):], payload)
+
+	if err := write(writer, frame, "failed write frame"); err != nil {
+		return nil, err
 	}
 
-	return writer.Flush()
+	return frame, nil
 }
 
 // PayloadSetString sets the given string as payload of the message
@@ -0,0 +1,169 @@
+package go2p
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// envelope fields are encoded as tag (1 byte), length (2 bytes) and value
+// unknown tags are skipped so that new fields can be added later.
+// The envelope is written in front of the payload and is not protected by the middlewares,
+// a secure channel (see NoiseWith) transmits a copy of it within the encrypted payload
+const (
+	envelopeFieldID       byte = 1
+	envelopeFieldCreated  byte = 2
+	envelopeFieldOrigin   byte = 3
+	envelopeFieldExpires  byte = 4
+	envelopeFieldControl  byte = 5
+	envelopeFieldEncoding byte = 6
+)
+
+const envelopeFieldHeaderLen = 3
+
+// MaxIdentityLength is the maximum length in bytes of an identity
+// and of the origin of a message
+const MaxIdentityLength = 1024
+
+// maxEnvelopeSize limits the envelope of a received frame.
+// It holds the known fields with the longest origin and leaves room for fields added later
+const maxEnvelopeSize = 4096
+
+func putEnvelopeField(buffer []byte, tag byte, value []byte) []byte {
+	header := make([]byte, envelopeFieldHeaderLen)
+	header[0] = tag
+	binary.BigEndian.PutUint16(header[1:], uint16(len(value)))
+
+	buffer = append(buffer, header...)
+	buffer = append(buffer, value...)
+	return buffer
+}
+
+func (m *Message) marshalEnvelope() ([]byte, error) {
+	if len(m.origin) > MaxIdentityLength {
+		return nil, errors.Errorf("origin exceeds %d bytes (len: %d)", MaxIdentityLength, len(m.origin))
+	}
+
+	result := []byte{}
+
+	id := m.id
+	result = putEnvelopeField(result, envelopeFieldID, id[:])
+
+	created := make([]byte, 8)
+	binary.BigEndian.PutUint64(created, uint64(m.createdAt.UnixNano()))
+	result = putEnvelopeField(result, envelopeFieldCreated, created)
+
+	if m.origin != "" {
+		result = putEnvelopeField(result, envelopeFieldOrigin, []byte(m.origin))
+	}
+
+	if !m.deadline.IsZero() {
+		deadline := make([]byte, 8)
+		binary.BigEndian.PutUint64(deadline, uint64(m.deadline.UnixNano()))
+		result = putEnvelopeField(result, envelopeFieldExpires, deadline)
+	}
+
+	if m.control != "" {
+		result = putEnvelopeField(result, envelopeFieldControl, []byte(m.control))
+	}
+
+	if m.encoding != CompressionNone {
+		result = putEnvelopeField(result, envelopeFieldEncoding, []byte{byte(m.encoding)})
+	}
+
+	return result, nil
+}
+
+// sealEnvelope returns the envelope followed by the payload,
+// so a secure channel can encrypt and authenticate both together
+func (m *Message) sealEnvelope() ([]byte, error) {
+	envelope, err := m.marshalEnvelope()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]byte, 4, 4+len(envelope)+len(m.payload))
+	binary.BigEndian.PutUint32(result, uint32(len(envelope)))
+	result = append(result, envelope...)
+	result = append(result, m.payload...)
+	return result, nil
+}
+
+// openEnvelope reads the envelope in front of the payload that was created by sealEnvelope.
+// It replaces the envelope fields that were transmitted outside of the secure channel
+// and returns the payload
+func (m *Message) openEnvelope(data []byte) ([]byte, error) {
+	if len(data) < 4 {
+		return nil, errors.Errorf("invalid sealed envelope (len: %d)", len(data))
+	}
+
+	size := int(binary.BigEndian.Uint32(data))
+	data = data[4:]
+	if len(data) < size {
+		return nil, errors.Errorf("invalid sealed envelope (len: %d, expected: %d)", len(data), size)
+	}
+
+	sealed := new(Message)
+	if err := sealed.unmarshalEnvelope(data[:size]); err != nil {
+		return nil, err
+	}
+
+	m.id = sealed.id
+	m.createdAt = sealed.createdAt
+	m.origin = sealed.origin
+	m.deadline = sealed.deadline
+	m.control = sealed.control
+	m.encoding = sealed.encoding
+
+	return data[size:], nil
+}
+
+func (m *Message) unmarshalEnvelope(data []byte) error {
+	for len(data) > 0 {
+		if len(data) < envelopeFieldHeaderLen {
+			return errors.Errorf("invalid envelope field header (len: %d)", len(data))
+		}
+
+		tag := data[0]
+		size := int(binary.BigEndian.Uint16(data[1:envelopeFieldHeaderLen]))
+		data = data[envelopeFieldHeaderLen:]
+		if len(data) < size {
+			return errors.Errorf("invalid envelope field %d (len: %d, expected: %d)", tag, len(data), size)
+		}
+
+		value := data[:size]
+		data = data[size:]
+
+		switch tag {
+		case envelopeFieldID:
+			id, err := uuid.FromBytes(value)
+			if err != nil {
+				return errors.Wrap(err, "invalid envelope id")
+			}
+			m.id = id
+		case envelopeFieldCreated:
+			if len(value) != 8 {
+				return errors.Errorf("invalid envelope timestamp (len: %d)", len(value))
+			}
+			m.createdAt = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+		case envelopeFieldOrigin:
+			m.origin = string(value)
+		case envelopeFieldExpires:
+			if len(value) != 8 {
+				return errors.Errorf("invalid envelope deadline (len: %d)", len(value))
+			}
+			m.deadline = time.Unix(0, int64(binary.BigEndian.Uint64(value)))
+		case envelopeFieldControl:
+			m.control = string(value)
+		case envelopeFieldEncoding:
+			if len(value) != 1 {
+				return errors.Errorf("invalid envelope encoding (len: %d)", len(value))
+			}
+			m.encoding = CompressionAlgorithm(value[0])
+		}
+	}
+
+	return nil
+}
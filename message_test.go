@@ -0,0 +1,125 @@
+package go2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageEnvelope(t *testing.T) {
+	m := NewMessageFromString("hello")
+	m.origin = "peer-1"
+	m.control = "compress"
+	m.encoding = CompressionGzip
+
+	buffer := new(bytes.Buffer)
+	err := m.WriteIntoWriter(bufio.NewWriter(buffer))
+	assert.NoError(t, err)
+
+	result := NewMessage()
+	err = result.ReadFromReader(bufio.NewReader(buffer))
+	assert.NoError(t, err)
+
+	assert.Equal(t, m.ID(), result.ID())
+	assert.Equal(t, m.Origin(), result.Origin())
+	assert.True(t, m.CreatedAt().Equal(result.CreatedAt()))
+	assert.Equal(t, "compress", result.control)
+	assert.Equal(t, CompressionGzip, result.encoding)
+	assert.Equal(t, "hello", result.PayloadGetString())
+}
+
+func TestMessageEnvelopeNegative(t *testing.T) {
+	m := NewMessage()
+
+	err := m.unmarshalEnvelope([]byte{envelopeFieldID})
+	assert.Error(t, err)
+
+	err = m.unmarshalEnvelope([]byte{envelopeFieldID, 0, 4, 1, 2, 3, 4})
+	assert.Error(t, err)
+
+	err = m.unmarshalEnvelope([]byte{envelopeFieldCreated, 0, 1, 1})
+	assert.Error(t, err)
+
+	// unknown fields are skipped
+	err = m.unmarshalEnvelope([]byte{99, 0, 1, 1})
+	assert.NoError(t, err)
+}
+
+func TestMessageFrameLimits(t *testing.T) {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[:4], maxEnvelopeSize+1)
+	_, err := NewMessage().readFrame(bufio.NewReader(bytes.NewReader(header)))
+	assert.Error(t, err)
+
+	header = make([]byte, 8)
+	binary.BigEndian.PutUint32(header[4:], 0xffffffff)
+	_, err = NewMessage().readFrame(bufio.NewReader(bytes.NewReader(header)))
+	assert.Error(t, err)
+
+	m := NewMessageFromString("hello")
+	m.origin = strings.Repeat("a", MaxIdentityLength+1)
+	assert.Error(t, m.WriteIntoWriter(bufio.NewWriter(new(bytes.Buffer))))
+	_, err = m.sealEnvelope()
+	assert.Error(t, err)
+
+	m.origin = strings.Repeat("a", MaxIdentityLength)
+	buffer := new(bytes.Buffer)
+	assert.NoError(t, m.WriteIntoWriter(bufio.NewWriter(buffer)))
+	result := NewMessage()
+	assert.NoError(t, result.ReadFromReader(bufio.NewReader(buffer)))
+	assert.Equal(t, m.origin, result.Origin())
+
+	assert.Panics(t, func() {
+		NewNetworkConnection().WithIdentity(strings.Repeat("a", MaxIdentityLength+1))
+	})
+}
+
+func TestMessageDeadline(t *testing.T) {
+	m := NewMessageFromString("hello")
+	assert.False(t, m.Expired())
+	assert.True(t, m.Deadline().IsZero())
+
+	m.SetTTL(time.Hour)
+	assert.False(t, m.Expired())
+	assert.True(t, m.Deadline().Equal(m.CreatedAt().Add(time.Hour)))
+
+	buffer := new(bytes.Buffer)
+	err := m.WriteIntoWriter(bufio.NewWriter(buffer))
+	assert.NoError(t, err)
+
+	result := NewMessage()
+	err = result.ReadFromReader(bufio.NewReader(buffer))
+	assert.NoError(t, err)
+	assert.True(t, m.Deadline().Equal(result.Deadline()))
+
+	m.SetDeadline(time.Now().Add(-time.Second))
+	assert.True(t, m.Expired())
+}
+
+func TestMessageClone(t *testing.T) {
+	m := NewMessageRoutedFromString("sync/blocks", "hello")
+	m.origin = "peer-1"
+	m.SetPriority(PriorityBulk)
+	m.SetTTL(time.Minute)
+
+	c := m.Clone()
+	assert.Equal(t, m.ID(), c.ID())
+	assert.Equal(t, m.Origin(), c.Origin())
+	assert.Equal(t, m.Priority(), c.Priority())
+	assert.Equal(t, m.Deadline(), c.Deadline())
+	assert.Equal(t, "hello", c.PayloadGetString())
+
+	route, _ := c.Metadata().Get(annotationKey)
+	assert.Equal(t, "sync/blocks", route)
+
+	c.PayloadGet()[0] = 'j'
+	c.Metadata().Put("key", "value")
+	assert.Equal(t, "hello", m.PayloadGetString())
+	_, found := m.Metadata().Get("key")
+	assert.False(t, found)
+}
@@ -0,0 +1,247 @@
+package go2p
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MiddlewareOutcome represents the result of a single middleware execution
+type MiddlewareOutcome int
+
+const (
+	// OutcomeNext is recorded when the middleware returned Next
+	OutcomeNext MiddlewareOutcome = iota
+	// OutcomeStop is recorded when the middleware returned Stop without an error
+	OutcomeStop MiddlewareOutcome = iota
+	// OutcomeError is recorded when the middleware returned an error
+	OutcomeError MiddlewareOutcome = iota
+	// OutcomePanic is recorded when the middleware panicked
+	OutcomePanic MiddlewareOutcome = iota
+)
+
+func (o MiddlewareOutcome) String() string {
+	switch o {
+	case OutcomeNext:
+		return "next"
+	case OutcomeStop:
+		return "stop"
+	case OutcomeError:
+		return "error"
+	case OutcomePanic:
+		return "panic"
+	}
+
+	return fmt.Sprintf("MiddlewareOutcome(%d)", o)
+}
+
+// Metrics receives the instrumentation data of the middleware pipeline.
+// Implementations are called concurrently from all peers and should not block
+type Metrics interface {
+	// ObserveMiddleware is called after each execution of a middleware
+	// with the operation (Send, Receive or Connect), the outcome and the elapsed time
+	ObserveMiddleware(name string, op PipeOperation, outcome MiddlewareOutcome, duration time.Duration)
+}
+
+// DefaultLatencyBuckets are the upper bounds of the histogram buckets used by MiddlewareStats
+var DefaultLatencyBuckets = []time.Duration{
+	time.Microsecond,
+	5 * time.Microsecond,
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// MiddlewareStats is an in memory Metrics implementation that keeps
+// a latency histogram and outcome counters per middleware name and operation
+type MiddlewareStats struct {
+	buckets []time.Duration
+	mutex   *sync.RWMutex
+	entries map[middlewareStatsKey]*middlewareStatsEntry
+}
+
+// MiddlewareStat is a snapshot of the metrics of a middleware for one operation
+type MiddlewareStat struct {
+	// Name of the middleware
+	Name string
+	// Op is the pipe operation the metrics belong to
+	Op PipeOperation
+	// Count is the number of executions
+	Count uint64
+	// Outcomes contains the number of executions per outcome
+	Outcomes map[MiddlewareOutcome]uint64
+	// Total is the sum of all execution durations
+	Total time.Duration
+	// Buckets contains the cumulative number of executions
+	// that took at most Bucket.UpperBound
+	Buckets []HistogramBucket
+}
+
+// HistogramBucket is a single bucket of a latency histogram
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+type middlewareStatsKey struct {
+	name string
+	op   PipeOperation
+}
+
+type middlewareStatsEntry struct {
+	total    int64
+	outcomes [OutcomePanic + 1]uint64
+	buckets  []uint64
+}
+
+var _ Metrics = (*MiddlewareStats)(nil)
+
+// NewMiddlewareStats creates a new MiddlewareStats instance with the DefaultLatencyBuckets.
+// Pass it to NetworkConnectionBuilder.WithMetrics to collect data
+func NewMiddlewareStats() *MiddlewareStats {
+	return NewMiddlewareStatsWithBuckets(DefaultLatencyBuckets)
+}
+
+// NewMiddlewareStatsWithBuckets creates a new MiddlewareStats instance
+// with the provided histogram bucket upper bounds
+func NewMiddlewareStatsWithBuckets(buckets []time.Duration) *MiddlewareStats {
+	s := new(MiddlewareStats)
+	s.buckets = append([]time.Duration{}, buckets...)
+	sort.Slice(s.buckets, func(i, j int) bool { return s.buckets[i] < s.buckets[j] })
+	s.mutex = new(sync.RWMutex)
+	s.entries = make(map[middlewareStatsKey]*middlewareStatsEntry)
+
+	return s
+}
+
+// ObserveMiddleware implements Metrics
+func (s *MiddlewareStats) ObserveMiddleware(name string, op PipeOperation, outcome MiddlewareOutcome, duration time.Duration) {
+	entry := s.entry(middlewareStatsKey{name: name, op: op})
+
+	atomic.AddInt64(&entry.total, int64(duration))
+	atomic.AddUint64(&entry.outcomes[outcome], 1)
+
+	idx := sort.Search(len(s.buckets), func(i int) bool { return duration <= s.buckets[i] })
+	atomic.AddUint64(&entry.buckets[idx], 1)
+}
+
+// Snapshot returns the current metrics of all middlewares ordered by name and operation
+func (s *MiddlewareStats) Snapshot() []MiddlewareStat {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	result := make([]MiddlewareStat, 0, len(s.entries))
+	for key, entry := range s.entries {
+		result = append(result, s.stat(key, entry))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Name != result[j].Name {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Op < result[j].Op
+	})
+
+	return result
+}
+
+// Get returns the current metrics of the middleware with the given name
+// for the provided operation and false if nothing was recorded
+func (s *MiddlewareStats) Get(name string, op PipeOperation) (MiddlewareStat, bool) {
+	key := middlewareStatsKey{name: name, op: op}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	entry, found := s.entries[key]
+	if !found {
+		return MiddlewareStat{}, false
+	}
+
+	return s.stat(key, entry), true
+}
+
+func (s *MiddlewareStats) entry(key middlewareStatsKey) *middlewareStatsEntry {
+	s.mutex.RLock()
+	entry, found := s.entries[key]
+	s.mutex.RUnlock()
+	if found {
+		return entry
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if entry, found := s.entries[key]; found {
+		return entry
+	}
+
+	entry = &middlewareStatsEntry{buckets: make([]uint64, len(s.buckets)+1)}
+	s.entries[key] = entry
+	return entry
+}
+
+func (s *MiddlewareStats) stat(key middlewareStatsKey, entry *middlewareStatsEntry) MiddlewareStat {
+	stat := MiddlewareStat{
+		Name:     key.name,
+		Op:       key.op,
+		Outcomes: make(map[MiddlewareOutcome]uint64),
+		Total:    time.Duration(atomic.LoadInt64(&entry.total)),
+	}
+
+	for outcome := range entry.outcomes {
+		count := atomic.LoadUint64(&entry.outcomes[outcome])
+		stat.Outcomes[MiddlewareOutcome(outcome)] = count
+		stat.Count += count
+	}
+
+	var cumulative uint64
+	for i, upperBound := range s.buckets {
+		cumulative += atomic.LoadUint64(&entry.buckets[i])
+		stat.Buckets = append(stat.Buckets, HistogramBucket{UpperBound: upperBound, Count: cumulative})
+	}
+
+	return stat
+}
+
+// Mean returns the average execution time
+func (s MiddlewareStat) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+
+	return s.Total / time.Duration(s.Count)
+}
+
+// Quantile returns the upper bound of the first bucket that contains
+// at least the fraction q of all executions.
+// If the quantile exceeds the largest bucket the largest upper bound is returned
+func (s MiddlewareStat) Quantile(q float64) time.Duration {
+	if s.Count == 0 || len(s.Buckets) == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(s.Count)))
+	if target == 0 {
+		target = 1
+	}
+
+	for _, bucket := range s.Buckets {
+		if bucket.Count >= target {
+			return bucket.UpperBound
+		}
+	}
+
+	return s.Buckets[len(s.Buckets)-1].UpperBound
+}
@@ -0,0 +1,73 @@
+package go2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareStats(t *testing.T) {
+	stats := NewMiddlewareStatsWithBuckets([]time.Duration{time.Millisecond, time.Microsecond})
+
+	stats.ObserveMiddleware("crypt", Send, OutcomeNext, 500*time.Nanosecond)
+	stats.ObserveMiddleware("crypt", Send, OutcomeNext, 700*time.Microsecond)
+	stats.ObserveMiddleware("crypt", Send, OutcomeError, 2*time.Millisecond)
+	stats.ObserveMiddleware("crypt", Receive, OutcomeStop, time.Microsecond)
+
+	stat, found := stats.Get("crypt", Send)
+	assert.True(t, found)
+	assert.Equal(t, uint64(3), stat.Count)
+	assert.Equal(t, uint64(2), stat.Outcomes[OutcomeNext])
+	assert.Equal(t, uint64(1), stat.Outcomes[OutcomeError])
+	assert.Equal(t, []HistogramBucket{{time.Microsecond, 1}, {time.Millisecond, 2}}, stat.Buckets)
+	assert.Equal(t, time.Microsecond, stat.Quantile(0.3))
+	assert.Equal(t, time.Millisecond, stat.Quantile(0.99))
+	assert.Equal(t, (500*time.Nanosecond+700*time.Microsecond+2*time.Millisecond)/3, stat.Mean())
+
+	_, found = stats.Get("crypt", Connect)
+	assert.False(t, found)
+
+	snapshot := stats.Snapshot()
+	assert.Len(t, snapshot, 2)
+	assert.Equal(t, Send, snapshot[0].Op)
+	assert.Equal(t, Receive, snapshot[1].Op)
+
+	assert.Equal(t, "panic", OutcomePanic.String())
+	assert.Equal(t, "MiddlewareOutcome(42)", MiddlewareOutcome(42).String())
+}
+
+func TestPipeMetrics(t *testing.T) {
+	stats := NewMiddlewareStats()
+	next := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		return Next, nil
+	}
+	fail := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		return Stop, errors.New("fail")
+	}
+	panics := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		panic("fail")
+	}
+
+	peer := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{metrics: stats})
+	process := func(op PipeOperation, mws ...*Middleware) {
+		p := newPipe(peer, newMiddlewares(mws...), op, 0, 0, len(mws))
+		if op == Receive {
+			p.pos = len(mws) - 1
+		}
+		p.process(NewMessage())
+	}
+
+	process(Send, NewMiddleware("next", next), NewMiddleware("fail", fail))
+	process(Receive, NewMiddleware("panic", panics), NewMiddleware("next", next))
+
+	stat, _ := stats.Get("next", Send)
+	assert.Equal(t, uint64(1), stat.Outcomes[OutcomeNext])
+	stat, _ = stats.Get("fail", Send)
+	assert.Equal(t, uint64(1), stat.Outcomes[OutcomeError])
+	stat, _ = stats.Get("next", Receive)
+	assert.Equal(t, uint64(1), stat.Outcomes[OutcomeNext])
+	stat, _ = stats.Get("panic", Receive)
+	assert.Equal(t, uint64(1), stat.Outcomes[OutcomePanic])
+}
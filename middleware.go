@@ -17,23 +17,107 @@ const (
 	Next MiddlewareResult = iota
 )
 
-// MiddlewareFunc represents a middleware implementation function
+// MiddlewareFunc represents a middleware implementation function.
+// It is called for both directions, use pipe.Operation() to distinguish them
 type MiddlewareFunc func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error)
 
+// OnConnect implements MiddlewareHandler, a MiddlewareFunc has no connect logic
+func (f MiddlewareFunc) OnConnect(peer *Peer, pipe *Pipe) error {
+	return nil
+}
+
+// OnSend implements MiddlewareHandler by calling the function
+func (f MiddlewareFunc) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	return f(peer, pipe, msg)
+}
+
+// OnReceive implements MiddlewareHandler by calling the function
+func (f MiddlewareFunc) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	return f(peer, pipe, msg)
+}
+
+// OnDisconnect implements MiddlewareHandler, a MiddlewareFunc has no disconnect logic
+func (f MiddlewareFunc) OnDisconnect(peer *Peer) {}
+
+// MiddlewareHandler represents a middleware that takes part in the whole peer lifecycle
+type MiddlewareHandler interface {
+	// OnConnect is called when a new peer connection is established,
+	// before the first message is processed and before NetworkConnection.OnPeer is fired.
+	// It is called from the middleware closest to the network up to the first one.
+	// Use pipe.Send and pipe.Receive to exchange handshake messages
+	// returning an error disconnects the peer
+	OnConnect(peer *Peer, pipe *Pipe) error
+
+	// OnSend is called for each outgoing message
+	OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error)
+
+	// OnReceive is called for each incoming message
+	OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error)
+
+	// OnDisconnect is called once when the peer is stopped
+	// or when the middleware is removed (see NetworkConnection.Remove).
+	// It is only called if OnConnect was called for the peer
+	OnDisconnect(peer *Peer)
+}
+
+// OrderIndependentHandler can be implemented by a MiddlewareHandler
+// that does not depend on the order of the messages.
+// Such middlewares can process several messages of a peer at once
+// (see NetworkConnectionBuilder.WithPipelineConcurrency)
+type OrderIndependentHandler interface {
+	OrderIndependent() bool
+}
+
+// orderIndependentHandler marks a wrapped handler as order independent
+type orderIndependentHandler struct {
+	MiddlewareHandler
+}
+
+func (h orderIndependentHandler) OrderIndependent() bool {
+	return true
+}
+
+// OrderIndependent marks the handler as order independent.
+// The handler has to be safe for concurrent use
+// and must not depend on the order of the messages of a peer
+func OrderIndependent(name string, handler MiddlewareHandler) (string, MiddlewareHandler) {
+	return name, orderIndependentHandler{handler}
+}
+
 // Middleware represents a wrapped middleware function with
 // additional information for internal usage
 type Middleware struct {
-	execute MiddlewareFunc
-	name    string
-	pos     int
+	handler          MiddlewareHandler
+	name             string
+	pos              int
+	orderIndependent bool
 }
 
 // NewMiddleware wraps the provided action into a Middleware instance
 func NewMiddleware(name string, action MiddlewareFunc) *Middleware {
-	return &Middleware{
+	return NewMiddlewareHandler(name, action)
+}
+
+// NewMiddlewareHandler wraps the provided handler into a Middleware instance
+func NewMiddlewareHandler(name string, handler MiddlewareHandler) *Middleware {
+	m := &Middleware{
 		name:    name,
-		execute: action,
+		handler: handler,
 	}
+
+	if independent, ok := handler.(OrderIndependentHandler); ok {
+		m.orderIndependent = independent.OrderIndependent()
+	}
+
+	return m
+}
+
+func (m *Middleware) execute(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if pipe.Operation() == Receive {
+		return m.handler.OnReceive(peer, pipe, msg)
+	}
+
+	return m.handler.OnSend(peer, pipe, msg)
 }
 
 // String returns the string representation of this instance
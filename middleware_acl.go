@@ -0,0 +1,206 @@
+package go2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ACLRule allows or denies principals to call routes.
+// Principals and routes are glob patterns (see matchPattern), e.g. "config/*"
+// matches "config/set" and all nested routes like "config/users/add".
+// An empty list matches all principals or routes
+type ACLRule struct {
+	Principals []string `json:"principals"`
+	Routes     []string `json:"routes"`
+	Allow      bool     `json:"allow"`
+}
+
+// ACLPolicy is an ordered list of rules, the first rule that matches
+// the principal and the route of a message decides.
+// If no rule matches DefaultAllow decides
+type ACLPolicy struct {
+	Rules        []ACLRule `json:"rules"`
+	DefaultAllow bool      `json:"defaultAllow"`
+}
+
+// ACLError is reported when a message was rejected by the ACL middleware
+type ACLError struct {
+	// Peer is the remote address of the peer
+	Peer string
+	// Principal of the peer (see Peer.Principal)
+	Principal string
+	// Route of the rejected message
+	Route string
+}
+
+func (e *ACLError) Error() string {
+	return fmt.Sprintf("access denied (peer: %s, principal: %s, route: %s)", e.Peer, e.Principal, e.Route)
+}
+
+// ErrorAction implements ErrorActioner, rejected messages are dropped
+func (e *ACLError) ErrorAction() ErrorAction {
+	return ErrorDrop
+}
+
+// ParseACLPolicy reads a policy from json:
+//
+//	{
+//		"rules": [
+//			{"principals": ["admin-*"], "routes": ["config/*"], "allow": true},
+//			{"routes": ["config/*"], "allow": false}
+//		],
+//		"defaultAllow": true
+//	}
+func ParseACLPolicy(data []byte) (*ACLPolicy, error) {
+	policy := new(ACLPolicy)
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, errors.Wrap(err, "invalid acl policy")
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// LoadACLPolicy reads a json policy from the given file (see ParseACLPolicy)
+func LoadACLPolicy(file string) (*ACLPolicy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read acl policy %s", file)
+	}
+
+	return ParseACLPolicy(data)
+}
+
+// Validate returns an error if a rule contains an invalid pattern
+func (p *ACLPolicy) Validate() error {
+	for i, rule := range p.Rules {
+		for _, pattern := range append(append([]string{}, rule.Principals...), rule.Routes...) {
+			for _, segment := range strings.Split(pattern, "/") {
+				if _, err := path.Match(segment, ""); err != nil {
+					return errors.Wrapf(err, "invalid pattern %q in acl rule %d", pattern, i)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Allowed returns true if the principal may call the route,
+// messages without a route are checked with the empty route
+func (p *ACLPolicy) Allowed(principal string, route string) bool {
+	for _, rule := range p.Rules {
+		if matchAny(rule.Principals, principal) && matchAny(rule.Routes, route) {
+			return rule.Allow
+		}
+	}
+
+	return p.DefaultAllow
+}
+
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if matchPattern(pattern, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchPattern matches the "/" separated segments of value against the pattern.
+// Each segment is matched with path.Match, a "**" segment matches any number of segments
+// and a trailing "*" segment matches one or more segments,
+// so "config/*" covers "config/set" and "config/users/add" but not "config"
+func matchPattern(pattern string, value string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(value, "/"))
+}
+
+func matchSegments(pattern []string, value []string) bool {
+	for len(pattern) > 0 {
+		segment := pattern[0]
+		if segment == "**" {
+			for i := 0; i <= len(value); i++ {
+				if matchSegments(pattern[1:], value[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(value) == 0 {
+			return false
+		}
+		if segment == "*" && len(pattern) == 1 {
+			return true
+		}
+		if matched, _ := path.Match(segment, value[0]); !matched {
+			return false
+		}
+
+		pattern, value = pattern[1:], value[1:]
+	}
+
+	return len(value) == 0
+}
+
+type acl struct {
+	policy *ACLPolicy
+	reply  bool
+}
+
+// ACL creates a middleware that authorizes incoming routed messages by the policy.
+// See ACLWith for details
+func ACL(policy *ACLPolicy) (string, MiddlewareFunc) {
+	return ACLWith(policy, false)
+}
+
+// ACLWith creates a middleware that checks the principal of the peer (see Auth)
+// and the route of each incoming message against the policy.
+//
+// Denied messages are dropped and reported with an ACLError,
+// if reply is true an ErrorReply is sent back to the peer on the ErrorRoute.
+// Messages without a route are checked with the empty route,
+// so they are only accepted by rules without routes or by DefaultAllow.
+// The middleware should be placed between Routes and Headers
+func ACLWith(policy *ACLPolicy, reply bool) (string, MiddlewareFunc) {
+	a := &acl{policy: policy, reply: reply}
+
+	return "acl", a.middlewareACLImpl
+}
+
+func (a *acl) middlewareACLImpl(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if pipe.Operation() == Send {
+		return Next, nil
+	}
+
+	route := ""
+	if routeHdr, found := msg.Metadata().Get(annotationKey); found {
+		route, _ = routeHdr.(string)
+	}
+
+	if a.policy.Allowed(peer.Principal(), route) {
+		return Next, nil
+	}
+
+	err := &ACLError{Peer: peer.RemoteAddress(), Principal: peer.Principal(), Route: route}
+	if a.reply {
+		if replyErr := sendErrorReply(pipe, "acl", route, msg, err); replyErr != nil {
+			return Stop, errors.Wrap(replyErr, "could not send acl error reply")
+		}
+	}
+
+	return Stop, err
+}
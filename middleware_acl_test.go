@@ -0,0 +1,98 @@
+package go2p
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestACLPolicy(t *testing.T) {
+	policy, err := ParseACLPolicy([]byte(`{
+		"rules": [
+			{"principals": ["admin-*"], "routes": ["config/*"], "allow": true},
+			{"routes": ["config/*", "debug"], "allow": false}
+		],
+		"defaultAllow": true
+	}`))
+	assert.NoError(t, err)
+
+	assert.True(t, policy.Allowed("admin-1", "config/set"))
+	assert.False(t, policy.Allowed("node-1", "config/set"))
+	assert.False(t, policy.Allowed("", "config/set"))
+	assert.False(t, policy.Allowed("admin-1", "debug"))
+	assert.True(t, policy.Allowed("node-1", "chat"))
+	assert.True(t, policy.Allowed("node-1", "config"))
+
+	// nested routes are covered by the trailing wildcard
+	assert.False(t, policy.Allowed("node-1", "config/users/add"))
+	assert.True(t, policy.Allowed("admin-1", "config/users/add"))
+
+	policy.DefaultAllow = false
+	assert.False(t, policy.Allowed("node-1", "chat"))
+}
+
+func TestACLMatchPattern(t *testing.T) {
+	assert.True(t, matchPattern("config/*", "config/set"))
+	assert.True(t, matchPattern("config/*", "config/a/b"))
+	assert.False(t, matchPattern("config/*", "config"))
+	assert.False(t, matchPattern("config/*", "configs/set"))
+	assert.True(t, matchPattern("config/**", "config"))
+	assert.True(t, matchPattern("**/set", "config/a/set"))
+	assert.False(t, matchPattern("**/set", "config/a/get"))
+	assert.True(t, matchPattern("config/*/add", "config/users/add"))
+	assert.False(t, matchPattern("config/*/add", "config/users/roles/add"))
+	assert.True(t, matchPattern("admin-*", "admin-1"))
+	assert.True(t, matchPattern("*", ""))
+}
+
+func TestACLPolicyInvalid(t *testing.T) {
+	_, err := ParseACLPolicy([]byte(`{"rules": [{"routes": ["config/["]}]}`))
+	assert.Error(t, err)
+
+	_, err = ParseACLPolicy([]byte(`{"rules": 1}`))
+	assert.Error(t, err)
+
+	_, err = LoadACLPolicy(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestLoadACLPolicy(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.json")
+	err := ioutil.WriteFile(file, []byte(`{"rules": [{"principals": ["admin"], "allow": true}]}`), 0600)
+	assert.NoError(t, err)
+
+	policy, err := LoadACLPolicy(file)
+	assert.NoError(t, err)
+	assert.True(t, policy.Allowed("admin", "config/set"))
+	assert.False(t, policy.Allowed("guest", "config/set"))
+}
+
+func TestACLMiddleware(t *testing.T) {
+	adapter := new(MockAdapter)
+	adapter.On("RemoteAddress").Return("127.0.0.1:4000")
+	peer := newPeer(adapter, newMiddlewareChain(), &peerConfig{})
+	peer.setPrincipal("guest")
+
+	policy := &ACLPolicy{Rules: []ACLRule{{Principals: []string{"admin"}, Routes: []string{"config/*"}, Allow: true}}, DefaultAllow: false}
+	m := NewMiddleware(ACL(policy))
+
+	_, err := m.handler.OnReceive(peer, newPipe(peer, newMiddlewares(m), Receive, 0, 0, 1), NewMessageRoutedFromString("config/set", "x"))
+	if assert.IsType(t, &ACLError{}, err) {
+		assert.Equal(t, "guest", err.(*ACLError).Principal)
+		assert.Equal(t, "config/set", err.(*ACLError).Route)
+	}
+
+	_, err = m.handler.OnReceive(peer, newPipe(peer, newMiddlewares(m), Receive, 0, 0, 1), NewMessageRoutedFromString("config/users/add", "x"))
+	assert.IsType(t, &ACLError{}, err)
+
+	// messages without a route are decided by DefaultAllow
+	_, err = m.handler.OnReceive(peer, newPipe(peer, newMiddlewares(m), Receive, 0, 0, 1), NewMessageFromString("x"))
+	assert.IsType(t, &ACLError{}, err)
+
+	peer.setPrincipal("admin")
+	res, err := m.handler.OnReceive(peer, newPipe(peer, newMiddlewares(m), Receive, 0, 0, 1), NewMessageRoutedFromString("config/set", "x"))
+	assert.NoError(t, err)
+	assert.Equal(t, Next, res)
+}
@@ -0,0 +1,436 @@
+package go2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultAuditMaxSize is the size (in bytes) after that an audit file is rotated
+const DefaultAuditMaxSize = 64 << 20
+
+const auditFilePrefix = "audit-"
+const auditFileSuffix = ".jsonl"
+
+// AuditRecord is one line of the audit log
+type AuditRecord struct {
+	// Seq is the number of the record, starting at 1 and without gaps across all files
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	// Peer is the remote address of the peer
+	Peer string `json:"peer"`
+	// Principal is the authenticated principal of the peer (see Auth)
+	Principal string `json:"principal,omitempty"`
+	// Direction is "send" or "receive"
+	Direction string `json:"direction"`
+	Route     string `json:"route,omitempty"`
+	Size      int    `json:"size"`
+	MessageID string `json:"messageId"`
+	// Prev is the hash of the previous record, empty for the first record
+	Prev string `json:"prev"`
+	// Hash is the hex encoded sha256 of the record (without Hash)
+	Hash string `json:"hash,omitempty"`
+}
+
+// computeHash returns the hash of the record without the Hash field
+func (r AuditRecord) computeHash() (string, error) {
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditConfig configures the Audit middleware
+type AuditConfig struct {
+	// Dir is the directory of the audit files
+	Dir string
+	// MaxSize is the size (in bytes) after that a new file is started,
+	// 0 uses DefaultAuditMaxSize
+	MaxSize int64
+	// MaxAge is the time after that a new file is started, 0 disables the time based rotation
+	MaxAge time.Duration
+	// Sync flushes each record to the disk before the message is processed further
+	Sync bool
+}
+
+// Auditor is a middleware that writes a hash chained audit log of all messages
+type Auditor struct {
+	config AuditConfig
+	now    func() time.Time
+	log    *logrus.Entry
+
+	mutex    *sync.Mutex
+	resumed  bool
+	file     *os.File
+	size     int64
+	openedAt time.Time
+	seq      uint64
+	prev     string
+}
+
+var _ MiddlewareHandler = (*Auditor)(nil)
+
+// Audit creates an audit middleware that writes into dir.
+// See AuditWith for details
+func Audit(dir string) (string, *Auditor) {
+	return AuditWith(AuditConfig{Dir: dir})
+}
+
+// AuditWith creates a middleware that appends a JSONL record for each sent and received message.
+//
+// Each record contains the hash of the previous record, so removed, changed
+// or reordered records are detected by VerifyAudit.
+// The directory is opened with the first message, the log is continued
+// if it already contains audit files. A torn record at the end of the newest file
+// (e.g. after a crash during a write) is moved into a .torn file and logged.
+// Files are rotated by size and age, the name of each file contains the
+// sequence number of its first record.
+// If a record can not be written the message is stopped with the error,
+// so no message passes the middleware without a record.
+// The middleware should be placed between Routes and Headers so the route is known
+func AuditWith(config AuditConfig) (string, *Auditor) {
+	if config.MaxSize <= 0 {
+		config.MaxSize = DefaultAuditMaxSize
+	}
+
+	a := new(Auditor)
+	a.config = config
+	a.now = time.Now
+	a.log = newLogger("audit")
+	a.mutex = new(sync.Mutex)
+
+	return "audit", a
+}
+
+// OnConnect implements MiddlewareHandler
+func (a *Auditor) OnConnect(peer *Peer, pipe *Pipe) error {
+	return nil
+}
+
+// OnSend writes the record of an outgoing message
+func (a *Auditor) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if err := a.append(peer, "send", msg); err != nil {
+		return Stop, err
+	}
+
+	return Next, nil
+}
+
+// OnReceive writes the record of an incoming message
+func (a *Auditor) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if err := a.append(peer, "receive", msg); err != nil {
+		return Stop, err
+	}
+
+	return Next, nil
+}
+
+// OnDisconnect implements MiddlewareHandler
+func (a *Auditor) OnDisconnect(peer *Peer) {}
+
+// Head returns the sequence number and the hash of the last record written by this instance.
+// Store them outside of the audit dir to detect removed records at the end of the log
+// and a log that was rewritten completely (see VerifyAudit)
+func (a *Auditor) Head() (uint64, string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.seq, a.prev
+}
+
+// Close closes the current audit file
+func (a *Auditor) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+func (a *Auditor) append(peer *Peer, direction string, msg *Message) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := a.resume(); err != nil {
+		return err
+	}
+
+	record := AuditRecord{
+		Seq:       a.seq + 1,
+		Time:      a.now().UTC(),
+		Direction: direction,
+		Size:      len(msg.PayloadGet()),
+		MessageID: msg.ID(),
+		Prev:      a.prev,
+	}
+	if peer != nil {
+		record.Peer = peer.RemoteAddress()
+		record.Principal = peer.Principal()
+	}
+	if route, found := msg.Metadata().Get(annotationKey); found {
+		record.Route, _ = route.(string)
+	}
+
+	hash, err := record.computeHash()
+	if err != nil {
+		return errors.Wrap(err, "could not hash audit record")
+	}
+	record.Hash = hash
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "could not encode audit record")
+	}
+	line = append(line, '\n')
+
+	if err := a.rotate(record.Seq, int64(len(line))); err != nil {
+		return err
+	}
+
+	if _, err := a.file.Write(line); err != nil {
+		return errors.Wrap(err, "could not write audit record")
+	}
+	if a.config.Sync {
+		if err := a.file.Sync(); err != nil {
+			return errors.Wrap(err, "could not sync audit file")
+		}
+	}
+
+	a.size += int64(len(line))
+	a.seq = record.Seq
+	a.prev = record.Hash
+
+	return nil
+}
+
+// rotate starts a new file if there is none or the current one is too big or too old
+func (a *Auditor) rotate(seq uint64, next int64) error {
+	if a.file != nil {
+		tooBig := a.size > 0 && a.size+next > a.config.MaxSize
+		tooOld := a.config.MaxAge > 0 && a.now().Sub(a.openedAt) >= a.config.MaxAge
+		if !tooBig && !tooOld {
+			return nil
+		}
+
+		if err := a.file.Close(); err != nil {
+			return errors.Wrap(err, "could not close audit file")
+		}
+		a.file = nil
+	}
+
+	name := filepath.Join(a.config.Dir, auditFileName(seq))
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not create audit file")
+	}
+
+	a.file = file
+	a.size = 0
+	a.openedAt = a.now()
+	return nil
+}
+
+// resume continues the chain after the last record of the existing files.
+// The caller has to hold the mutex
+func (a *Auditor) resume() error {
+	if a.resumed {
+		return nil
+	}
+
+	if err := os.MkdirAll(a.config.Dir, 0700); err != nil {
+		return errors.Wrap(err, "could not create audit dir")
+	}
+
+	files, err := auditFiles(a.config.Dir)
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		if err := a.repairTail(files[len(files)-1].path); err != nil {
+			return err
+		}
+	}
+
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := lastAuditRecord(files[i].path)
+		if err != nil {
+			return err
+		}
+
+		if last != nil {
+			a.seq = last.Seq
+			a.prev = last.Hash
+			break
+		}
+	}
+
+	a.resumed = true
+	return nil
+}
+
+// repairTail removes a torn last line (a record that was not completely written,
+// e.g. because of a crash during the write) from the newest audit file,
+// so the chain continues after the last complete record.
+// The torn bytes are moved into a .torn file next to the audit file
+func (a *Auditor) repairTail(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open audit file")
+	}
+	defer file.Close()
+
+	torn, err := auditTornTail(file)
+	if err != nil {
+		return errors.Wrap(err, "could not read audit file")
+	}
+	if torn == 0 {
+		return nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "could not read audit file")
+	}
+
+	data := make([]byte, torn)
+	if _, err := file.ReadAt(data, info.Size()-int64(torn)); err != nil {
+		return errors.Wrap(err, "could not read torn audit record")
+	}
+
+	if err := ioutil.WriteFile(path+".torn", data, 0600); err != nil {
+		return errors.Wrap(err, "could not save torn audit record")
+	}
+
+	if err := file.Truncate(info.Size() - int64(torn)); err != nil {
+		return errors.Wrap(err, "could not remove torn audit record")
+	}
+
+	a.log.WithField("file", filepath.Base(path)).Warnf("removed torn record at the end of the audit file (%d bytes)", torn)
+	return nil
+}
+
+// auditTornTail returns the length of the last line of the file if it is not terminated by a newline.
+// The read position of the file is not changed
+func auditTornTail(file *os.File) (int, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+	torn := 0
+	buffer := make([]byte, 4096)
+	for end := size; end > 0; {
+		start := end - int64(len(buffer))
+		if start < 0 {
+			start = 0
+		}
+
+		chunk := buffer[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return torn + len(chunk) - i - 1, nil
+		}
+
+		torn += len(chunk)
+		end = start
+	}
+
+	return torn, nil
+}
+
+func lastAuditRecord(path string) (*AuditRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open audit file")
+	}
+	defer file.Close()
+
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "could not read audit file %s", path)
+	}
+
+	if last == nil {
+		return nil, nil
+	}
+
+	record := new(AuditRecord)
+	if err := json.Unmarshal(last, record); err != nil {
+		return nil, errors.Wrapf(err, "invalid last record in audit file %s", path)
+	}
+
+	return record, nil
+}
+
+type auditFile struct {
+	path  string
+	first uint64
+}
+
+func auditFileName(first uint64) string {
+	return fmt.Sprintf("%s%020d%s", auditFilePrefix, first, auditFileSuffix)
+}
+
+// auditFiles returns the audit files of dir ordered by their first sequence number
+func auditFiles(dir string) ([]auditFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read audit dir")
+	}
+
+	var files []auditFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, auditFilePrefix) || !strings.HasSuffix(name, auditFileSuffix) {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, auditFilePrefix), auditFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		files = append(files, auditFile{path: filepath.Join(dir, name), first: first})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].first < files[j].first
+	})
+
+	return files, nil
+}
@@ -0,0 +1,244 @@
+package go2p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeAuditRecords(t *testing.T, auditor *Auditor, count int) {
+	adapter := new(MockAdapter)
+	adapter.On("RemoteAddress").Return("127.0.0.1:4000")
+	p := newPeer(adapter, newMiddlewareChain(), &peerConfig{})
+	p.setPrincipal("node-1")
+
+	m := NewMiddlewareHandler("audit", auditor)
+	for i := 0; i < count; i++ {
+		op := Send
+		if i%2 == 1 {
+			op = Receive
+		}
+
+		pipe := newPipe(p, newMiddlewares(m), op, 0, 0, 1)
+		assert.NoError(t, pipe.process(NewMessageRoutedFromString("cmd/restart", "payload")))
+	}
+}
+
+func readAuditFiles(t *testing.T, dir string) []string {
+	files, err := auditFiles(dir)
+	assert.NoError(t, err)
+
+	result := []string{}
+	for _, file := range files {
+		result = append(result, filepath.Base(file.path))
+	}
+
+	return result
+}
+
+func TestAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go2p-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, auditor := Audit(dir)
+	writeAuditRecords(t, auditor, 3)
+	assert.NoError(t, auditor.Close())
+
+	report, err := VerifyAudit(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), report.Records)
+	assert.Equal(t, 1, report.Files)
+
+	seq, hash := auditor.Head()
+	assert.Equal(t, report.LastSeq, seq)
+	assert.Equal(t, report.LastHash, hash)
+
+	record, err := lastAuditRecord(filepath.Join(dir, auditFileName(1)))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), record.Seq)
+	assert.Equal(t, "127.0.0.1:4000", record.Peer)
+	assert.Equal(t, "node-1", record.Principal)
+	assert.Equal(t, "send", record.Direction)
+	assert.Equal(t, "cmd/restart", record.Route)
+	assert.Equal(t, len("payload"), record.Size)
+
+	_, resumed := Audit(dir)
+	writeAuditRecords(t, resumed, 2)
+	assert.NoError(t, resumed.Close())
+
+	report, err = VerifyAudit(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), report.Records)
+}
+
+func TestAuditRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go2p-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, auditor := AuditWith(AuditConfig{Dir: dir, MaxSize: 800})
+	writeAuditRecords(t, auditor, 6)
+	assert.NoError(t, auditor.Close())
+	assert.Equal(t, []string{auditFileName(1), auditFileName(3), auditFileName(5)}, readAuditFiles(t, dir))
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	dir2, err := ioutil.TempDir("", "go2p-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir2)
+
+	_, auditor = AuditWith(AuditConfig{Dir: dir2, MaxAge: time.Hour})
+	auditor.now = clock.Now
+	writeAuditRecords(t, auditor, 2)
+	clock.now = clock.now.Add(time.Hour)
+	writeAuditRecords(t, auditor, 1)
+	assert.NoError(t, auditor.Close())
+	assert.Equal(t, []string{auditFileName(1), auditFileName(3)}, readAuditFiles(t, dir2))
+
+	for _, d := range []string{dir, dir2} {
+		_, err := VerifyAudit(d)
+		assert.NoError(t, err)
+	}
+}
+
+func TestAuditVerifyNegative(t *testing.T) {
+	tamper := map[string]func(dir string){
+		"hash mismatch": func(dir string) {
+			path := filepath.Join(dir, auditFileName(3))
+			content, _ := ioutil.ReadFile(path)
+			ioutil.WriteFile(path, bytes.Replace(content, []byte("cmd/restart"), []byte("cmd/status!"), 1), 0600)
+		},
+		"gap after seq 3": func(dir string) {
+			path := filepath.Join(dir, auditFileName(3))
+			content, _ := ioutil.ReadFile(path)
+			lines := bytes.SplitAfter(content, []byte("\n"))
+			ioutil.WriteFile(path, lines[0], 0600)
+		},
+		"gap after seq 2": func(dir string) {
+			os.Remove(filepath.Join(dir, auditFileName(3)))
+		},
+		"not chained": func(dir string) {
+			_, other := AuditWith(AuditConfig{Dir: dir + "-other", MaxSize: 800})
+			writeAuditRecords(t, other, 6)
+			other.Close()
+			defer os.RemoveAll(dir + "-other")
+
+			content, _ := ioutil.ReadFile(filepath.Join(dir+"-other", auditFileName(5)))
+			ioutil.WriteFile(filepath.Join(dir, auditFileName(5)), content, 0600)
+		},
+		"truncated log starts at seq 3": func(dir string) {
+			os.Remove(filepath.Join(dir, auditFileName(1)))
+		},
+		"torn record": func(dir string) {
+			path := filepath.Join(dir, auditFileName(1))
+			content, _ := ioutil.ReadFile(path)
+			ioutil.WriteFile(path, content[:len(content)-10], 0600)
+		},
+		"invalid record": func(dir string) {
+			path := filepath.Join(dir, auditFileName(1))
+			content, _ := ioutil.ReadFile(path)
+			ioutil.WriteFile(path, bytes.Replace(content, []byte("}\n"), []byte("\n"), 1), 0600)
+		},
+		"canonical encoding": func(dir string) {
+			path := filepath.Join(dir, auditFileName(3))
+			content, _ := ioutil.ReadFile(path)
+			ioutil.WriteFile(path, bytes.Replace(content, []byte(`"peer":"127.0.0.1:4000",`), []byte(`"peer":"10.0.0.1:4000","peer":"127.0.0.1:4000",`), 1), 0600)
+		},
+	}
+
+	for reason, change := range tamper {
+		dir, err := ioutil.TempDir("", "go2p-audit")
+		assert.NoError(t, err)
+
+		_, auditor := AuditWith(AuditConfig{Dir: dir, MaxSize: 800})
+		writeAuditRecords(t, auditor, 6)
+		assert.NoError(t, auditor.Close())
+
+		change(dir)
+		_, err = VerifyAudit(dir)
+		if assert.Error(t, err, reason) {
+			verifyErr, ok := err.(*AuditVerifyError)
+			assert.True(t, ok, reason)
+			assert.Contains(t, verifyErr.Reason, reason)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAuditWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go2p-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(path, nil, 0600))
+
+	_, auditor := Audit(path)
+	err = processMiddleware(Send, NewMessageFromString("hello"), NewMiddlewareHandler("audit", auditor))
+	assert.Error(t, err)
+}
+
+func TestAuditVerifyFrom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go2p-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, auditor := AuditWith(AuditConfig{Dir: dir, MaxSize: 800})
+	writeAuditRecords(t, auditor, 6)
+	assert.NoError(t, auditor.Close())
+
+	removed, err := lastAuditRecord(filepath.Join(dir, auditFileName(1)))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(filepath.Join(dir, auditFileName(1))))
+
+	report, err := VerifyAuditFrom(dir, removed.Seq+1, removed.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), report.FirstSeq)
+	assert.Equal(t, uint64(4), report.Records)
+
+	_, err = VerifyAuditFrom(dir, removed.Seq+1, "")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.(*AuditVerifyError).Reason, "expected previous hash")
+	}
+}
+
+func TestAuditTornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go2p-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, auditor := Audit(dir)
+	writeAuditRecords(t, auditor, 3)
+	assert.NoError(t, auditor.Close())
+
+	// a crash during the write of the 4th record
+	path := filepath.Join(dir, auditFileName(1))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte(`{"seq":4,"time":"2026-`))
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	_, err = VerifyAudit(dir)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.(*AuditVerifyError).Reason, "torn record")
+	}
+
+	_, auditor = Audit(dir)
+	writeAuditRecords(t, auditor, 2)
+	assert.NoError(t, auditor.Close())
+
+	report, err := VerifyAudit(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), report.Records)
+
+	torn, err := ioutil.ReadFile(path + ".torn")
+	assert.NoError(t, err)
+	assert.Equal(t, `{"seq":4,"time":"2026-`, string(torn))
+}
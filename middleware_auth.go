@@ -0,0 +1,426 @@
+package go2p
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/v-braun/go-must"
+)
+
+// DefaultAuthTimeout is the time a peer has to complete the authentication
+const DefaultAuthTimeout = 10 * time.Second
+
+const authChallengeLen = 32
+
+var prefixAuthChallenge = []byte("auth:c")
+var prefixAuthProof = []byte("auth:p")
+var prefixAuthAccept = []byte("auth:ok")
+
+// ErrAuthTimeout is returned when the remote did not complete the authentication in time
+var ErrAuthTimeout = errors.New("authentication timeout")
+
+// ErrAuthReflected is returned when the remote sent back the own challenge
+var ErrAuthReflected = errors.New("remote reflected the challenge")
+
+// AuthScheme proves the identity of the local node and verifies the identity of the remote.
+//
+// The challenge passed to Prove and Verify contains the random challenges of both sides
+// and the channel binding of the connection (see Peer.ChannelBinding),
+// so a proof is only valid for a single connection
+type AuthScheme interface {
+	// Prove returns the local principal and the proof for the challenge
+	Prove(challenge []byte) (principal string, proof []byte, err error)
+	// Verify returns an error if proof is not valid for principal and challenge
+	Verify(principal string, challenge []byte, proof []byte) error
+}
+
+// AuthError is reported when the authentication of a peer failed
+type AuthError struct {
+	// Peer is the remote address of the peer
+	Peer string
+	// Principal is the principal claimed by the remote, if it was received
+	Principal string
+	// Err is the cause of the failure
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed (peer: %s, principal: %s): %v", e.Peer, e.Principal, e.Err)
+}
+
+type authenticator struct {
+	scheme        AuthScheme
+	timeout       time.Duration
+	authenticated *PeerState[bool]
+}
+
+// Auth creates a middleware that authenticates peers with the given scheme
+// and the DefaultAuthTimeout. See AuthWith for details
+func Auth(scheme AuthScheme) (string, MiddlewareHandler) {
+	return AuthWith(scheme, DefaultAuthTimeout)
+}
+
+// AuthWith creates a middleware that runs a mutual challenge-response authentication
+// when a peer connects.
+//
+// Both sides send a random challenge, answer the challenge of the remote with the proof of the scheme
+// and verify the proof of the remote. No other message is processed until both sides accepted
+// the remote, the peer is disconnected if the authentication fails or does not complete within timeout.
+// The authenticated principal of the remote is available by Peer.Principal.
+//
+// Place the middleware between Headers and Noise, so the exchange is encrypted
+// and the challenge is bound to the handshake hash of the Noise channel.
+// A man in the middle that terminates the channel can not relay the proofs to another connection.
+// Without a channel binding (for example with Crypt) the proofs are only bound to the challenges
+func AuthWith(scheme AuthScheme, timeout time.Duration) (string, MiddlewareHandler) {
+	a := new(authenticator)
+	a.scheme = scheme
+	a.timeout = timeout
+	a.authenticated = NewPeerState[bool]("auth", nil, nil)
+
+	return "auth", a
+}
+
+// OnConnect runs the challenge-response exchange
+func (a *authenticator) OnConnect(peer *Peer, pipe *Pipe) error {
+	var timedOut int32
+	if a.timeout > 0 {
+		timer := time.AfterFunc(a.timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			peer.stopInternal()
+		})
+		defer timer.Stop()
+	}
+
+	principal, err := a.authenticate(peer, pipe)
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = ErrAuthTimeout
+	}
+
+	if err != nil {
+		return &AuthError{Peer: peer.RemoteAddress(), Principal: principal, Err: err}
+	}
+
+	peer.setPrincipal(principal)
+	a.authenticated.Set(peer, true)
+	return nil
+}
+
+func (a *authenticator) authenticate(peer *Peer, pipe *Pipe) (string, error) {
+	myChallenge := make([]byte, authChallengeLen)
+	if _, err := io.ReadFull(rand.Reader, myChallenge); err != nil {
+		return "", errors.Wrap(err, "could not create challenge")
+	}
+
+	if err := authSend(pipe, prefixAuthChallenge, myChallenge); err != nil {
+		return "", err
+	}
+
+	theirChallenge, err := authReceive(pipe, prefixAuthChallenge)
+	if err != nil {
+		return "", err
+	}
+	if len(theirChallenge) != authChallengeLen {
+		return "", errors.Errorf("invalid challenge (len: %d)", len(theirChallenge))
+	}
+	if bytes.Equal(myChallenge, theirChallenge) {
+		return "", ErrAuthReflected
+	}
+
+	binding := peer.ChannelBinding()
+	myPrincipal, myProof, err := a.scheme.Prove(authChallenge(theirChallenge, myChallenge, binding))
+	if err != nil {
+		return "", errors.Wrap(err, "could not create proof")
+	}
+
+	if err := authSend(pipe, prefixAuthProof, marshalAuthProof(myPrincipal, myProof)); err != nil {
+		return "", err
+	}
+
+	content, err := authReceive(pipe, prefixAuthProof)
+	if err != nil {
+		return "", err
+	}
+
+	principal, proof, err := unmarshalAuthProof(content)
+	if err != nil {
+		return "", err
+	}
+
+	if err := a.scheme.Verify(principal, authChallenge(myChallenge, theirChallenge, binding), proof); err != nil {
+		return principal, err
+	}
+
+	if err := authSend(pipe, prefixAuthAccept, nil); err != nil {
+		return principal, err
+	}
+
+	if _, err := authReceive(pipe, prefixAuthAccept); err != nil {
+		return principal, err
+	}
+
+	return principal, nil
+}
+
+// OnSend stops messages to peers that are not authenticated
+func (a *authenticator) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	return a.check(peer)
+}
+
+// OnReceive stops messages from peers that are not authenticated
+func (a *authenticator) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	return a.check(peer)
+}
+
+// OnDisconnect implements MiddlewareHandler
+func (a *authenticator) OnDisconnect(peer *Peer) {}
+
+func (a *authenticator) check(peer *Peer) (MiddlewareResult, error) {
+	if a.authenticated.Get(peer) {
+		return Next, nil
+	}
+
+	return Stop, &AuthError{Peer: peer.RemoteAddress(), Err: errors.New("peer is not authenticated")}
+}
+
+// authChallenge returns the challenge for the proof of the remote,
+// the challenge of the verifier comes first so proofs can not be reflected.
+// The channel binding ties the proof to the secure channel of the connection
+func authChallenge(verifier []byte, prover []byte, binding []byte) []byte {
+	result := make([]byte, 0, len(verifier)+len(prover)+len(binding))
+	result = append(result, verifier...)
+	result = append(result, prover...)
+	result = append(result, binding...)
+
+	return result
+}
+
+func authSend(pipe *Pipe, prefix []byte, content []byte) error {
+	msg := NewMessage()
+
+	payload := make([]byte, 0, len(prefix)+len(content))
+	payload = append(payload, prefix...)
+	payload = append(payload, content...)
+	msg.PayloadSet(payload)
+
+	return pipe.Send(msg)
+}
+
+func authReceive(pipe *Pipe, prefix []byte) ([]byte, error) {
+	msg, err := pipe.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	content := msg.PayloadGet()
+	if !bytes.HasPrefix(content, prefix) {
+		return nil, errors.Errorf("unexpected authentication message (expected: %s)", prefix)
+	}
+
+	return content[len(prefix):], nil
+}
+
+func marshalAuthProof(principal string, proof []byte) []byte {
+	result := make([]byte, 0, 2+len(principal)+len(proof))
+	result = binary.BigEndian.AppendUint16(result, uint16(len(principal)))
+	result = append(result, principal...)
+	result = append(result, proof...)
+
+	return result
+}
+
+func unmarshalAuthProof(content []byte) (string, []byte, error) {
+	if len(content) < 2 {
+		return "", nil, errors.Errorf("invalid proof (len: %d)", len(content))
+	}
+
+	principalLen := int(binary.BigEndian.Uint16(content))
+	if len(content) < 2+principalLen {
+		return "", nil, errors.Errorf("invalid proof (len: %d, principal len: %d)", len(content), principalLen)
+	}
+
+	principal := string(content[2 : 2+principalLen])
+	return principal, content[2+principalLen:], nil
+}
+
+type authHMAC struct {
+	principal string
+	secret    []byte
+}
+
+// AuthHMAC returns an AuthScheme based on a secret that is shared by all nodes.
+// The proof is the HMAC-SHA256 of the challenge and the principal
+func AuthHMAC(principal string, secret []byte) AuthScheme {
+	return &authHMAC{principal: principal, secret: secret}
+}
+
+func (a *authHMAC) Prove(challenge []byte) (string, []byte, error) {
+	return a.principal, a.sign(a.principal, challenge), nil
+}
+
+func (a *authHMAC) Verify(principal string, challenge []byte, proof []byte) error {
+	if !hmac.Equal(a.sign(principal, challenge), proof) {
+		return errors.New("invalid hmac")
+	}
+
+	return nil
+}
+
+func (a *authHMAC) sign(principal string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(challenge)
+	mac.Write([]byte(principal))
+
+	return mac.Sum(nil)
+}
+
+// AuthToken is a token issued by IssueAuthToken
+type AuthToken struct {
+	// Principal is the identity of the token owner
+	Principal string
+	// PublicKey of the token owner, used to verify the proofs of the owner
+	PublicKey ed25519.PublicKey
+	// Expires is the time after that the token is no longer accepted
+	Expires time.Time
+	// Signature of the issuer
+	Signature []byte
+}
+
+// IssueAuthToken creates a token for the owner of publicKey that is signed by the issuer.
+// It panics if a key has an invalid size or the principal exceeds 65535 bytes
+func IssueAuthToken(issuer ed25519.PrivateKey, principal string, publicKey ed25519.PublicKey, expires time.Time) *AuthToken {
+	must.ArgBeValid(len(issuer) == ed25519.PrivateKeySize, "issuer must be an ed25519 private key")
+	must.ArgBeValid(len(publicKey) == ed25519.PublicKeySize, "publicKey must be an ed25519 public key")
+	must.ArgBeValid(len(principal) <= 0xffff, "principal exceeds 65535 bytes")
+
+	t := &AuthToken{Principal: principal, PublicKey: publicKey, Expires: expires}
+	t.Signature = ed25519.Sign(issuer, t.signedData())
+
+	return t
+}
+
+func (t *AuthToken) signedData() []byte {
+	data := make([]byte, 0, len(t.Principal)+len(t.PublicKey)+10)
+	data = binary.BigEndian.AppendUint16(data, uint16(len(t.Principal)))
+	data = append(data, t.Principal...)
+	data = append(data, t.PublicKey...)
+	data = binary.BigEndian.AppendUint64(data, uint64(t.Expires.Unix()))
+
+	return data
+}
+
+type authSignedToken struct {
+	token  *AuthToken
+	key    ed25519.PrivateKey
+	issuer ed25519.PublicKey
+	now    func() time.Time
+}
+
+// AuthSignedToken returns an AuthScheme based on tokens signed by an issuer.
+//
+// The local node presents its token and signs the challenge with the key of the token.
+// The remote is accepted if its token is signed by issuer, not expired
+// and its proof is signed with the key of its token.
+// A node that only verifies remotes can pass a nil token and key.
+// It panics if a key or the token has an invalid size
+func AuthSignedToken(token *AuthToken, key ed25519.PrivateKey, issuer ed25519.PublicKey) AuthScheme {
+	must.ArgBeValid(len(issuer) == ed25519.PublicKeySize, "issuer must be an ed25519 public key")
+	if token != nil {
+		must.ArgBeValid(len(key) == ed25519.PrivateKeySize, "key must be an ed25519 private key")
+		must.ArgBeValid(len(token.PublicKey) == ed25519.PublicKeySize, "token.PublicKey must be an ed25519 public key")
+		must.ArgBeValid(len(token.Signature) == ed25519.SignatureSize, "token.Signature must be an ed25519 signature")
+	}
+
+	return &authSignedToken{token: token, key: key, issuer: issuer, now: time.Now}
+}
+
+func (a *authSignedToken) Prove(challenge []byte) (string, []byte, error) {
+	if a.token == nil {
+		return "", nil, errors.New("no token to prove the identity")
+	}
+
+	signedData := a.token.signedData()
+
+	proof := make([]byte, 0, len(signedData)+2*ed25519.SignatureSize)
+	proof = append(proof, a.token.Signature...)
+	proof = append(proof, ed25519.Sign(a.key, challenge)...)
+	proof = append(proof, signedData...)
+
+	return a.token.Principal, proof, nil
+}
+
+func (a *authSignedToken) Verify(principal string, challenge []byte, proof []byte) error {
+	if len(proof) < 2*ed25519.SignatureSize+2 {
+		return errors.Errorf("invalid token proof (len: %d)", len(proof))
+	}
+
+	tokenSignature := proof[:ed25519.SignatureSize]
+	challengeSignature := proof[ed25519.SignatureSize : 2*ed25519.SignatureSize]
+	signedData := proof[2*ed25519.SignatureSize:]
+
+	if !ed25519.Verify(a.issuer, signedData, tokenSignature) {
+		return errors.New("token is not signed by the issuer")
+	}
+
+	token, err := unmarshalAuthToken(signedData)
+	if err != nil {
+		return err
+	}
+
+	if token.Principal != principal {
+		return errors.Errorf("token was issued for %s", token.Principal)
+	}
+
+	if !a.now().Before(token.Expires) {
+		return errors.Errorf("token expired at %s", token.Expires)
+	}
+
+	if !ed25519.Verify(token.PublicKey, challenge, challengeSignature) {
+		return errors.New("invalid challenge signature")
+	}
+
+	return nil
+}
+
+func unmarshalAuthToken(data []byte) (*AuthToken, error) {
+	principalLen := int(binary.BigEndian.Uint16(data))
+	if len(data) != 2+principalLen+ed25519.PublicKeySize+8 {
+		return nil, errors.Errorf("invalid token (len: %d)", len(data))
+	}
+
+	t := new(AuthToken)
+	t.Principal = string(data[2 : 2+principalLen])
+	t.PublicKey = ed25519.PublicKey(data[2+principalLen : 2+principalLen+ed25519.PublicKeySize])
+	t.Expires = time.Unix(int64(binary.BigEndian.Uint64(data[2+principalLen+ed25519.PublicKeySize:])), 0)
+
+	return t, nil
+}
+
+type authCallback struct {
+	prove  func(challenge []byte) (string, []byte, error)
+	verify func(principal string, challenge []byte, proof []byte) error
+}
+
+// AuthCallback returns an AuthScheme that delegates to the provided functions
+func AuthCallback(
+	prove func(challenge []byte) (principal string, proof []byte, err error),
+	verify func(principal string, challenge []byte, proof []byte) error) AuthScheme {
+	return &authCallback{prove: prove, verify: verify}
+}
+
+func (a *authCallback) Prove(challenge []byte) (string, []byte, error) {
+	return a.prove(challenge)
+}
+
+func (a *authCallback) Verify(principal string, challenge []byte, proof []byte) error {
+	return a.verify(principal, challenge, proof)
+}
@@ -0,0 +1,127 @@
+package go2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthHMAC(t *testing.T) {
+	challenge := []byte("challenge")
+	alice := AuthHMAC("alice", []byte("secret"))
+	bob := AuthHMAC("bob", []byte("secret"))
+	mallory := AuthHMAC("alice", []byte("guessed"))
+
+	principal, proof, err := alice.Prove(challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", principal)
+	assert.NoError(t, bob.Verify(principal, challenge, proof))
+	assert.Error(t, bob.Verify("bob", challenge, proof))
+	assert.Error(t, bob.Verify(principal, []byte("other"), proof))
+
+	principal, proof, _ = mallory.Prove(challenge)
+	assert.Error(t, bob.Verify(principal, challenge, proof))
+}
+
+func TestAuthChannelBinding(t *testing.T) {
+	alice := AuthHMAC("alice", []byte("secret"))
+	bob := AuthHMAC("bob", []byte("secret"))
+	verifier, prover := []byte("verifier"), []byte("prover")
+
+	principal, proof, err := alice.Prove(authChallenge(verifier, prover, []byte("channel 1")))
+	assert.NoError(t, err)
+	assert.NoError(t, bob.Verify(principal, authChallenge(verifier, prover, []byte("channel 1")), proof))
+
+	// a proof relayed to another channel is rejected
+	assert.Error(t, bob.Verify(principal, authChallenge(verifier, prover, []byte("channel 2")), proof))
+	assert.Error(t, bob.Verify(principal, authChallenge(verifier, prover, nil), proof))
+}
+
+func TestAuthSignedToken(t *testing.T) {
+	issuerPub, issuer, _ := ed25519.GenerateKey(rand.Reader)
+	alicePub, aliceKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, otherIssuer, _ := ed25519.GenerateKey(rand.Reader)
+	challenge := []byte("challenge")
+	expires := time.Now().Add(time.Hour)
+
+	verifier := AuthSignedToken(nil, nil, issuerPub).(*authSignedToken)
+
+	alice := AuthSignedToken(IssueAuthToken(issuer, "alice", alicePub, expires), aliceKey, issuerPub)
+	principal, proof, err := alice.Prove(challenge)
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", principal)
+	assert.NoError(t, verifier.Verify(principal, challenge, proof))
+	assert.Error(t, verifier.Verify("bob", challenge, proof))
+	assert.Error(t, verifier.Verify(principal, []byte("other"), proof))
+
+	verifier.now = func() time.Time { return expires }
+	assert.Error(t, verifier.Verify(principal, challenge, proof))
+	verifier.now = time.Now
+
+	forged := AuthSignedToken(IssueAuthToken(otherIssuer, "alice", alicePub, expires), aliceKey, issuerPub)
+	principal, proof, _ = forged.Prove(challenge)
+	assert.Error(t, verifier.Verify(principal, challenge, proof))
+
+	_, stolenKey, _ := ed25519.GenerateKey(rand.Reader)
+	stolen := AuthSignedToken(IssueAuthToken(issuer, "alice", alicePub, expires), stolenKey, issuerPub)
+	principal, proof, _ = stolen.Prove(challenge)
+	assert.Error(t, verifier.Verify(principal, challenge, proof))
+
+	assert.Error(t, verifier.Verify(principal, challenge, proof[:10]))
+
+	_, _, err = verifier.Prove(challenge)
+	assert.Error(t, err)
+}
+
+func TestAuthSignedTokenKeySize(t *testing.T) {
+	issuerPub, issuer, _ := ed25519.GenerateKey(rand.Reader)
+	alicePub, aliceKey, _ := ed25519.GenerateKey(rand.Reader)
+	expires := time.Now().Add(time.Hour)
+	token := IssueAuthToken(issuer, "alice", alicePub, expires)
+
+	assert.Panics(t, func() { IssueAuthToken(issuer[:10], "alice", alicePub, expires) })
+	assert.Panics(t, func() { IssueAuthToken(issuer, "alice", alicePub[:10], expires) })
+	assert.Panics(t, func() { AuthSignedToken(nil, nil, issuerPub[:10]) })
+	assert.Panics(t, func() { AuthSignedToken(token, aliceKey[:10], issuerPub) })
+	assert.Panics(t, func() { AuthSignedToken(token, nil, issuerPub) })
+	assert.Panics(t, func() {
+		AuthSignedToken(&AuthToken{Principal: "alice", PublicKey: alicePub[:10], Signature: token.Signature}, aliceKey, issuerPub)
+	})
+	assert.Panics(t, func() {
+		AuthSignedToken(&AuthToken{Principal: "alice", PublicKey: alicePub, Signature: token.Signature[:10]}, aliceKey, issuerPub)
+	})
+	assert.NotPanics(t, func() { AuthSignedToken(token, aliceKey, issuerPub) })
+}
+
+func TestAuthCallback(t *testing.T) {
+	denied := errors.New("denied")
+	scheme := AuthCallback(func(challenge []byte) (string, []byte, error) {
+		return "node", challenge, nil
+	}, func(principal string, challenge []byte, proof []byte) error {
+		if principal != "node" {
+			return denied
+		}
+		return nil
+	})
+
+	principal, proof, err := scheme.Prove([]byte("c"))
+	assert.NoError(t, err)
+	assert.NoError(t, scheme.Verify(principal, []byte("c"), proof))
+	assert.Equal(t, denied, scheme.Verify("other", []byte("c"), proof))
+}
+
+func TestAuthProofMarshal(t *testing.T) {
+	principal, proof, err := unmarshalAuthProof(marshalAuthProof("alice", []byte{1, 2, 3}))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", principal)
+	assert.Equal(t, []byte{1, 2, 3}, proof)
+
+	_, _, err = unmarshalAuthProof([]byte{0})
+	assert.Error(t, err)
+	_, _, err = unmarshalAuthProof([]byte{0, 10, 'a'})
+	assert.Error(t, err)
+}
@@ -0,0 +1,146 @@
+package go2p
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrMiddlewareNotFound is returned when a middleware with the given name is not registered
+var ErrMiddlewareNotFound = errors.New("middleware not found")
+
+// ErrMiddlewareExists is returned when a middleware with the same name is already registered
+var ErrMiddlewareExists = errors.New("middleware already exists")
+
+// MiddlewarePosition returns the index where a new middleware
+// should be inserted into the given middleware list
+type MiddlewarePosition func(names []string) (int, error)
+
+// Before inserts the middleware before the one with the given name.
+// Outgoing messages will pass the new middleware before the named one
+func Before(name string) MiddlewarePosition {
+	return func(names []string) (int, error) {
+		for idx, n := range names {
+			if n == name {
+				return idx, nil
+			}
+		}
+
+		return -1, errors.Wrapf(ErrMiddlewareNotFound, "name: %s", name)
+	}
+}
+
+// After inserts the middleware after the one with the given name.
+// Outgoing messages will pass the new middleware after the named one
+func After(name string) MiddlewarePosition {
+	return func(names []string) (int, error) {
+		idx, err := Before(name)(names)
+		if err != nil {
+			return idx, err
+		}
+
+		return idx + 1, nil
+	}
+}
+
+// middlewareChain holds the current middlewares of a NetworkConnection.
+// Changes replace the whole list, so a pipe keeps working on the snapshot it started with
+type middlewareChain struct {
+	mutex *sync.RWMutex
+	items middlewares
+}
+
+func newMiddlewareChain(items ...*Middleware) *middlewareChain {
+	c := new(middlewareChain)
+	c.mutex = new(sync.RWMutex)
+	c.items = newMiddlewares(items...)
+
+	return c
+}
+
+func (c *middlewareChain) snapshot() middlewares {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.items
+}
+
+func (c *middlewareChain) names() []string {
+	result := []string{}
+	for _, m := range c.items {
+		result = append(result, m.name)
+	}
+
+	return result
+}
+
+// contains returns true if the chain has a middleware with the given name
+func (c *middlewareChain) contains(name string) bool {
+	for _, m := range c.snapshot() {
+		if m.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *middlewareChain) insert(m *Middleware, pos MiddlewarePosition) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	names := c.names()
+	for _, name := range names {
+		if name == m.name {
+			return errors.Wrapf(ErrMiddlewareExists, "name: %s", m.name)
+		}
+	}
+
+	idx := len(names)
+	if pos != nil {
+		var err error
+		idx, err = pos(names)
+		if err != nil {
+			return err
+		}
+	}
+
+	items := []*Middleware{}
+	items = append(items, c.items[:idx]...)
+	items = append(items, m)
+	items = append(items, c.items[idx:]...)
+	c.replace(items)
+
+	return nil
+}
+
+// remove removes the middleware with the given name and returns it
+func (c *middlewareChain) remove(name string) (*Middleware, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	idx, err := Before(name)(c.names())
+	if err != nil {
+		return nil, err
+	}
+
+	removed := c.items[idx]
+	items := []*Middleware{}
+	items = append(items, c.items[:idx]...)
+	items = append(items, c.items[idx+1:]...)
+	c.replace(items)
+
+	return removed, nil
+}
+
+// replace sets a new list of copied middlewares,
+// so the positions of the previous snapshot are not changed
+func (c *middlewareChain) replace(items []*Middleware) {
+	copies := []*Middleware{}
+	for _, m := range items {
+		clone := *m
+		copies = append(copies, &clone)
+	}
+
+	c.items = newMiddlewares(copies...)
+}
@@ -0,0 +1,57 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newNamedMiddleware(name string) *Middleware {
+	return NewMiddleware(name, func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		return Next, nil
+	})
+}
+
+func chainNames(ml middlewares) []string {
+	result := []string{}
+	for _, m := range ml {
+		result = append(result, m.String())
+	}
+
+	return result
+}
+
+func TestMiddlewareChain(t *testing.T) {
+	c := newMiddlewareChain(newNamedMiddleware("routes"), newNamedMiddleware("Crypt"))
+	before := c.snapshot()
+
+	assert.NoError(t, c.insert(newNamedMiddleware("log"), nil))
+	assert.NoError(t, c.insert(newNamedMiddleware("compress"), Before("Crypt")))
+	assert.NoError(t, c.insert(newNamedMiddleware("headers"), After("routes")))
+	assert.Equal(t, []string{"routes (0)", "headers (1)", "compress (2)", "Crypt (3)", "log (4)"}, chainNames(c.snapshot()))
+
+	// previous snapshots are not changed
+	assert.Equal(t, []string{"routes (0)", "Crypt (1)"}, chainNames(before))
+
+	removed, err := c.remove("compress")
+	assert.NoError(t, err)
+	assert.Equal(t, "compress", removed.name)
+	assert.Equal(t, []string{"routes (0)", "headers (1)", "Crypt (2)", "log (3)"}, chainNames(c.snapshot()))
+}
+
+func TestMiddlewareChainNegative(t *testing.T) {
+	c := newMiddlewareChain(newNamedMiddleware("routes"))
+
+	err := c.insert(newNamedMiddleware("routes"), nil)
+	assert.Equal(t, ErrMiddlewareExists, errors.Cause(err))
+
+	err = c.insert(newNamedMiddleware("log"), Before("foo"))
+	assert.Equal(t, ErrMiddlewareNotFound, errors.Cause(err))
+
+	err = c.insert(newNamedMiddleware("log"), After("foo"))
+	assert.Equal(t, ErrMiddlewareNotFound, errors.Cause(err))
+
+	_, err = c.remove("foo")
+	assert.Equal(t, ErrMiddlewareNotFound, errors.Cause(err))
+}
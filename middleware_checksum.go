@@ -0,0 +1,65 @@
+package go2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+const checksumLen = 4
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError is returned by the Checksum middleware when a received message
+// is truncated or its digest does not match the payload
+type ChecksumError struct {
+	Expected  uint32
+	Actual    uint32
+	Truncated bool
+}
+
+func (e *ChecksumError) Error() string {
+	if e.Truncated {
+		return "checksum missing, message truncated"
+	}
+
+	return fmt.Sprintf("checksum mismatch (expected: %08x, actual: %08x)", e.Expected, e.Actual)
+}
+
+// Checksum creates a middleware that appends a CRC32C digest to outgoing messages
+// and verifies it on incoming messages.
+// Use it in stacks without Crypt to detect corrupted frames before
+// other middlewares try to parse them
+func Checksum() (string, MiddlewareFunc) {
+	return "checksum", middlewareChecksumImpl
+}
+
+func middlewareChecksumImpl(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	content := msg.PayloadGet()
+
+	if pipe.Operation() == Send {
+		digest := make([]byte, checksumLen)
+		binary.BigEndian.PutUint32(digest, crc32.Checksum(content, checksumTable))
+
+		full := make([]byte, 0, len(content)+checksumLen)
+		full = append(full, content...)
+		full = append(full, digest...)
+
+		msg.PayloadSet(full)
+		return Next, nil
+	}
+
+	if len(content) < checksumLen {
+		return Stop, &ChecksumError{Truncated: true}
+	}
+
+	body := content[:len(content)-checksumLen]
+	expected := binary.BigEndian.Uint32(content[len(content)-checksumLen:])
+	actual := crc32.Checksum(body, checksumTable)
+	if expected != actual {
+		return Stop, &ChecksumError{Expected: expected, Actual: actual}
+	}
+
+	msg.PayloadSet(body)
+	return Next, nil
+}
@@ -0,0 +1,59 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func processMiddleware(op PipeOperation, msg *Message, m *Middleware) error {
+	p := newPipe(nil, newMiddlewares(m), op, 0, 0, 1)
+	return p.process(msg)
+}
+
+func TestChecksum(t *testing.T) {
+	msg := NewMessageFromString("hello")
+
+	err := processMiddleware(Send, msg, NewMiddleware(Checksum()))
+	assert.NoError(t, err)
+	assert.Len(t, msg.PayloadGet(), len("hello")+checksumLen)
+
+	err = processMiddleware(Receive, msg, NewMiddleware(Checksum()))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", msg.PayloadGetString())
+}
+
+func TestChecksumNegative(t *testing.T) {
+	msg := NewMessageFromString("hello")
+
+	err := processMiddleware(Send, msg, NewMiddleware(Checksum()))
+	assert.NoError(t, err)
+
+	msg.PayloadGet()[0] = 'j'
+	err = processMiddleware(Receive, msg, NewMiddleware(Checksum()))
+	assert.IsType(t, &ChecksumError{}, errors.Cause(err))
+	assert.False(t, errors.Cause(err).(*ChecksumError).Truncated)
+
+	err = processMiddleware(Receive, NewMessageFromString("hi"), NewMiddleware(Checksum()))
+	assert.IsType(t, &ChecksumError{}, errors.Cause(err))
+	assert.True(t, errors.Cause(err).(*ChecksumError).Truncated)
+}
+
+func TestHeadersMalformed(t *testing.T) {
+	err := processMiddleware(Receive, NewMessageFromString("hi"), NewMiddleware(Headers()))
+	assert.Error(t, err)
+
+	err = processMiddleware(Receive, NewMessageFromData([]byte{0, 0, 0, 10, 0, 0, 0, 0, 1}), NewMiddleware(Headers()))
+	assert.Error(t, err)
+
+	msg := NewMessageFromString("hello")
+	msg.Metadata().Put("key", "value")
+	err = processMiddleware(Send, msg, NewMiddleware(Headers()))
+	assert.NoError(t, err)
+
+	result := NewMessageFromData(msg.PayloadGet())
+	err = processMiddleware(Receive, result, NewMiddleware(Headers()))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", result.PayloadGetString())
+}
@@ -0,0 +1,249 @@
+package go2p
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// CompressionAlgorithm represents an algorithm supported by the Compress middleware
+type CompressionAlgorithm byte
+
+const (
+	// CompressionNone marks an uncompressed message
+	CompressionNone CompressionAlgorithm = iota
+	// CompressionGzip compress messages with gzip
+	CompressionGzip CompressionAlgorithm = iota
+	// CompressionZstd compress messages with zstd
+	CompressionZstd CompressionAlgorithm = iota
+	// CompressionSnappy compress messages with snappy
+	CompressionSnappy CompressionAlgorithm = iota
+)
+
+func (c CompressionAlgorithm) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionSnappy:
+		return "snappy"
+	}
+
+	return fmt.Sprintf("CompressionAlgorithm(%d)", c)
+}
+
+// DefaultCompressionThreshold is the payload size (in bytes)
+// below that messages are sent uncompressed
+const DefaultCompressionThreshold = 256
+
+// compressName is the name of the middleware and the address of its hello message
+const compressName = "compress"
+
+// maxDecompressedSize limits the payload size after decompression
+const maxDecompressedSize = 64 << 20
+
+type compressor struct {
+	threshold  int
+	algorithms []CompressionAlgorithm
+	accept     byte
+	remote     *PeerState[byte]
+
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+}
+
+// Compress creates a middleware that compress messages with zstd, snappy or gzip.
+// See CompressWith for details
+func Compress() (string, MiddlewareHandler) {
+	return CompressWith(DefaultCompressionThreshold, CompressionZstd, CompressionSnappy, CompressionGzip)
+}
+
+// CompressWith creates a middleware that compress outgoing messages with the first
+// of the provided algorithms that is also supported by the remote peer.
+//
+// Both sides announce the algorithms they accept with a control message when the peer connects.
+// Messages are compressed as soon as the announcement of the remote was received,
+// a remote without the middleware drops the announcement and receives uncompressed messages.
+// Each compressed message is marked with the used algorithm in its envelope.
+// Payloads smaller than threshold and payloads that do not get smaller are sent uncompressed.
+// The middleware should be placed before Noise because encrypted data does not compress
+// and keeps the name "compress", the announcement is addressed to it
+func CompressWith(threshold int, algorithms ...CompressionAlgorithm) (string, MiddlewareHandler) {
+	c := new(compressor)
+	c.threshold = threshold
+	c.remote = NewPeerState[byte](compressName, nil, nil)
+
+	for _, alg := range algorithms {
+		if alg == CompressionNone || alg > CompressionSnappy {
+			continue
+		}
+
+		c.algorithms = append(c.algorithms, alg)
+		c.accept |= 1 << alg
+	}
+
+	var err error
+	c.zstdEncoder, err = zstd.NewWriter(nil)
+	if err != nil {
+		panic(errors.Wrap(err, "could not create zstd encoder"))
+	}
+
+	c.zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	if err != nil {
+		panic(errors.Wrap(err, "could not create zstd decoder"))
+	}
+
+	return compressName, c
+}
+
+// OnConnect announces the accepted algorithms to the remote
+func (c *compressor) OnConnect(peer *Peer, pipe *Pipe) error {
+	hello := NewMessageFromData([]byte{c.accept})
+	hello.control = compressName
+
+	return pipe.Send(hello)
+}
+
+// OnSend compresses the message with the best algorithm that is accepted by the remote
+func (c *compressor) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	c.compress(peer, msg)
+	return Next, nil
+}
+
+// OnReceive stores the algorithms announced by the remote and decompresses all other messages
+func (c *compressor) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if msg.control == compressName {
+		return Stop, c.handleHello(peer, msg.PayloadGet())
+	}
+
+	err := c.decompress(msg)
+	if err != nil {
+		return Stop, err
+	}
+
+	return Next, nil
+}
+
+// OnDisconnect implements MiddlewareHandler,
+// the algorithms of the remote are removed together with the peer state
+func (c *compressor) OnDisconnect(peer *Peer) {}
+
+func (c *compressor) handleHello(peer *Peer, content []byte) error {
+	if len(content) != 1 {
+		return errors.Errorf("invalid compression announcement (len: %d)", len(content))
+	}
+
+	c.remote.Set(peer, content[0])
+	return nil
+}
+
+func (c *compressor) selectAlgorithm(peer *Peer, size int) CompressionAlgorithm {
+	if size < c.threshold {
+		return CompressionNone
+	}
+
+	remote, found := c.remote.Lookup(peer)
+	if !found {
+		return CompressionNone
+	}
+
+	for _, alg := range c.algorithms {
+		if remote&(1<<alg) != 0 {
+			return alg
+		}
+	}
+
+	return CompressionNone
+}
+
+func (c *compressor) compress(peer *Peer, msg *Message) {
+	content := msg.PayloadGet()
+	alg := c.selectAlgorithm(peer, len(content))
+	if alg == CompressionNone {
+		return
+	}
+
+	body := c.encode(alg, content)
+	if len(body) >= len(content) {
+		return
+	}
+
+	msg.encoding = alg
+	msg.PayloadSet(body)
+}
+
+func (c *compressor) decompress(msg *Message) error {
+	alg := msg.encoding
+	if alg == CompressionNone {
+		return nil
+	}
+
+	if c.accept&(1<<alg) == 0 {
+		return errors.Errorf("unsupported compression algorithm %d", alg)
+	}
+
+	body := msg.PayloadGet()
+	result, err := c.decode(alg, body)
+	if err != nil {
+		return errors.Wrapf(err, "could not decompress message (alg: %s, len: %d)", alg, len(body))
+	}
+
+	msg.encoding = CompressionNone
+	msg.PayloadSet(result)
+	return nil
+}
+
+func (c *compressor) encode(alg CompressionAlgorithm, data []byte) []byte {
+	switch alg {
+	case CompressionZstd:
+		return c.zstdEncoder.EncodeAll(data, nil)
+	case CompressionSnappy:
+		return snappy.Encode(nil, data)
+	default:
+		buffer := new(bytes.Buffer)
+		writer := gzip.NewWriter(buffer)
+		writer.Write(data)
+		writer.Close()
+		return buffer.Bytes()
+	}
+}
+
+func (c *compressor) decode(alg CompressionAlgorithm, data []byte) ([]byte, error) {
+	switch alg {
+	case CompressionZstd:
+		return c.zstdDecoder.DecodeAll(data, nil)
+	case CompressionSnappy:
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxDecompressedSize {
+			return nil, errors.Errorf("decompressed size %d exceeds limit", size)
+		}
+		return snappy.Decode(nil, data)
+	default:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+
+		result, err := ioutil.ReadAll(io.LimitReader(reader, maxDecompressedSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(result) > maxDecompressedSize {
+			return nil, errors.New("decompressed size exceeds limit")
+		}
+		return result, nil
+	}
+}
@@ -0,0 +1,103 @@
+package go2p
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func compressRoundtrip(t *testing.T, sender *Peer, receiver *Peer, m *Middleware, content string) int {
+	msg := NewMessageFromString(content)
+
+	err := newPipe(sender, newMiddlewares(m), Send, 0, 0, 1).process(msg)
+	assert.NoError(t, err)
+	size := len(msg.PayloadGet())
+
+	err = newPipe(receiver, newMiddlewares(m), Receive, 0, 0, 1).process(msg)
+	assert.NoError(t, err)
+	assert.Equal(t, content, msg.PayloadGetString())
+
+	return size
+}
+
+func TestCompressNegotiation(t *testing.T) {
+	for _, alg := range []CompressionAlgorithm{CompressionZstd, CompressionSnappy, CompressionGzip} {
+		a := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+		b := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+		_, handler := CompressWith(64, alg)
+		c := handler.(*compressor)
+		m := NewMiddlewareHandler("compress", c)
+
+		large := strings.Repeat(`{"key": "value"}`, 100)
+
+		// the algorithms of the remote are announced on connect
+		assert.NoError(t, c.handleHello(a, []byte{c.accept}))
+		assert.NoError(t, c.handleHello(b, []byte{c.accept}))
+
+		size := compressRoundtrip(t, a, b, m, large)
+		assert.True(t, size < len(large)/5, alg.String())
+
+		size = compressRoundtrip(t, b, a, m, large)
+		assert.True(t, size < len(large)/5, alg.String())
+
+		// small messages are not compressed
+		size = compressRoundtrip(t, a, b, m, "small")
+		assert.Equal(t, len("small"), size, alg.String())
+	}
+}
+
+func TestCompressNoCommonAlgorithm(t *testing.T) {
+	a := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+	_, gzipOnly := CompressWith(0, CompressionGzip)
+	_, zstdOnly := CompressWith(0, CompressionZstd)
+	c := gzipOnly.(*compressor)
+
+	assert.NoError(t, c.handleHello(a, []byte{zstdOnly.(*compressor).accept}))
+
+	large := strings.Repeat(`{"key": "value"}`, 100)
+	size := compressRoundtrip(t, a, a, NewMiddlewareHandler("compress", c), large)
+	assert.Equal(t, len(large), size)
+
+	// without a handshake the messages are sent uncompressed
+	b := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+	size = compressRoundtrip(t, b, b, NewMiddlewareHandler("compress", c), large)
+	assert.Equal(t, len(large), size)
+
+	assert.Error(t, c.handleHello(a, []byte("compress")))
+
+	// the announcement of the remote is consumed by the middleware
+	hello := NewMessageFromData([]byte{c.accept})
+	hello.control = compressName
+	assert.Equal(t, ErrPipeStopProcessing, newPipe(b, newMiddlewares(NewMiddlewareHandler("compress", c)), Receive, 0, 0, 1).process(hello))
+	_, found := c.remote.Lookup(b)
+	assert.True(t, found)
+}
+
+func TestCompressNegative(t *testing.T) {
+	p := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+	m := NewMiddlewareHandler(CompressWith(0, CompressionGzip))
+
+	encoded := func(alg CompressionAlgorithm, data []byte) *Message {
+		msg := NewMessageFromData(data)
+		msg.encoding = alg
+		return msg
+	}
+
+	err := newPipe(p, newMiddlewares(m), Receive, 0, 0, 1).process(encoded(CompressionZstd, []byte{1, 2}))
+	assert.Error(t, err)
+
+	err = newPipe(p, newMiddlewares(m), Receive, 0, 0, 1).process(encoded(CompressionGzip, []byte{1, 2}))
+	assert.Error(t, err)
+
+	err = newPipe(p, newMiddlewares(m), Receive, 0, 0, 1).process(encoded(CompressionAlgorithm(42), []byte{1, 2}))
+	assert.Error(t, err)
+
+	// uncompressed messages of remotes without the middleware pass unchanged
+	msg := NewMessageFromString("plain")
+	assert.NoError(t, newPipe(p, newMiddlewares(m), Receive, 0, 0, 1).process(msg))
+	assert.Equal(t, "plain", msg.PayloadGetString())
+
+	assert.Equal(t, "snappy", CompressionSnappy.String())
+	assert.Equal(t, "CompressionAlgorithm(42)", CompressionAlgorithm(42).String())
+}
@@ -2,6 +2,11 @@ package go2p
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pkg/errors"
 	"github.com/v-braun/go2p/crypt"
@@ -9,100 +14,236 @@ import (
 
 var prefixHandshake = []byte("hello:")
 
-const cryptLabel = "middleware.crypt"
-const headerKeyPubKey = "middleware.crypt.pubkey"
+const sessionIDLen = 16
+const seqLen = 8
 
-// Crypt returns the crypto middleware.
+// cryptMiddleware holds the key pair of a Crypt middleware instance
+// and the sessions of its peers
+type cryptMiddleware struct {
+	myKey      *crypt.PrivKey
+	sessions   *PeerState[*cryptSession]
+	handshakes *PeerState[*cryptHandshake]
+}
+
+// cryptSession is created by the handshake of a connection.
+//
+// Each side picks a random session id that the remote authenticates together with
+// the sequence number of each message, so messages can neither be replayed
+// within the session nor in a later session
+type cryptSession struct {
+	localID  []byte
+	remoteID []byte
+	theirKey *crypt.PubKey
+	sendSeq  uint64
+	window   *replayWindow
+}
+
+// cryptHandshake is the state of a handshake that is done with the first message
+// when Crypt is used as a MiddlewareFunc
+type cryptHandshake struct {
+	localID []byte
+	sent    *sync.Once
+	sendErr error
+	ready   chan struct{}
+	done    *sync.Once
+}
+
+// Crypt returns the crypto middleware as a MiddlewareFunc.
 // This middleware handles encryption in your communication
-// PublicKeys are exchanged on first peer communication
+// PublicKeys are exchanged on first peer communication,
+// the first outgoing message waits until the key of the remote was received.
+// Use CryptHandler to exchange the keys when the peer connects.
+// Each message is encrypted with RSA, prefer Noise for new networks.
+// Only the payload is protected, the id, origin and deadline of the message are not authenticated
 func Crypt() (string, MiddlewareFunc) {
-	key := crypt.Generate()
+	c := newCryptMiddleware()
+	return "Crypt", c.handle
+}
 
-	f := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
-		op, err := middlewareCryptImpl(key, peer, pipe, msg)
-		return op, err
+// CryptHandler returns the crypto middleware as a MiddlewareHandler.
+// PublicKeys are exchanged when the peer connects, before any other message is sent.
+// Each message carries a sequence number that is authenticated with the payload,
+// replayed messages and messages that are reordered too far are rejected with a ReplayError.
+// Like Crypt it does not authenticate the id, origin and deadline of the message.
+// Add it with NetworkConnectionBuilder.WithHandler
+func CryptHandler() (string, MiddlewareHandler) {
+	return "Crypt", newCryptMiddleware()
+}
+
+func newCryptMiddleware() *cryptMiddleware {
+	c := &cryptMiddleware{
+		myKey:    crypt.Generate(),
+		sessions: NewPeerState[*cryptSession]("Crypt", nil, nil),
 	}
+	c.handshakes = NewPeerState[*cryptHandshake]("Crypt", func(peer *Peer) *cryptHandshake {
+		return &cryptHandshake{
+			sent:  new(sync.Once),
+			ready: make(chan struct{}),
+			done:  new(sync.Once),
+		}
+	}, nil)
 
-	return "Crypt", f
+	return c
 }
 
-func middlewareCryptImpl(myKey *crypt.PrivKey, peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+// handle runs the handshake with the first message of the peer.
+// Each side sends its key once, a session is created when the key of the remote is received
+func (c *cryptMiddleware) handle(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if _, found := c.sessions.Lookup(peer); found {
+		if pipe.Operation() == Receive {
+			return c.OnReceive(peer, pipe, msg)
+		}
 
-	if isHandshakeDone(peer, pipe) {
-		// handshake done, just handle the message
-		err := messageHandle(peer, pipe, msg, myKey)
-		if err != nil {
-			return Stop, err
+		return c.OnSend(peer, pipe, msg)
+	}
+
+	hs := c.handshakes.Get(peer)
+	hs.sent.Do(func() {
+		hs.localID = make([]byte, sessionIDLen)
+		if _, err := io.ReadFull(rand.Reader, hs.localID); err != nil {
+			hs.sendErr = errors.Wrap(err, "could not create session id")
+			return
 		}
 
-		return Next, err
+		hs.sendErr = handshakeSend(pipe, c.myKey, hs.localID)
+	})
+	if hs.sendErr != nil {
+		return Stop, hs.sendErr
 	}
 
-	// no pub-key from remote, handle handshake
 	if pipe.Operation() == Receive {
 		// passive mode:
-		// the remote send us the pub key
-		// so the received message should be a handshake message
-		err := handshakePassive(peer, pipe, msg, myKey)
-		return Stop, err
+		// the message without a session has to be the key of the remote
+		if err := c.handshakeHandleResponse(peer, msg, hs.localID); err != nil {
+			return Stop, err
+		}
+
+		hs.done.Do(func() {
+			close(hs.ready)
+		})
+		return Stop, nil
 	}
 
 	// active mode:
-	// the active message should be postpone after the key exchange
-	err := handshakeActive(peer, pipe, myKey)
-	if err != nil {
-		return Stop, err
+	// the message is postponed until the key of the remote was received
+	select {
+	case <-hs.ready:
+	case <-peer.awaiter.CancelRequested():
+		return Stop, DisconnectedError
 	}
 
-	// handshake done, just handle the active message
-	err = messageHandle(peer, pipe, msg, myKey)
-	return Next, err
+	return c.OnSend(peer, pipe, msg)
 }
 
-func messageHandle(peer *Peer, pipe *Pipe, msg *Message, myKey *crypt.PrivKey) error {
-	key, _ := peer.Metadata().Get(headerKeyPubKey)
-	theirKey := key.(*crypt.PubKey)
+// OnConnect exchange the public keys and the session ids with the remote.
+// Both sides send their key and wait for the key of the remote
+func (c *cryptMiddleware) OnConnect(peer *Peer, pipe *Pipe) error {
+	localID := make([]byte, sessionIDLen)
+	if _, err := io.ReadFull(rand.Reader, localID); err != nil {
+		return errors.Wrap(err, "could not create session id")
+	}
 
-	if pipe.Operation() == Send {
-		err := encrypt(msg, theirKey, myKey)
+	if err := handshakeSend(pipe, c.myKey, localID); err != nil {
 		return err
 	}
 
-	err := decrypt(msg, myKey, theirKey)
+	msg, err := pipe.Receive()
+	if err != nil {
+		return err
+	}
+
+	err = c.handshakeHandleResponse(peer, msg, localID)
 	return err
 }
 
-func encrypt(msg *Message, theirKey *crypt.PubKey, myKey *crypt.PrivKey) error {
+// OnSend encrypts the message with the public key of the remote
+func (c *cryptMiddleware) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	session, found := c.sessions.Lookup(peer)
+	if !found {
+		return Stop, errors.Errorf("no handshake with peer | peer: %s", peer.RemoteAddress())
+	}
+
+	seq := atomic.AddUint64(&session.sendSeq, 1)
+	if err := encrypt(msg, session.theirKey, c.myKey, session.remoteID, seq); err != nil {
+		return Stop, err
+	}
+
+	return Next, nil
+}
+
+// OnReceive decrypts the message with the own private key
+// and checks its sequence number against the replay window
+func (c *cryptMiddleware) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	session, found := c.sessions.Lookup(peer)
+	if !found {
+		return Stop, errors.Errorf("received message from peer without a handshake | peer: %s", peer.RemoteAddress())
+	}
+
+	seq, err := decrypt(msg, c.myKey, session.theirKey, session.localID)
+	if err != nil {
+		return Stop, err
+	}
+
+	if err := session.window.check(seq); err != nil {
+		return Stop, err
+	}
+
+	return Next, nil
+}
+
+// OrderIndependent implements OrderIndependentHandler,
+// the replay window accepts reordered messages
+func (c *cryptMiddleware) OrderIndependent() bool {
+	return true
+}
+
+// OnDisconnect implements MiddlewareHandler,
+// the session is removed together with the peer state
+func (c *cryptMiddleware) OnDisconnect(peer *Peer) {}
+
+// sessionAAD returns the additional authenticated data of a message
+func sessionAAD(sessionID []byte, seq uint64) []byte {
+	aad := make([]byte, 0, len(sessionID)+seqLen)
+	aad = append(aad, sessionID...)
+	aad = binary.BigEndian.AppendUint64(aad, seq)
+
+	return aad
+}
+
+func encrypt(msg *Message, theirKey *crypt.PubKey, myKey *crypt.PrivKey, sessionID []byte, seq uint64) error {
 	content := msg.PayloadGet()
-	contentEnc, err := theirKey.Encrypt(myKey, content)
+	contentEnc, err := theirKey.EncryptWithAAD(myKey, content, sessionAAD(sessionID, seq))
 	if err != nil {
 		return errors.Wrapf(err, "could not encrypt message (len: %d)", len(content))
 	}
 
-	msg.PayloadSet(contentEnc)
+	full := make([]byte, 0, seqLen+len(contentEnc))
+	full = binary.BigEndian.AppendUint64(full, seq)
+	full = append(full, contentEnc...)
+	msg.PayloadSet(full)
 
 	return nil
 }
 
-func decrypt(msg *Message, myKey *crypt.PrivKey, theirKey *crypt.PubKey) error {
+func decrypt(msg *Message, myKey *crypt.PrivKey, theirKey *crypt.PubKey, sessionID []byte) (uint64, error) {
 	content := msg.PayloadGet()
 	contentLen := len(content)
-	content, err := myKey.Decrypt(theirKey, content)
+	if contentLen < seqLen {
+		return 0, errors.Errorf("invalid encrypted message (len: %d)", contentLen)
+	}
+
+	seq := binary.BigEndian.Uint64(content)
+	content, err := myKey.DecryptWithAAD(theirKey, content[seqLen:], sessionAAD(sessionID, seq))
 	if err != nil {
-		return errors.Wrapf(err, "could not decrypt (len: %d)", contentLen)
+		return 0, errors.Wrapf(err, "could not decrypt (len: %d, seq: %d)", contentLen, seq)
 	}
 
 	msg.PayloadSet(content)
 
-	return nil
+	return seq, nil
 }
 
 // handshake methods
-func isHandshakeDone(peer *Peer, pipe *Pipe) bool {
-	_, found := peer.Metadata().Get(headerKeyPubKey)
-	return found
-}
-
 func isHandshakeMsg(msg *Message) bool {
 	content := msg.PayloadGet()
 	if len(content) < len(prefixHandshake) {
@@ -115,52 +256,38 @@ func isHandshakeMsg(msg *Message) bool {
 	return equal
 }
 
-func handshakePassive(peer *Peer, pipe *Pipe, msg *Message, myKey *crypt.PrivKey) error {
-	if err := handshakeHandleResponse(peer, pipe, msg); err != nil {
-		errors.Wrapf(err, "received message from peer without a handshake | peer: %s", peer.RemoteAddress())
-		return err
-	}
-
-	err := handshakeSend(pipe, myKey)
-	return err
-}
-
-func handshakeActive(peer *Peer, pipe *Pipe, myKey *crypt.PrivKey) error {
-	if err := handshakeSend(pipe, myKey); err != nil {
-		return err
-	}
-
-	msg, err := pipe.Receive()
-	if err != nil {
-		return err
-	}
-
-	err = handshakeHandleResponse(peer, pipe, msg)
-	return err
-}
-
-func handshakeSend(pipe *Pipe, myKey *crypt.PrivKey) error {
+func handshakeSend(pipe *Pipe, myKey *crypt.PrivKey, sessionID []byte) error {
 	rq := NewMessage()
 
-	content := append(prefixHandshake, myKey.PubKey.Bytes...)
+	content := []byte{}
+	content = append(content, prefixHandshake...)
+	content = append(content, sessionID...)
+	content = append(content, myKey.PubKey.Bytes...)
 	rq.PayloadSet(content)
 	err := pipe.Send(rq)
 	return err
 }
 
-func handshakeHandleResponse(peer *Peer, pipe *Pipe, msg *Message) error {
-	if !isHandshakeMsg(msg) {
+func (c *cryptMiddleware) handshakeHandleResponse(peer *Peer, msg *Message, localID []byte) error {
+	if !isHandshakeMsg(msg) || len(msg.PayloadGet()) < len(prefixHandshake)+sessionIDLen {
 		return errors.Errorf("invalid handshake message | peer: %s", peer.RemoteAddress())
 	}
 
 	content := msg.PayloadGet()
 
-	result := content[len(prefixHandshake):]
+	remoteID := content[len(prefixHandshake) : len(prefixHandshake)+sessionIDLen]
+	result := content[len(prefixHandshake)+sessionIDLen:]
 
 	key, err := crypt.PubFromBytes(result)
 	if err != nil {
 		return err
 	}
-	peer.Metadata().Put(headerKeyPubKey, key)
+
+	c.sessions.Set(peer, &cryptSession{
+		localID:  localID,
+		remoteID: append([]byte{}, remoteID...),
+		theirKey: key,
+		window:   newReplayWindow(),
+	})
 	return err
 }
@@ -0,0 +1,63 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newCryptTestPeers() (*cryptMiddleware, *Peer, *cryptMiddleware, *Peer) {
+	_, h1 := CryptHandler()
+	_, h2 := CryptHandler()
+	c1 := h1.(*cryptMiddleware)
+	c2 := h2.(*cryptMiddleware)
+
+	p1 := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+	p2 := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+
+	id1 := []byte("0123456789abcdef")
+	id2 := []byte("fedcba9876543210")
+	c1.sessions.Set(p1, &cryptSession{localID: id1, remoteID: id2, theirKey: &c2.myKey.PubKey, window: newReplayWindow()})
+	c2.sessions.Set(p2, &cryptSession{localID: id2, remoteID: id1, theirKey: &c1.myKey.PubKey, window: newReplayWindow()})
+
+	return c1, p1, c2, p2
+}
+
+func TestCryptReplay(t *testing.T) {
+	c1, p1, c2, p2 := newCryptTestPeers()
+
+	msg := NewMessageFromString("hello")
+	_, err := c1.OnSend(p1, nil, msg)
+	assert.NoError(t, err)
+	recorded := append([]byte{}, msg.PayloadGet()...)
+
+	_, err = c2.OnReceive(p2, nil, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", msg.PayloadGetString())
+
+	replayed := NewMessageFromData(recorded)
+	_, err = c2.OnReceive(p2, nil, replayed)
+	assert.IsType(t, &ReplayError{}, errors.Cause(err))
+	assert.Equal(t, ErrorDrop, DefaultErrorPolicy(&MiddlewareError{Err: err}))
+
+	recorded[seqLen-1]++
+	_, err = c2.OnReceive(p2, nil, NewMessageFromData(recorded))
+	assert.Error(t, err)
+	_, isReplay := errors.Cause(err).(*ReplayError)
+	assert.False(t, isReplay)
+}
+
+func TestCryptReplayOtherSession(t *testing.T) {
+	c1, p1, c2, p2 := newCryptTestPeers()
+
+	msg := NewMessageFromString("hello")
+	_, err := c1.OnSend(p1, nil, msg)
+	assert.NoError(t, err)
+
+	session, _ := c2.sessions.Lookup(p2)
+	session.localID = []byte("a new session id")
+
+	_, err = c2.OnReceive(p2, nil, msg)
+	assert.Error(t, err)
+}
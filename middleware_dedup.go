@@ -0,0 +1,183 @@
+package go2p
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DefaultDedupSize is the number of message ids remembered by Dedup
+const DefaultDedupSize = 10000
+
+// DefaultDedupWindow is the time a message id is remembered by Dedup
+const DefaultDedupWindow = 10 * time.Minute
+
+// Deduplicator is a middleware that stops incoming messages
+// whose id was already received from any peer with the same origin.
+//
+// The ids are kept in a cache that is bounded by size (least recently seen ids are evicted)
+// and by time (ids not seen within the window are forgotten)
+type Deduplicator struct {
+	size   int
+	window time.Duration
+	now    func() time.Time
+
+	mutex *sync.Mutex
+	order *list.List
+	items map[dedupKey]*list.Element
+	stats DedupStats
+}
+
+// DedupStats contains the counters of a Deduplicator
+type DedupStats struct {
+	// Hits is the number of stopped duplicates
+	Hits uint64
+	// Misses is the number of messages seen for the first time
+	Misses uint64
+	// Evictions is the number of ids removed because the cache was full or the window passed
+	Evictions uint64
+	// Size is the number of ids in the cache
+	Size int
+}
+
+// dedupKey scopes the message id by its origin,
+// so a peer can not suppress the messages of other origins by sending their ids first
+type dedupKey struct {
+	origin string
+	id     uuid.UUID
+}
+
+type dedupEntry struct {
+	key    dedupKey
+	seenAt time.Time
+}
+
+var _ MiddlewareHandler = (*Deduplicator)(nil)
+
+// Dedup creates a Deduplicator with the DefaultDedupSize and the DefaultDedupWindow.
+// See DedupWith for details
+func Dedup() (string, *Deduplicator) {
+	return DedupWith(DefaultDedupSize, DefaultDedupWindow)
+}
+
+// DedupWith creates a Deduplicator that remembers up to size message ids for the given window.
+// A window of 0 keeps ids until they are evicted by newer ones,
+// a size of 0 (or less) uses the DefaultDedupSize.
+//
+// Share the same instance for all peers of a NetworkConnection, the ids are tracked across peers
+// and scoped by the origin of the message.
+// Place the middleware above the Noise channel (add it before Noise),
+// which authenticates the id and the origin of the message.
+// Below it (or with Crypt) an injected frame could record the id of a legitimate message before it arrives.
+// The origin is still claimed by the sending peer, use Auth to only accept trusted peers
+func DedupWith(size int, window time.Duration) (string, *Deduplicator) {
+	if size <= 0 {
+		size = DefaultDedupSize
+	}
+
+	d := new(Deduplicator)
+	d.size = size
+	d.window = window
+	d.now = time.Now
+	d.mutex = new(sync.Mutex)
+	d.order = list.New()
+	d.items = make(map[dedupKey]*list.Element)
+
+	return "dedup", d
+}
+
+// Stats returns the current counters
+func (d *Deduplicator) Stats() DedupStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	stats := d.stats
+	stats.Size = d.order.Len()
+	return stats
+}
+
+// HitRate returns the fraction of received messages that were duplicates
+func (s DedupStats) HitRate() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(total)
+}
+
+// OnConnect implements MiddlewareHandler
+func (d *Deduplicator) OnConnect(peer *Peer, pipe *Pipe) error {
+	return nil
+}
+
+// OnSend implements MiddlewareHandler, outgoing messages are not tracked
+func (d *Deduplicator) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	return Next, nil
+}
+
+// OnReceive stops the message if its id was already seen
+func (d *Deduplicator) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if msg.id == uuid.Nil {
+		return Next, nil
+	}
+
+	if d.seen(dedupKey{origin: msg.origin, id: msg.id}) {
+		return Stop, nil
+	}
+
+	return Next, nil
+}
+
+// OnDisconnect implements MiddlewareHandler
+func (d *Deduplicator) OnDisconnect(peer *Peer) {}
+
+// seen records the key and returns true if it was already in the cache
+func (d *Deduplicator) seen(key dedupKey) bool {
+	now := d.now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.evictExpired(now)
+
+	if elem, found := d.items[key]; found {
+		elem.Value.(*dedupEntry).seenAt = now
+		d.order.MoveToFront(elem)
+		d.stats.Hits++
+		return true
+	}
+
+	d.stats.Misses++
+	d.items[key] = d.order.PushFront(&dedupEntry{key: key, seenAt: now})
+
+	for elem := d.order.Back(); elem != nil && d.order.Len() > d.size; elem = d.order.Back() {
+		d.evict(elem)
+	}
+
+	return false
+}
+
+// evictExpired removes ids older than the window,
+// starting with the least recently seen ones
+func (d *Deduplicator) evictExpired(now time.Time) {
+	if d.window <= 0 {
+		return
+	}
+
+	for elem := d.order.Back(); elem != nil; elem = d.order.Back() {
+		if now.Sub(elem.Value.(*dedupEntry).seenAt) < d.window {
+			return
+		}
+
+		d.evict(elem)
+	}
+}
+
+func (d *Deduplicator) evict(elem *list.Element) {
+	entry := d.order.Remove(elem).(*dedupEntry)
+	delete(d.items, entry.key)
+	d.stats.Evictions++
+}
@@ -0,0 +1,76 @@
+package go2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedup(t *testing.T) {
+	name, dedup := DedupWith(2, 0)
+	m := NewMiddlewareHandler(name, dedup)
+
+	first := NewMessageFromString("first")
+	second := NewMessageFromString("second")
+	third := NewMessageFromString("third")
+
+	assert.NoError(t, processMiddleware(Receive, first, m))
+	assert.NoError(t, processMiddleware(Send, first, m))
+	assert.Equal(t, ErrPipeStopProcessing, processMiddleware(Receive, first, m))
+
+	assert.NoError(t, processMiddleware(Receive, second, m))
+	assert.NoError(t, processMiddleware(Receive, third, m))
+	assert.NoError(t, processMiddleware(Receive, first, m))
+	assert.Equal(t, ErrPipeStopProcessing, processMiddleware(Receive, third, m))
+
+	stats := dedup.Stats()
+	assert.Equal(t, DedupStats{Hits: 2, Misses: 4, Evictions: 2, Size: 2}, stats)
+	assert.InDelta(t, 2.0/6.0, stats.HitRate(), 0.0001)
+}
+
+func TestDedupWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	name, dedup := DedupWith(10, time.Minute)
+	dedup.now = clock.Now
+	m := NewMiddlewareHandler(name, dedup)
+
+	msg := NewMessageFromString("hello")
+	assert.NoError(t, processMiddleware(Receive, msg, m))
+
+	clock.now = clock.now.Add(30 * time.Second)
+	assert.Equal(t, ErrPipeStopProcessing, processMiddleware(Receive, msg, m))
+
+	clock.now = clock.now.Add(59 * time.Second)
+	assert.Equal(t, ErrPipeStopProcessing, processMiddleware(Receive, msg, m))
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.NoError(t, processMiddleware(Receive, msg, m))
+	assert.Equal(t, uint64(1), dedup.Stats().Evictions)
+}
+
+func TestDedupOrigin(t *testing.T) {
+	name, dedup := DedupWith(10, 0)
+	m := NewMiddlewareHandler(name, dedup)
+
+	msg := NewMessageFromString("hello")
+	msg.origin = "a"
+	assert.NoError(t, processMiddleware(Receive, msg, m))
+
+	// the same id claimed by another origin does not suppress the message
+	msg.origin = "b"
+	assert.NoError(t, processMiddleware(Receive, msg, m))
+	assert.Equal(t, ErrPipeStopProcessing, processMiddleware(Receive, msg, m))
+}
+
+func TestDedupInvalidSize(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		name, dedup := DedupWith(size, 0)
+		assert.Equal(t, DefaultDedupSize, dedup.size)
+
+		m := NewMiddlewareHandler(name, dedup)
+		msg := NewMessageFromString("hello")
+		assert.NoError(t, processMiddleware(Receive, msg, m))
+		assert.Equal(t, ErrPipeStopProcessing, processMiddleware(Receive, msg, m))
+	}
+}
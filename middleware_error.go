@@ -0,0 +1,111 @@
+package go2p
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorAction represents how a peer handles an error returned by a middleware
+type ErrorAction int
+
+const (
+	// ErrorDisconnect reports the error and disconnects the peer
+	ErrorDisconnect ErrorAction = iota
+	// ErrorDrop reports the error and drops the message
+	ErrorDrop ErrorAction = iota
+	// ErrorContinue reports the error and continues with the next middleware
+	ErrorContinue ErrorAction = iota
+)
+
+func (a ErrorAction) String() string {
+	switch a {
+	case ErrorDisconnect:
+		return "Disconnect"
+	case ErrorDrop:
+		return "Drop"
+	case ErrorContinue:
+		return "Continue"
+	}
+
+	return "Unknown"
+}
+
+// valid returns true for the known actions
+func (a ErrorAction) valid() bool {
+	return a >= ErrorDisconnect && a <= ErrorContinue
+}
+
+// MiddlewareError is reported when a middleware returns an error or panics
+type MiddlewareError struct {
+	// Name of the failed middleware
+	Name string
+	// Op is the pipe operation during the error occurred
+	Op PipeOperation
+	// Err is the error returned by the middleware
+	Err error
+	// Panic is true if the middleware panicked
+	Panic bool
+}
+
+func (e *MiddlewareError) Error() string {
+	if e.Panic {
+		return fmt.Sprintf("middleware %s panicked during %s: %v", e.Name, e.Op, e.Err)
+	}
+
+	return fmt.Sprintf("middleware %s failed during %s: %v", e.Name, e.Op, e.Err)
+}
+
+// Cause returns the error returned by the middleware
+func (e *MiddlewareError) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the error returned by the middleware
+func (e *MiddlewareError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorActioner can be implemented by errors that provide
+// the action the DefaultErrorPolicy should apply
+type ErrorActioner interface {
+	ErrorAction() ErrorAction
+}
+
+// ErrorPolicy decides how an error of a middleware is handled.
+// A policy that panics or returns an unknown action disconnects the peer
+type ErrorPolicy func(err *MiddlewareError) ErrorAction
+
+// DefaultErrorPolicy disconnects the peer on any middleware error,
+// unless the cause of the error implements ErrorActioner
+func DefaultErrorPolicy(err *MiddlewareError) ErrorAction {
+	if actioner, ok := errors.Cause(err.Err).(ErrorActioner); ok {
+		return actioner.ErrorAction()
+	}
+
+	return ErrorDisconnect
+}
+
+// PolicyForMiddleware returns a policy that applies action to all errors
+// of the middleware with the given name and uses fallback for all others
+func PolicyForMiddleware(name string, action ErrorAction, fallback ErrorPolicy) ErrorPolicy {
+	return func(err *MiddlewareError) ErrorAction {
+		if err.Name == name {
+			return action
+		}
+
+		return fallback(err)
+	}
+}
+
+// PolicyForError returns a policy that applies action to all errors
+// where match returns true for the cause and uses fallback for all others
+func PolicyForError(match func(cause error) bool, action ErrorAction, fallback ErrorPolicy) ErrorPolicy {
+	return func(err *MiddlewareError) ErrorAction {
+		if match(errors.Cause(err.Err)) {
+			return action
+		}
+
+		return fallback(err)
+	}
+}
@@ -47,12 +47,19 @@ func middlewareHeadersImpl(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResu
 		msg.PayloadSet(full)
 	} else if pipe.Operation() == Receive {
 		full := msg.PayloadGet()
+		if len(full) < 8 {
+			return Stop, errors.Errorf("invalid headers message (len: %d)", len(full))
+		}
 
 		headerSizeData := full[:4]
-		// bodySizeData := full[4:8]
+		bodySizeData := full[4:8]
+
+		headerSize := uint64(binary.BigEndian.Uint32(headerSizeData))
+		bodySize := uint64(binary.BigEndian.Uint32(bodySizeData))
 
-		headerSize := binary.BigEndian.Uint32(headerSizeData)
-		// bodySize := binary.BigEndian.Uint32(bodySizeData)
+		if 8+headerSize+bodySize != uint64(len(full)) {
+			return Stop, errors.Errorf("invalid headers message (len: %d, header: %d, body: %d)", len(full), headerSize, bodySize)
+		}
 
 		header := full[8 : 8+headerSize]
 		body := full[8+headerSize:]
@@ -0,0 +1,467 @@
+package go2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/pkg/errors"
+)
+
+// DefaultNoiseTimeout is the time a peer has to complete the Noise handshake
+const DefaultNoiseTimeout = 10 * time.Second
+
+const noiseVersion = 2
+const noiseNonceLen = 32
+
+var prefixNoiseHello = []byte("noise:h")
+var prefixNoiseHandshake = []byte("noise:m")
+var noisePrologue = []byte("go2p-noise-v1")
+
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// ErrNoiseTimeout is returned when the remote did not complete the Noise handshake in time
+var ErrNoiseTimeout = errors.New("noise handshake timeout")
+
+// NoisePattern is the Noise handshake pattern used by the secure channel
+type NoisePattern byte
+
+const (
+	// NoiseXX transmits both static keys encrypted during the handshake,
+	// no side has to know the key of the remote in advance
+	NoiseXX NoisePattern = iota + 1
+	// NoiseIK needs one round trip less but the initiator has to know the static key
+	// of the responder (see NoiseConfig.PeerKey)
+	NoiseIK
+)
+
+func (p NoisePattern) String() string {
+	switch p {
+	case NoiseXX:
+		return "XX"
+	case NoiseIK:
+		return "IK"
+	}
+
+	return fmt.Sprintf("NoisePattern(%d)", p)
+}
+
+func (p NoisePattern) handshake() (noise.HandshakePattern, bool) {
+	switch p {
+	case NoiseXX:
+		return noise.HandshakeXX, true
+	case NoiseIK:
+		return noise.HandshakeIK, true
+	}
+
+	return noise.HandshakePattern{}, false
+}
+
+// NoiseKey is a static X25519 key pair that identifies a node in the Noise handshake
+type NoiseKey struct {
+	Private []byte
+	Public  []byte
+}
+
+// GenerateNoiseKey creates a new random static key pair
+func GenerateNoiseKey() (NoiseKey, error) {
+	key, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return NoiseKey{}, errors.Wrap(err, "could not generate noise key")
+	}
+
+	return NoiseKey{Private: key.Private, Public: key.Public}, nil
+}
+
+// NoiseError is reported when the Noise handshake with a peer failed
+type NoiseError struct {
+	// Peer is the remote address of the peer
+	Peer string
+	// RemoteStatic is the static key of the remote, if it was received
+	RemoteStatic []byte
+	// Err is the cause of the failure
+	Err error
+}
+
+func (e *NoiseError) Error() string {
+	return fmt.Sprintf("noise handshake failed (peer: %s, remote key: %x): %v", e.Peer, e.RemoteStatic, e.Err)
+}
+
+// NoiseConfig configures the Noise middleware
+type NoiseConfig struct {
+	// Pattern is the handshake pattern, both sides have to use the same one.
+	// 0 uses NoiseXX
+	Pattern NoisePattern
+	// StaticKey is the static key of the local node, a random key is generated if it is empty
+	StaticKey NoiseKey
+	// PeerKey returns the expected static key of the remote.
+	// If a key is returned the remote has to prove that it owns this key.
+	// With NoiseIK it is required on both sides because each side can become the initiator
+	PeerKey func(peer *Peer) ([]byte, bool)
+	// Authorize is called with the authenticated static key of the remote,
+	// the peer is disconnected if it returns an error
+	Authorize func(peer *Peer, remoteStatic []byte) error
+	// HandshakeTimeout is the time a peer has to complete the handshake,
+	// 0 uses DefaultNoiseTimeout and a negative value disables the timeout
+	HandshakeTimeout time.Duration
+	// Rekey configures when the key of the outgoing frames is replaced,
+	// each side uses its own limits
+	Rekey NoiseRekey
+	// OnRekey is called when a key of a session was replaced.
+	// It is called from the peer workers and should not block
+	OnRekey func(event RekeyEvent)
+}
+
+// NoiseChannel is a middleware that encrypts the communication with the Noise protocol
+// (X25519, ChaCha20-Poly1305 and SHA-256)
+type NoiseChannel struct {
+	config   NoiseConfig
+	sessions *PeerState[*noiseSession]
+	now      func() time.Time
+}
+
+var _ MiddlewareHandler = (*NoiseChannel)(nil)
+
+// Noise creates a Noise middleware with the NoiseXX pattern and a random static key.
+// It accepts any remote key, so the traffic is encrypted but the peers are not authenticated.
+// See NoiseWith for details
+func Noise() (string, *NoiseChannel) {
+	return NoiseWith(NoiseConfig{})
+}
+
+// NoiseWith creates a middleware that establishes a secure channel when a peer connects.
+//
+// Both sides send a random nonce first, the side with the higher nonce becomes the initiator
+// of the handshake. The nonces are part of the prologue, so a changed nonce breaks the handshake.
+// The handshake authenticates the static keys of both sides, derives new transport keys
+// for each connection (forward secrecy) and hashes the whole transcript.
+// No other message is processed until the handshake completed,
+// the peer is disconnected with a NoiseError if it fails or does not complete in time.
+//
+// Without PeerKey and Authorize any remote key is accepted,
+// use them to restrict the channel to known nodes.
+// Each frame carries an explicit nonce that is checked against a replay window,
+// replayed frames are dropped with a ReplayError.
+//
+// The envelope of the message (id, creation time, origin and deadline) is encrypted together
+// with the payload and replaces the unauthenticated copy that is written in front of the frame,
+// so the middlewares above the channel see the values of the authenticated remote.
+//
+// The keys of both directions are replaced when a limit of the Rekey config is reached,
+// with a new Diffie-Hellman exchange of ephemeral keys. The remote follows the generation
+// of the key that is part of each frame, so both sides stay in sync without pausing the traffic
+func NoiseWith(config NoiseConfig) (string, *NoiseChannel) {
+	if config.Pattern == 0 {
+		config.Pattern = NoiseXX
+	}
+	if config.HandshakeTimeout == 0 {
+		config.HandshakeTimeout = DefaultNoiseTimeout
+	}
+	config.Rekey = config.Rekey.withDefaults()
+	if len(config.StaticKey.Private) == 0 {
+		key, err := GenerateNoiseKey()
+		if err != nil {
+			panic(err)
+		}
+		config.StaticKey = key
+	}
+
+	n := new(NoiseChannel)
+	n.config = config
+	n.sessions = NewPeerState[*noiseSession]("noise", nil, nil)
+	n.now = time.Now
+
+	return "noise", n
+}
+
+// PublicKey returns the static public key of the local node
+func (n *NoiseChannel) PublicKey() []byte {
+	return n.config.StaticKey.Public
+}
+
+// RemoteStatic returns the authenticated static key of the remote
+// or false if no handshake was completed with the peer
+func (n *NoiseChannel) RemoteStatic(peer *Peer) ([]byte, bool) {
+	session, found := n.sessions.Lookup(peer)
+	if !found {
+		return nil, false
+	}
+
+	return session.remoteStatic, true
+}
+
+// OnConnect runs the Noise handshake
+func (n *NoiseChannel) OnConnect(peer *Peer, pipe *Pipe) error {
+	var timedOut int32
+	if n.config.HandshakeTimeout > 0 {
+		timer := time.AfterFunc(n.config.HandshakeTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			peer.stopInternal()
+		})
+		defer timer.Stop()
+	}
+
+	send := func(prefix []byte, content []byte) error {
+		return noiseSend(pipe, prefix, content)
+	}
+	receive := func(prefix []byte) ([]byte, error) {
+		return noiseReceive(pipe, prefix)
+	}
+
+	session, err := n.handshake(peer, send, receive)
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = ErrNoiseTimeout
+	}
+
+	if err != nil {
+		result := &NoiseError{Peer: peer.RemoteAddress(), Err: err}
+		if session != nil {
+			result.RemoteStatic = session.remoteStatic
+		}
+		return result
+	}
+
+	n.sessions.Set(peer, session)
+	peer.setChannelBinding(session.channelBinding)
+	return nil
+}
+
+// handshake returns the session and an error if the remote was not accepted.
+// On errors after the remote key was authenticated the session is returned with the error
+func (n *NoiseChannel) handshake(peer *Peer, send func([]byte, []byte) error, receive func([]byte) ([]byte, error)) (*noiseSession, error) {
+	pattern, ok := n.config.Pattern.handshake()
+	if !ok {
+		return nil, errors.Errorf("unknown noise pattern %s", n.config.Pattern)
+	}
+
+	myNonce := make([]byte, noiseNonceLen)
+	if _, err := io.ReadFull(rand.Reader, myNonce); err != nil {
+		return nil, errors.Wrap(err, "could not create nonce")
+	}
+
+	hello := make([]byte, 0, 2+noiseNonceLen)
+	hello = append(hello, noiseVersion, byte(n.config.Pattern))
+	hello = append(hello, myNonce...)
+	if err := send(prefixNoiseHello, hello); err != nil {
+		return nil, err
+	}
+
+	theirHello, err := receive(prefixNoiseHello)
+	if err != nil {
+		return nil, err
+	}
+	if len(theirHello) != 2+noiseNonceLen {
+		return nil, errors.Errorf("invalid hello (len: %d)", len(theirHello))
+	}
+	if theirHello[0] != noiseVersion {
+		return nil, errors.Errorf("unsupported noise version %d", theirHello[0])
+	}
+	if NoisePattern(theirHello[1]) != n.config.Pattern {
+		return nil, errors.Errorf("pattern mismatch (local: %s, remote: %s)", n.config.Pattern, NoisePattern(theirHello[1]))
+	}
+
+	theirNonce := theirHello[2:]
+	order := bytes.Compare(myNonce, theirNonce)
+	if order == 0 {
+		return nil, errors.New("remote reflected the nonce")
+	}
+
+	initiator := order > 0
+	prologue := append([]byte{}, noisePrologue...)
+	if initiator {
+		prologue = append(prologue, myNonce...)
+		prologue = append(prologue, theirNonce...)
+	} else {
+		prologue = append(prologue, theirNonce...)
+		prologue = append(prologue, myNonce...)
+	}
+
+	var expected []byte
+	if n.config.PeerKey != nil {
+		expected, _ = n.config.PeerKey(peer)
+	}
+
+	config := noise.Config{
+		CipherSuite:   noiseCipherSuite,
+		Random:        rand.Reader,
+		Pattern:       pattern,
+		Initiator:     initiator,
+		Prologue:      prologue,
+		StaticKeypair: noise.DHKey{Private: n.config.StaticKey.Private, Public: n.config.StaticKey.Public},
+	}
+	if n.config.Pattern == NoiseIK && initiator {
+		if expected == nil {
+			return nil, errors.New("the IK pattern requires the static key of the remote")
+		}
+		config.PeerStatic = expected
+	}
+
+	state, err := noise.NewHandshakeState(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create handshake state")
+	}
+
+	// the messages alternate between the initiator and the responder
+	// until one of the calls returns the cipher states
+	var toResponder, toInitiator *noise.CipherState
+	writing := initiator
+	for toResponder == nil {
+		if writing {
+			var out []byte
+			out, toResponder, toInitiator, err = state.WriteMessage(nil, nil)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not write handshake message")
+			}
+			if err := send(prefixNoiseHandshake, out); err != nil {
+				return nil, err
+			}
+		} else {
+			content, err := receive(prefixNoiseHandshake)
+			if err != nil {
+				return nil, err
+			}
+			if _, toResponder, toInitiator, err = state.ReadMessage(nil, content); err != nil {
+				return nil, errors.Wrap(err, "invalid handshake message")
+			}
+		}
+
+		writing = !writing
+	}
+
+	sendKey, receiveKey := toResponder, toInitiator
+	if !initiator {
+		sendKey, receiveKey = toInitiator, toResponder
+	}
+
+	session := newNoiseSession(state.PeerStatic(), sendKey.Cipher(), receiveKey.Cipher(), n.config.Rekey, n.now)
+	session.channelBinding = state.ChannelBinding()
+	if n.config.OnRekey != nil {
+		session.onRekey = func(event RekeyEvent) {
+			event.Peer = peer
+			n.config.OnRekey(event)
+		}
+	}
+
+	if expected != nil && !bytes.Equal(expected, session.remoteStatic) {
+		return session, errors.New("unexpected static key of the remote")
+	}
+	if n.config.Authorize != nil {
+		if err := n.config.Authorize(peer, session.remoteStatic); err != nil {
+			return session, errors.Wrap(err, "remote not authorized")
+		}
+	}
+
+	return session, nil
+}
+
+// OnSend encrypts the message with the current key of the session.
+// If a rekey limit was reached the rekey request is sent before the message
+func (n *NoiseChannel) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	session, found := n.sessions.Lookup(peer)
+	if !found {
+		return Stop, errors.Errorf("no noise session with peer | peer: %s", peer.RemoteAddress())
+	}
+
+	peer.stampOrigin(msg)
+	sealed, err := msg.sealEnvelope()
+	if err != nil {
+		return Stop, err
+	}
+
+	frame, request, err := session.seal(sealed)
+	if err != nil {
+		return Stop, err
+	}
+
+	if request != nil {
+		if err := noiseSendFrame(pipe, request); err != nil {
+			return Stop, err
+		}
+	}
+
+	msg.PayloadSet(frame)
+	return Next, nil
+}
+
+// OnReceive decrypts the message and checks its nonce against the replay window.
+// Rekey frames are answered and not passed to the next middleware
+func (n *NoiseChannel) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	session, found := n.sessions.Lookup(peer)
+	if !found {
+		return Stop, errors.Errorf("received message from peer without a noise session | peer: %s", peer.RemoteAddress())
+	}
+
+	frameType, content, err := session.open(msg.PayloadGet())
+	if err != nil {
+		return Stop, err
+	}
+
+	if frameType == noiseFrameData {
+		payload, err := msg.openEnvelope(content)
+		if err != nil {
+			return Stop, err
+		}
+
+		msg.PayloadSet(payload)
+		return Next, nil
+	}
+
+	response, err := session.control(frameType, content)
+	if err != nil {
+		return Stop, err
+	}
+
+	if response != nil {
+		if err := noiseSendFrame(pipe, response); err != nil {
+			return Stop, err
+		}
+	}
+
+	return Stop, nil
+}
+
+// OnDisconnect implements MiddlewareHandler,
+// the session is removed together with the peer state
+func (n *NoiseChannel) OnDisconnect(peer *Peer) {}
+
+// OrderIndependent implements OrderIndependentHandler,
+// the nonces are explicit and the replay window accepts reordered frames
+func (n *NoiseChannel) OrderIndependent() bool {
+	return true
+}
+
+func noiseSend(pipe *Pipe, prefix []byte, content []byte) error {
+	msg := NewMessage()
+
+	payload := make([]byte, 0, len(prefix)+len(content))
+	payload = append(payload, prefix...)
+	payload = append(payload, content...)
+	msg.PayloadSet(payload)
+
+	return pipe.Send(msg)
+}
+
+func noiseReceive(pipe *Pipe, prefix []byte) ([]byte, error) {
+	msg, err := pipe.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	content := msg.PayloadGet()
+	if !bytes.HasPrefix(content, prefix) {
+		return nil, errors.Errorf("unexpected noise message (expected: %s)", prefix)
+	}
+
+	return content[len(prefix):], nil
+}
+
+func noiseSendFrame(pipe *Pipe, frame []byte) error {
+	msg := NewMessage()
+	msg.PayloadSet(frame)
+
+	return pipe.Send(msg)
+}
@@ -0,0 +1,337 @@
+package go2p
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type noiseTestResult struct {
+	session *noiseSession
+	err     error
+}
+
+// runNoiseHandshake runs the handshake of both channels over in-memory queues
+func runNoiseHandshake(n1 *NoiseChannel, p1 *Peer, n2 *NoiseChannel, p2 *Peer) (noiseTestResult, noiseTestResult) {
+	to1 := make(chan []byte, 10)
+	to2 := make(chan []byte, 10)
+
+	run := func(n *NoiseChannel, peer *Peer, in chan []byte, out chan []byte, result chan noiseTestResult) {
+		send := func(prefix []byte, content []byte) error {
+			out <- append(append([]byte{}, prefix...), content...)
+			return nil
+		}
+		receive := func(prefix []byte) ([]byte, error) {
+			content, ok := <-in
+			if !ok {
+				return nil, DisconnectedError
+			}
+			if !bytes.HasPrefix(content, prefix) {
+				return nil, errors.Errorf("unexpected message (expected: %s)", prefix)
+			}
+			return content[len(prefix):], nil
+		}
+
+		session, err := n.handshake(peer, send, receive)
+		// a failed side closes the connection
+		if err != nil {
+			close(out)
+		}
+		result <- noiseTestResult{session: session, err: err}
+	}
+
+	r1 := make(chan noiseTestResult, 1)
+	r2 := make(chan noiseTestResult, 1)
+	go run(n1, p1, to1, to2, r1)
+	go run(n2, p2, to2, to1, r2)
+
+	return <-r1, <-r2
+}
+
+// noiseTransfer seals the content and opens the frame on the other side
+func noiseTransfer(from *noiseSession, to *noiseSession, content []byte) ([]byte, error) {
+	frame, _, err := from.seal(content)
+	if err != nil {
+		return nil, err
+	}
+
+	_, result, err := to.open(frame)
+	return result, err
+}
+
+func newNoiseTestPeer() *Peer {
+	return newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+}
+
+func TestNoiseHandshakeXX(t *testing.T) {
+	_, n1 := Noise()
+	_, n2 := Noise()
+
+	r1, r2 := runNoiseHandshake(n1, newNoiseTestPeer(), n2, newNoiseTestPeer())
+	if !assert.NoError(t, r1.err) || !assert.NoError(t, r2.err) {
+		return
+	}
+
+	assert.Equal(t, n2.PublicKey(), r1.session.remoteStatic)
+	assert.Equal(t, n1.PublicKey(), r2.session.remoteStatic)
+	assert.NotEmpty(t, r1.session.channelBinding)
+	assert.Equal(t, r1.session.channelBinding, r2.session.channelBinding)
+
+	content, err := noiseTransfer(r1.session, r2.session, []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	content, err = noiseTransfer(r2.session, r1.session, []byte("world"))
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(content))
+
+	// each direction has its own key
+	_, err = noiseTransfer(r1.session, r1.session, []byte("reflected"))
+	assert.Error(t, err)
+}
+
+func TestNoiseHandshakeIK(t *testing.T) {
+	key1, _ := GenerateNoiseKey()
+	key2, _ := GenerateNoiseKey()
+	peerKey := func(key NoiseKey) func(peer *Peer) ([]byte, bool) {
+		return func(peer *Peer) ([]byte, bool) {
+			return key.Public, true
+		}
+	}
+
+	_, n1 := NoiseWith(NoiseConfig{Pattern: NoiseIK, StaticKey: key1, PeerKey: peerKey(key2)})
+	_, n2 := NoiseWith(NoiseConfig{Pattern: NoiseIK, StaticKey: key2, PeerKey: peerKey(key1)})
+
+	r1, r2 := runNoiseHandshake(n1, newNoiseTestPeer(), n2, newNoiseTestPeer())
+	if !assert.NoError(t, r1.err) || !assert.NoError(t, r2.err) {
+		return
+	}
+
+	assert.Equal(t, key2.Public, r1.session.remoteStatic)
+	assert.Equal(t, key1.Public, r2.session.remoteStatic)
+
+	content, err := noiseTransfer(r1.session, r2.session, []byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(content))
+
+	// the initiator can not start without the key of the responder
+	_, n3 := NoiseWith(NoiseConfig{Pattern: NoiseIK})
+	_, n4 := NoiseWith(NoiseConfig{Pattern: NoiseIK})
+	r3, r4 := runNoiseHandshake(n3, newNoiseTestPeer(), n4, newNoiseTestPeer())
+	assert.Error(t, r3.err)
+	assert.Error(t, r4.err)
+}
+
+func TestNoiseRejected(t *testing.T) {
+	other, _ := GenerateNoiseKey()
+	denied := errors.New("denied")
+
+	tests := map[string]NoiseConfig{
+		"unexpected key": {PeerKey: func(peer *Peer) ([]byte, bool) {
+			return other.Public, true
+		}},
+		"not authorized": {Authorize: func(peer *Peer, remoteStatic []byte) error {
+			return denied
+		}},
+		"pattern mismatch": {Pattern: NoiseIK},
+	}
+
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, n1 := Noise()
+			_, n2 := NoiseWith(config)
+
+			_, r2 := runNoiseHandshake(n1, newNoiseTestPeer(), n2, newNoiseTestPeer())
+			assert.Error(t, r2.err)
+		})
+	}
+}
+
+func TestNoiseReplay(t *testing.T) {
+	_, n1 := Noise()
+	_, n2 := Noise()
+	p1 := newNoiseTestPeer()
+	p2 := newNoiseTestPeer()
+
+	r1, r2 := runNoiseHandshake(n1, p1, n2, p2)
+	if !assert.NoError(t, r1.err) || !assert.NoError(t, r2.err) {
+		return
+	}
+	n1.sessions.Set(p1, r1.session)
+	n2.sessions.Set(p2, r2.session)
+
+	msg := NewMessageFromString("hello")
+	_, err := n1.OnSend(p1, nil, msg)
+	assert.NoError(t, err)
+	recorded := append([]byte{}, msg.PayloadGet()...)
+
+	_, err = n2.OnReceive(p2, nil, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", msg.PayloadGetString())
+
+	_, err = n2.OnReceive(p2, nil, NewMessageFromData(append([]byte{}, recorded...)))
+	assert.IsType(t, &ReplayError{}, errors.Cause(err))
+	assert.Equal(t, ErrorDrop, DefaultErrorPolicy(&MiddlewareError{Err: err}))
+
+	// a changed nonce breaks the authentication and does not move the window
+	recorded[noiseFrameHeaderLen-1]++
+	_, err = n2.OnReceive(p2, nil, NewMessageFromData(recorded))
+	assert.Error(t, err)
+	_, isReplay := errors.Cause(err).(*ReplayError)
+	assert.False(t, isReplay)
+
+	msg = NewMessageFromString("next")
+	_, _ = n1.OnSend(p1, nil, msg)
+	_, err = n2.OnReceive(p2, nil, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "next", msg.PayloadGetString())
+}
+
+func TestNoiseEnvelope(t *testing.T) {
+	_, n1 := Noise()
+	_, n2 := Noise()
+	p1 := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{identity: "node-1"})
+	p2 := newNoiseTestPeer()
+
+	r1, r2 := runNoiseHandshake(n1, p1, n2, p2)
+	if !assert.NoError(t, r1.err) || !assert.NoError(t, r2.err) {
+		return
+	}
+	n1.sessions.Set(p1, r1.session)
+	n2.sessions.Set(p2, r2.session)
+
+	msg := NewMessageFromString("hello")
+	msg.SetDeadline(time.Now().Add(time.Hour))
+	_, err := n1.OnSend(p1, nil, msg)
+	assert.NoError(t, err)
+	id, deadline := msg.id, msg.deadline
+
+	// the envelope in front of the frame is replaced by the sealed one
+	msg.id = uuid.New()
+	msg.origin = "node-2"
+	msg.deadline = time.Time{}
+
+	_, err = n2.OnReceive(p2, nil, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", msg.PayloadGetString())
+	assert.Equal(t, id, msg.id)
+	assert.Equal(t, "node-1", msg.Origin())
+	assert.True(t, deadline.Equal(msg.Deadline()))
+
+	_, err = msg.openEnvelope([]byte{0, 0, 0, 10, 1})
+	assert.Error(t, err)
+}
+
+// noiseDeliver opens the frame and answers rekey frames until no frame is left,
+// it returns the content of the data frame
+func noiseDeliver(t *testing.T, from *noiseSession, to *noiseSession, frame []byte) []byte {
+	frameType, content, err := to.open(frame)
+	if !assert.NoError(t, err) || frameType == noiseFrameData {
+		return content
+	}
+
+	response, err := to.control(frameType, content)
+	assert.NoError(t, err)
+	if response != nil {
+		noiseDeliver(t, to, from, response)
+	}
+
+	return nil
+}
+
+func TestNoiseRekey(t *testing.T) {
+	var events []RekeyEvent
+	onRekey := func(event RekeyEvent) {
+		events = append(events, event)
+	}
+
+	_, n1 := NoiseWith(NoiseConfig{Rekey: NoiseRekey{Messages: 3, Bytes: -1, Interval: -1}, OnRekey: onRekey})
+	_, n2 := NoiseWith(NoiseConfig{Rekey: NoiseRekey{Messages: -1, Bytes: -1, Interval: -1}, OnRekey: onRekey})
+	p1 := newNoiseTestPeer()
+	p2 := newNoiseTestPeer()
+
+	r1, r2 := runNoiseHandshake(n1, p1, n2, p2)
+	if !assert.NoError(t, r1.err) || !assert.NoError(t, r2.err) {
+		return
+	}
+	s1, s2 := r1.session, r2.session
+
+	var old [][]byte
+	for i := 0; i < 13; i++ {
+		frame, request, err := s1.seal([]byte{byte(i)})
+		assert.NoError(t, err)
+		if request != nil {
+			noiseDeliver(t, s1, s2, request)
+		}
+
+		assert.Equal(t, []byte{byte(i)}, noiseDeliver(t, s1, s2, frame))
+		old = append(old, frame)
+
+		// the direction without limits keeps its key
+		content, err := noiseTransfer(s2, s1, []byte("pong"))
+		assert.NoError(t, err)
+		assert.Equal(t, "pong", string(content))
+	}
+
+	// the limit is checked before a frame is sealed and the request is counted as well,
+	// so each key seals four data frames and the request
+	assert.Equal(t, uint32(3), s1.out.generation)
+	assert.Equal(t, uint32(3), s2.in.current.generation)
+	assert.Equal(t, uint32(0), s2.out.generation)
+
+	if assert.Len(t, events, 6) {
+		assert.Equal(t, RekeyEvent{Peer: p1, Direction: Send, Generation: 1, Reason: RekeyMessages, Messages: 5, Bytes: 4}, events[0])
+		assert.Equal(t, RekeyEvent{Peer: p2, Direction: Receive, Generation: 1, Reason: RekeyMessages, Messages: 5, Bytes: 4}, events[1])
+	}
+
+	// the previous key accepts reordered frames, older keys are discarded
+	late := sealNoiseFrame(s2.in.previous.cipher, noiseFrameData, 2, 1000, []byte("late"))
+	_, content, err := s2.open(late)
+	assert.NoError(t, err)
+	assert.Equal(t, "late", string(content))
+
+	_, _, err = s2.open(old[0])
+	assert.IsType(t, &StaleKeyError{}, err)
+	assert.Equal(t, ErrorDrop, DefaultErrorPolicy(&MiddlewareError{Err: err}))
+}
+
+func TestNoiseRekeyInterval(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	_, n1 := NoiseWith(NoiseConfig{Rekey: NoiseRekey{Interval: time.Minute}})
+	n1.now = clock.Now
+	_, n2 := Noise()
+
+	r1, r2 := runNoiseHandshake(n1, newNoiseTestPeer(), n2, newNoiseTestPeer())
+	if !assert.NoError(t, r1.err) || !assert.NoError(t, r2.err) {
+		return
+	}
+	s1, s2 := r1.session, r2.session
+
+	_, request, err := s1.seal([]byte("idle"))
+	assert.NoError(t, err)
+	assert.Nil(t, request)
+
+	clock.now = clock.now.Add(time.Minute)
+	frame, request, err := s1.seal([]byte("later"))
+	assert.NoError(t, err)
+	if !assert.NotNil(t, request) {
+		return
+	}
+
+	// a second frame does not repeat the pending request
+	_, again, _ := s1.seal([]byte("again"))
+	assert.Nil(t, again)
+
+	noiseDeliver(t, s1, s2, request)
+	assert.Equal(t, "later", string(noiseDeliver(t, s1, s2, frame)))
+	assert.Equal(t, uint32(1), s1.out.generation)
+	assert.Equal(t, clock.now, s1.out.since)
+
+	// the response can not be applied twice
+	_, err = s1.control(noiseFrameRekeyResponse, make([]byte, 4+1+noiseKeyLen))
+	assert.Error(t, err)
+}
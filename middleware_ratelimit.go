@@ -0,0 +1,367 @@
+package go2p
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitAction represents what the RateLimit middleware does
+// with a message that exceeds a limit
+type RateLimitAction int
+
+const (
+	// RateLimitDrop drops the message
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitDelay holds the message until the limit allows it (at most RateLimitConfig.MaxDelay).
+	// While a message is held no further messages are read from the peer
+	RateLimitDelay RateLimitAction = iota
+	// RateLimitDisconnect disconnects the peer and bans it for RateLimitConfig.BanDuration
+	RateLimitDisconnect RateLimitAction = iota
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitDelay:
+		return "delay"
+	case RateLimitDisconnect:
+		return "disconnect"
+	}
+
+	return fmt.Sprintf("RateLimitAction(%d)", a)
+}
+
+// Limit defines token bucket limits for messages and bytes.
+// A zero rate disables the limit, a zero burst allows one second of the rate.
+// Messages larger than ByteBurst are only accepted with RateLimitDelay
+type Limit struct {
+	// Messages is the number of messages allowed per second
+	Messages float64
+	// MessageBurst is the number of messages allowed at once
+	MessageBurst int
+	// Bytes is the payload size allowed per second
+	Bytes float64
+	// ByteBurst is the payload size allowed at once
+	ByteBurst int
+}
+
+// RateLimitConfig contains the settings of the RateLimit middleware
+type RateLimitConfig struct {
+	// Peer limits all incoming messages of a peer
+	Peer Limit
+	// Routes limits the incoming messages of a peer per route path (see Routes)
+	Routes map[string]Limit
+	// Action is applied to messages that exceed a limit
+	Action RateLimitAction
+	// MaxDelay is the longest time a message is held with RateLimitDelay,
+	// messages that would wait longer are dropped
+	MaxDelay time.Duration
+	// BanDuration is the time a peer is rejected after it was disconnected with RateLimitDisconnect
+	BanDuration time.Duration
+}
+
+// RateLimitError is reported when a message exceeds a limit
+// or a banned peer tries to connect
+type RateLimitError struct {
+	// Peer is the remote address of the peer
+	Peer string
+	// Route is the route path of the message or empty if the peer limit was exceeded
+	Route string
+	// Action is the configured RateLimitAction
+	Action RateLimitAction
+	// Banned is true if the peer was rejected because of an earlier ban
+	Banned bool
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Banned {
+		return fmt.Sprintf("peer %s is banned", e.Peer)
+	}
+
+	if e.Route != "" {
+		return fmt.Sprintf("rate limit exceeded (peer: %s, route: %s, action: %s)", e.Peer, e.Route, e.Action)
+	}
+
+	return fmt.Sprintf("rate limit exceeded (peer: %s, action: %s)", e.Peer, e.Action)
+}
+
+// ErrorAction implements ErrorActioner,
+// the peer is disconnected for RateLimitDisconnect and banned peers,
+// otherwise the message is dropped
+func (e *RateLimitError) ErrorAction() ErrorAction {
+	if e.Banned || e.Action == RateLimitDisconnect {
+		return ErrorDisconnect
+	}
+
+	return ErrorDrop
+}
+
+type rateLimiter struct {
+	config RateLimitConfig
+	peers  *PeerState[*rateLimitState]
+	now    func() time.Time
+
+	bansMutex *sync.Mutex
+	bans      map[string]time.Time
+}
+
+type rateLimitState struct {
+	mutex  *sync.Mutex
+	peer   *limitBuckets
+	routes map[string]*limitBuckets
+}
+
+type limitBuckets struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+// RateLimit creates a middleware that limits the incoming messages of each peer.
+//
+// Messages are counted against the peer limit and the limit of their route.
+// The middleware should be placed between Routes and Headers,
+// so the route is known on receive and messages are limited before
+// they reach the route handlers
+func RateLimit(config RateLimitConfig) (string, MiddlewareHandler) {
+	r := new(rateLimiter)
+	r.config = config
+	r.now = time.Now
+	r.bansMutex = new(sync.Mutex)
+	r.bans = make(map[string]time.Time)
+	r.peers = NewPeerState("ratelimit", func(peer *Peer) *rateLimitState {
+		return &rateLimitState{
+			mutex:  new(sync.Mutex),
+			peer:   newLimitBuckets(config.Peer, r.now()),
+			routes: make(map[string]*limitBuckets),
+		}
+	}, nil)
+
+	return "ratelimit", r
+}
+
+// OnConnect rejects banned peers
+func (r *rateLimiter) OnConnect(peer *Peer, pipe *Pipe) error {
+	key := banKey(peer.RemoteAddress())
+
+	r.bansMutex.Lock()
+	defer r.bansMutex.Unlock()
+
+	until, found := r.bans[key]
+	if !found {
+		return nil
+	}
+
+	if r.now().Before(until) {
+		return &RateLimitError{Peer: peer.RemoteAddress(), Action: RateLimitDisconnect, Banned: true}
+	}
+
+	delete(r.bans, key)
+	return nil
+}
+
+// OnSend implements MiddlewareHandler, outgoing messages are not limited
+func (r *rateLimiter) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	return Next, nil
+}
+
+// OnReceive checks the incoming message against the peer and the route limits
+func (r *rateLimiter) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	route := ""
+	if routeHdr, found := msg.Metadata().Get(annotationKey); found {
+		route, _ = routeHdr.(string)
+	}
+
+	maxDelay := time.Duration(0)
+	if r.config.Action == RateLimitDelay {
+		maxDelay = r.config.MaxDelay
+	}
+
+	wait, limitedRoute, ok := r.take(peer, route, len(msg.PayloadGet()), maxDelay)
+	if ok && wait <= 0 {
+		return Next, nil
+	}
+
+	if ok {
+		if !sleepPeer(peer, wait) {
+			return Stop, nil
+		}
+		return Next, nil
+	}
+
+	if r.config.Action == RateLimitDisconnect {
+		r.ban(peer.RemoteAddress())
+	}
+
+	return Stop, &RateLimitError{Peer: peer.RemoteAddress(), Route: limitedRoute, Action: r.config.Action}
+}
+
+// OnDisconnect implements MiddlewareHandler,
+// the buckets of the peer are removed together with the peer state
+func (r *rateLimiter) OnDisconnect(peer *Peer) {}
+
+// take consumes the message from all buckets of the peer and its route.
+// It returns the time the message has to wait, the route of the exceeded limit
+// and false if the message exceeds a limit for longer than maxDelay
+func (r *rateLimiter) take(peer *Peer, route string, size int, maxDelay time.Duration) (time.Duration, string, bool) {
+	state := r.peers.Get(peer)
+	now := r.now()
+
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	buckets := []*limitBuckets{state.peer}
+	routeLimit, hasRouteLimit := r.config.Routes[route]
+	if hasRouteLimit {
+		routeBuckets, found := state.routes[route]
+		if !found {
+			routeBuckets = newLimitBuckets(routeLimit, now)
+			state.routes[route] = routeBuckets
+		}
+		buckets = append(buckets, routeBuckets)
+	}
+
+	wait := time.Duration(0)
+	for i, b := range buckets {
+		bucketWait := maxDuration(b.messages.wait(1, now), b.bytes.wait(float64(size), now))
+		if bucketWait > maxDelay {
+			if i == 0 {
+				return bucketWait, "", false
+			}
+			return bucketWait, route, false
+		}
+		wait = maxDuration(wait, bucketWait)
+	}
+
+	for _, b := range buckets {
+		b.messages.consume(1)
+		b.bytes.consume(float64(size))
+	}
+
+	return wait, "", true
+}
+
+// ban bans the host of the address for RateLimitConfig.BanDuration,
+// expired bans of hosts that never reconnected are removed on the way
+func (r *rateLimiter) ban(addr string) {
+	if r.config.BanDuration <= 0 {
+		return
+	}
+
+	r.bansMutex.Lock()
+	defer r.bansMutex.Unlock()
+
+	now := r.now()
+	for key, until := range r.bans {
+		if !now.Before(until) {
+			delete(r.bans, key)
+		}
+	}
+
+	r.bans[banKey(addr)] = now.Add(r.config.BanDuration)
+}
+
+// banKey returns the host of the address because
+// the port of incoming connections changes with each connect.
+// Adapters return addresses as "network:host:port" (see adapterTCP.RemoteAddress),
+// the network prefix is removed before the address is split
+func banKey(addr string) string {
+	if network := strings.Index(addr, ":"); network > 0 && !strings.Contains(addr[:network], "[") {
+		if host, _, err := net.SplitHostPort(addr[network+1:]); err == nil {
+			return host
+		}
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// sleepPeer waits for the given duration or until the peer is stopped.
+// It returns false if the peer was stopped
+func sleepPeer(peer *Peer, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-peer.awaiter.CancelRequested():
+		return false
+	}
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func newLimitBuckets(limit Limit, now time.Time) *limitBuckets {
+	return &limitBuckets{
+		messages: newTokenBucket(limit.Messages, limit.MessageBurst, now),
+		bytes:    newTokenBucket(limit.Bytes, limit.ByteBurst, now),
+	}
+}
+
+// tokenBucket refills rate tokens per second up to burst.
+// A nil tokenBucket has no limit
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	b := new(tokenBucket)
+	b.rate = rate
+	b.burst = float64(burst)
+	if burst <= 0 {
+		b.burst = math.Max(1, math.Ceil(rate))
+	}
+	b.tokens = b.burst
+	b.last = now
+
+	return b
+}
+
+// wait refills the bucket and returns the time until n tokens are available
+func (b *tokenBucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+
+	if b.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// consume removes n tokens, the bucket goes into debt for delayed messages
+func (b *tokenBucket) consume(n float64) {
+	if b == nil {
+		return
+	}
+
+	b.tokens -= n
+}
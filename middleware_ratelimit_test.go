@@ -0,0 +1,148 @@
+package go2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newRateLimitTest(config RateLimitConfig, remote string) (*Middleware, *Peer, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	name, handler := RateLimit(config)
+	handler.(*rateLimiter).now = clock.Now
+
+	adapter := new(MockAdapter)
+	adapter.On("RemoteAddress").Return(remote)
+	peer := newPeer(adapter, newMiddlewareChain(), &peerConfig{})
+
+	return NewMiddlewareHandler(name, handler), peer, clock
+}
+
+func receiveLimited(m *Middleware, peer *Peer, msg *Message) error {
+	p := newPipe(peer, newMiddlewares(m), Receive, 0, 0, 1)
+	return p.process(msg)
+}
+
+func TestRateLimitPeer(t *testing.T) {
+	m, peer, clock := newRateLimitTest(RateLimitConfig{
+		Peer: Limit{Messages: 2, MessageBurst: 3, Bytes: 100},
+	}, "127.0.0.1:4000")
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, receiveLimited(m, peer, NewMessageFromString("hi")))
+	}
+
+	err := receiveLimited(m, peer, NewMessageFromString("hi"))
+	assert.Equal(t, ErrPipeStopProcessing, err)
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	assert.NoError(t, receiveLimited(m, peer, NewMessageFromString("hi")))
+
+	clock.now = clock.now.Add(10 * time.Second)
+	err = receiveLimited(m, peer, NewMessageFromData(make([]byte, 101)))
+	assert.Equal(t, ErrPipeStopProcessing, err)
+	assert.NoError(t, receiveLimited(m, peer, NewMessageFromData(make([]byte, 100))))
+}
+
+func TestRateLimitRoute(t *testing.T) {
+	m, peer, _ := newRateLimitTest(RateLimitConfig{
+		Routes: map[string]Limit{"chat": {Messages: 1}},
+	}, "127.0.0.1:4000")
+
+	assert.NoError(t, receiveLimited(m, peer, NewMessageRoutedFromString("chat", "hi")))
+	assert.NoError(t, receiveLimited(m, peer, NewMessageRoutedFromString("other", "hi")))
+	assert.NoError(t, receiveLimited(m, peer, NewMessageFromString("hi")))
+
+	err := receiveLimited(m, peer, NewMessageRoutedFromString("chat", "hi"))
+	assert.Equal(t, ErrPipeStopProcessing, err)
+
+	_, err = m.handler.OnReceive(peer, nil, NewMessageRoutedFromString("chat", "hi"))
+	if assert.IsType(t, &RateLimitError{}, err) {
+		assert.Equal(t, "chat", err.(*RateLimitError).Route)
+		assert.Equal(t, ErrorDrop, err.(*RateLimitError).ErrorAction())
+	}
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	m, peer, _ := newRateLimitTest(RateLimitConfig{
+		Peer:     Limit{Messages: 50, MessageBurst: 1, Bytes: 1000, ByteBurst: 100},
+		Action:   RateLimitDelay,
+		MaxDelay: 25 * time.Millisecond,
+	}, "127.0.0.1:4000")
+	m.handler.(*rateLimiter).now = time.Now
+
+	start := time.Now()
+	assert.NoError(t, receiveLimited(m, peer, NewMessageFromString("hi")))
+	assert.NoError(t, receiveLimited(m, peer, NewMessageFromString("hi")))
+	assert.True(t, time.Since(start) >= 15*time.Millisecond)
+
+	err := receiveLimited(m, peer, NewMessageFromData(make([]byte, 1000)))
+	assert.Equal(t, ErrPipeStopProcessing, err)
+
+	assert.Equal(t, "delay", RateLimitDelay.String())
+	assert.Equal(t, "RateLimitAction(42)", RateLimitAction(42).String())
+}
+
+func TestRateLimitBan(t *testing.T) {
+	m, peer, clock := newRateLimitTest(RateLimitConfig{
+		Peer:        Limit{Messages: 1},
+		Action:      RateLimitDisconnect,
+		BanDuration: time.Minute,
+	}, "tcp:127.0.0.1:4000")
+	limiter := m.handler.(*rateLimiter)
+
+	assert.NoError(t, receiveLimited(m, peer, NewMessageFromString("hi")))
+
+	err := receiveLimited(m, peer, NewMessageFromString("hi"))
+	if assert.IsType(t, &RateLimitError{}, errors.Cause(err)) {
+		assert.Equal(t, ErrorDisconnect, errors.Cause(err).(*RateLimitError).ErrorAction())
+	}
+
+	adapter := new(MockAdapter)
+	adapter.On("RemoteAddress").Return("tcp:127.0.0.1:4001")
+	reconnected := newPeer(adapter, newMiddlewareChain(), &peerConfig{})
+
+	err = limiter.OnConnect(reconnected, nil)
+	if assert.IsType(t, &RateLimitError{}, err) {
+		assert.True(t, err.(*RateLimitError).Banned)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	assert.NoError(t, limiter.OnConnect(reconnected, nil))
+}
+
+func TestRateLimitBanKey(t *testing.T) {
+	assert.Equal(t, "127.0.0.1", banKey("tcp:127.0.0.1:4000"))
+	assert.Equal(t, "::1", banKey("tcp:[::1]:4000"))
+	assert.Equal(t, "127.0.0.1", banKey("127.0.0.1:4000"))
+	assert.Equal(t, "::1", banKey("[::1]:4000"))
+	assert.Equal(t, "local", banKey("local"))
+}
+
+func TestRateLimitBanPrune(t *testing.T) {
+	m, _, clock := newRateLimitTest(RateLimitConfig{
+		Peer:        Limit{Messages: 1},
+		Action:      RateLimitDisconnect,
+		BanDuration: time.Minute,
+	}, "tcp:127.0.0.1:4000")
+	limiter := m.handler.(*rateLimiter)
+
+	limiter.ban("tcp:127.0.0.1:4000")
+	limiter.ban("tcp:127.0.0.2:4000")
+	assert.Len(t, limiter.bans, 2)
+
+	clock.now = clock.now.Add(time.Minute)
+	limiter.ban("tcp:127.0.0.3:4000")
+	assert.Len(t, limiter.bans, 1)
+	assert.Contains(t, limiter.bans, "127.0.0.3")
+}
@@ -0,0 +1,311 @@
+package go2p
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SpanKind describes the role of a span
+type SpanKind int
+
+const (
+	// SpanKindProducer is the kind of the spans of sent messages
+	SpanKindProducer SpanKind = iota
+	// SpanKindConsumer is the kind of the spans of received messages
+	SpanKindConsumer SpanKind = iota
+)
+
+func (k SpanKind) String() string {
+	switch k {
+	case SpanKindProducer:
+		return "producer"
+	case SpanKindConsumer:
+		return "consumer"
+	}
+
+	return fmt.Sprintf("SpanKind(%d)", k)
+}
+
+// Span is a finished span recorded by the Tracing middleware
+type Span struct {
+	Name    string
+	Kind    SpanKind
+	Context SpanContext
+	// Parent is the span id of the parent span, zero for the root span of a trace
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+}
+
+// SpanExporter exports finished spans, see NewOTLPExporter
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// DefaultTracingBatchSize is the number of spans that are exported together
+const DefaultTracingBatchSize = 512
+
+// DefaultTracingFlushInterval is the maximum time a span waits for its export
+const DefaultTracingFlushInterval = 5 * time.Second
+
+// DefaultTracingQueueSize is the number of spans that can wait for the export
+const DefaultTracingQueueSize = 4 * DefaultTracingBatchSize
+
+// TracingConfig configures the Tracing middleware
+type TracingConfig struct {
+	// Exporter receives the finished spans
+	Exporter SpanExporter
+	// BatchSize is the number of spans that are exported together,
+	// 0 uses DefaultTracingBatchSize
+	BatchSize int
+	// FlushInterval is the maximum time a span waits for its export,
+	// 0 uses DefaultTracingFlushInterval
+	FlushInterval time.Duration
+	// QueueSize is the number of spans that can wait for the export,
+	// batches that do not fit are dropped (see Tracer.Dropped).
+	// 0 uses DefaultTracingQueueSize, it is at least BatchSize
+	QueueSize int
+}
+
+// Tracer is a middleware that records a span for each sent and received message
+// and propagates the trace context to the remote peer
+type Tracer struct {
+	config TracingConfig
+	log    *logrus.Entry
+
+	mutex     *sync.Mutex
+	pending   []*Span
+	timer     *time.Timer
+	queue     [][]*Span
+	queued    int
+	exporting bool
+	dropped   uint64
+	exports   *sync.WaitGroup
+}
+
+var _ MiddlewareHandler = (*Tracer)(nil)
+
+// Tracing creates a tracing middleware that exports its spans to the exporter.
+// See TracingWith for details
+func Tracing(exporter SpanExporter) (string, *Tracer) {
+	return TracingWith(TracingConfig{Exporter: exporter})
+}
+
+// TracingWith creates a middleware that records a producer span for each sent message
+// and a consumer span for each received message.
+//
+// The context of the send span is written into the TraceparentKey header (W3C trace context),
+// the remote continues the trace with its receive span and passes the context of that span
+// to the route handlers (see TraceContext and ContinueTrace).
+// Messages that already have a trace context are sent as part of that trace,
+// all other messages start a new trace.
+// The middleware should be placed between Routes and Headers.
+//
+// Spans are exported in batches by a single background worker, call Flush to export pending spans.
+// If the exporter is slower than the traffic the spans that do not fit into the queue are dropped
+func TracingWith(config TracingConfig) (string, *Tracer) {
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultTracingBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = DefaultTracingFlushInterval
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultTracingQueueSize
+	}
+	if config.QueueSize < config.BatchSize {
+		config.QueueSize = config.BatchSize
+	}
+
+	t := new(Tracer)
+	t.config = config
+	t.log = newLogger("tracing")
+	t.mutex = new(sync.Mutex)
+	t.exports = new(sync.WaitGroup)
+
+	return "tracing", t
+}
+
+// OnConnect implements MiddlewareHandler
+func (t *Tracer) OnConnect(peer *Peer, pipe *Pipe) error {
+	return nil
+}
+
+// OnSend records the send span and injects its context into the message headers
+func (t *Tracer) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	start := time.Now()
+	if msg.Origin() == "" && msg.CreatedAt().Before(start) {
+		start = msg.CreatedAt()
+	}
+
+	parent, hasParent := TraceContext(msg)
+	ctx := SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true}
+	if hasParent {
+		ctx.TraceID = parent.TraceID
+		ctx.Sampled = parent.Sampled
+	}
+
+	setTraceContext(msg, ctx)
+	t.record(peer, msg, "send", SpanKindProducer, ctx, parent, start)
+
+	return Next, nil
+}
+
+// OnReceive records the receive span as child of the remote send span
+// and replaces the trace context of the message with the context of the receive span
+func (t *Tracer) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	start := time.Now()
+
+	parent, hasParent := TraceContext(msg)
+	ctx := SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Sampled: true}
+	if hasParent {
+		ctx.TraceID = parent.TraceID
+		ctx.Sampled = parent.Sampled
+	}
+
+	setTraceContext(msg, ctx)
+	t.record(peer, msg, "receive", SpanKindConsumer, ctx, parent, start)
+
+	return Next, nil
+}
+
+// OnDisconnect implements MiddlewareHandler
+func (t *Tracer) OnDisconnect(peer *Peer) {}
+
+// OrderIndependent implements OrderIndependentHandler
+func (t *Tracer) OrderIndependent() bool {
+	return true
+}
+
+// Dropped returns the number of spans that were dropped because the export queue was full
+func (t *Tracer) Dropped() uint64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.dropped
+}
+
+// Flush exports all pending spans and waits until queued exports are finished
+func (t *Tracer) Flush() error {
+	t.mutex.Lock()
+	batch := t.takePending()
+	t.mutex.Unlock()
+
+	t.exports.Wait()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	return t.config.Exporter.ExportSpans(batch)
+}
+
+func (t *Tracer) record(peer *Peer, msg *Message, op string, kind SpanKind, ctx SpanContext, parent SpanContext, start time.Time) {
+	if !ctx.Sampled || t.config.Exporter == nil {
+		return
+	}
+
+	span := &Span{
+		Kind:    kind,
+		Context: ctx,
+		Parent:  parent.SpanID,
+		Start:   start,
+		End:     time.Now(),
+		Attributes: map[string]string{
+			"messaging.system":     "go2p",
+			"messaging.operation":  op,
+			"messaging.message.id": msg.ID(),
+		},
+	}
+
+	span.Name = op
+	if route, found := msg.Metadata().Get(annotationKey); found {
+		routeStr, _ := route.(string)
+		span.Name = op + " " + routeStr
+		span.Attributes["messaging.destination.name"] = routeStr
+	}
+	if peer != nil {
+		span.Attributes["network.peer.address"] = peer.RemoteAddress()
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.pending = append(t.pending, span)
+	if len(t.pending) >= t.config.BatchSize {
+		t.exportAsync(t.takePending())
+	} else if t.timer == nil {
+		t.timer = time.AfterFunc(t.config.FlushInterval, t.flushPending)
+	}
+}
+
+func (t *Tracer) flushPending() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.timer = nil
+	t.exportAsync(t.takePending())
+}
+
+// takePending returns the pending spans, the caller has to hold the mutex
+func (t *Tracer) takePending() []*Span {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+
+	batch := t.pending
+	t.pending = nil
+
+	return batch
+}
+
+// exportAsync queues the batch for the export worker and starts the worker if it is not running.
+// The batch is dropped if the queue is full, the caller has to hold the mutex
+func (t *Tracer) exportAsync(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if t.queued+len(batch) > t.config.QueueSize {
+		t.dropped += uint64(len(batch))
+		t.log.WithField("dropped", t.dropped).Warnf("export queue is full, dropped %d spans", len(batch))
+		return
+	}
+
+	t.queue = append(t.queue, batch)
+	t.queued += len(batch)
+	if t.exporting {
+		return
+	}
+
+	t.exporting = true
+	t.exports.Add(1)
+	go t.exportLoop()
+}
+
+// exportLoop exports the queued batches one after another and stops when the queue is empty
+func (t *Tracer) exportLoop() {
+	defer t.exports.Done()
+
+	for {
+		t.mutex.Lock()
+		if len(t.queue) == 0 {
+			t.exporting = false
+			t.mutex.Unlock()
+			return
+		}
+
+		batch := t.queue[0]
+		t.queue = t.queue[1:]
+		t.queued -= len(batch)
+		t.mutex.Unlock()
+
+		if err := t.config.Exporter.ExportSpans(batch); err != nil {
+			t.log.WithError(err).Warn("could not export spans")
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package go2p
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingExporter struct {
+	mutex *sync.Mutex
+	spans []*Span
+	calls int
+}
+
+func newRecordingExporter() *recordingExporter {
+	return &recordingExporter{mutex: new(sync.Mutex)}
+}
+
+func (e *recordingExporter) ExportSpans(spans []*Span) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.spans = append(e.spans, spans...)
+	e.calls++
+	return nil
+}
+
+func (e *recordingExporter) exported() ([]*Span, int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return append([]*Span{}, e.spans...), e.calls
+}
+
+func TestTraceparent(t *testing.T) {
+	ctx, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", ctx.TraceID.String())
+	assert.Equal(t, "00f067aa0ba902b7", ctx.SpanID.String())
+	assert.True(t, ctx.Sampled)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ctx.Traceparent())
+
+	ctx, err = ParseTraceparent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	assert.NoError(t, err)
+	assert.False(t, ctx.Sampled)
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+	}
+	for _, value := range invalid {
+		_, err := ParseTraceparent(value)
+		assert.Error(t, err, value)
+	}
+
+	assert.Equal(t, "consumer", SpanKindConsumer.String())
+	assert.Equal(t, "SpanKind(42)", SpanKind(42).String())
+}
+
+func TestTracingPropagation(t *testing.T) {
+	exporter := newRecordingExporter()
+	_, tracer := Tracing(exporter)
+
+	msg := NewMessageRoutedFromString("sync/blocks", "hello")
+	assert.NoError(t, processMiddleware(Send, msg, NewMiddlewareHandler("tracing", tracer)))
+	sent, found := TraceContext(msg)
+	assert.True(t, found)
+
+	assert.NoError(t, processMiddleware(Receive, msg, NewMiddlewareHandler("tracing", tracer)))
+	received, found := TraceContext(msg)
+	assert.True(t, found)
+	assert.Equal(t, sent.TraceID, received.TraceID)
+	assert.NotEqual(t, sent.SpanID, received.SpanID)
+
+	reply := NewMessageRoutedFromString("sync/ack", "ok")
+	ContinueTrace(reply, msg)
+	assert.NoError(t, processMiddleware(Send, reply, NewMiddlewareHandler("tracing", tracer)))
+
+	assert.NoError(t, tracer.Flush())
+	spans, _ := exporter.exported()
+	assert.Len(t, spans, 3)
+
+	assert.Equal(t, "send sync/blocks", spans[0].Name)
+	assert.Equal(t, SpanKindProducer, spans[0].Kind)
+	assert.Equal(t, SpanID{}, spans[0].Parent)
+	assert.Equal(t, "sync/blocks", spans[0].Attributes["messaging.destination.name"])
+	assert.Equal(t, msg.ID(), spans[0].Attributes["messaging.message.id"])
+
+	assert.Equal(t, "receive sync/blocks", spans[1].Name)
+	assert.Equal(t, SpanKindConsumer, spans[1].Kind)
+	assert.Equal(t, sent.SpanID, spans[1].Parent)
+
+	assert.Equal(t, "send sync/ack", spans[2].Name)
+	assert.Equal(t, received.SpanID, spans[2].Parent)
+	assert.Equal(t, sent.TraceID, spans[2].Context.TraceID)
+}
+
+func TestTracingNotSampled(t *testing.T) {
+	exporter := newRecordingExporter()
+	_, tracer := Tracing(exporter)
+
+	msg := NewMessageFromString("hello")
+	msg.Metadata().Put(TraceparentKey, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	assert.NoError(t, processMiddleware(Send, msg, NewMiddlewareHandler("tracing", tracer)))
+
+	ctx, _ := TraceContext(msg)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", ctx.TraceID.String())
+	assert.False(t, ctx.Sampled)
+
+	assert.NoError(t, tracer.Flush())
+	spans, _ := exporter.exported()
+	assert.Empty(t, spans)
+}
+
+func TestTracingBatches(t *testing.T) {
+	exporter := newRecordingExporter()
+	_, tracer := TracingWith(TracingConfig{Exporter: exporter, BatchSize: 2, FlushInterval: 20 * time.Millisecond})
+	m := NewMiddlewareHandler("tracing", tracer)
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, processMiddleware(Send, NewMessageFromString("msg"), m))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	spans, calls := exporter.exported()
+	assert.Len(t, spans, 3)
+	assert.Equal(t, 2, calls)
+}
+
+type blockingExporter struct {
+	release chan struct{}
+	running int32
+	max     int32
+	spans   int32
+}
+
+func (e *blockingExporter) ExportSpans(spans []*Span) error {
+	running := atomic.AddInt32(&e.running, 1)
+	defer atomic.AddInt32(&e.running, -1)
+	for {
+		max := atomic.LoadInt32(&e.max)
+		if running <= max || atomic.CompareAndSwapInt32(&e.max, max, running) {
+			break
+		}
+	}
+
+	<-e.release
+	atomic.AddInt32(&e.spans, int32(len(spans)))
+	return nil
+}
+
+func TestTracingQueue(t *testing.T) {
+	exporter := &blockingExporter{release: make(chan struct{})}
+	_, tracer := TracingWith(TracingConfig{Exporter: exporter, BatchSize: 2, QueueSize: 4, FlushInterval: time.Hour})
+	m := NewMiddlewareHandler("tracing", tracer)
+
+	send := func(count int) {
+		for i := 0; i < count; i++ {
+			assert.NoError(t, processMiddleware(Send, NewMessageFromString("msg"), m))
+		}
+	}
+
+	// one batch is exported, two are queued and all others are dropped
+	send(2)
+	for atomic.LoadInt32(&exporter.running) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	send(18)
+	assert.Equal(t, uint64(14), tracer.Dropped())
+
+	close(exporter.release)
+	assert.NoError(t, tracer.Flush())
+	assert.Equal(t, int32(6), atomic.LoadInt32(&exporter.spans))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exporter.max))
+}
@@ -0,0 +1,193 @@
+package go2p
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+)
+
+// ValidateFunc checks the payload of a routed message and returns an error if it is invalid
+type ValidateFunc func(payload []byte) error
+
+// ValidationRules maps route paths to the ValidateFunc for their payloads.
+// Keys can be glob patterns (see path.Match), all matching rules have to pass
+type ValidationRules map[string]ValidateFunc
+
+// ValidationError is reported when a payload was rejected by the Validate middleware
+type ValidationError struct {
+	// Peer is the remote address of the peer
+	Peer string
+	// Route of the rejected message
+	Route string
+	// Err is the error returned by the ValidateFunc
+	Err error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid payload (peer: %s, route: %s): %v", e.Peer, e.Route, e.Err)
+}
+
+// ErrorAction implements ErrorActioner, rejected messages are dropped
+func (e *ValidationError) ErrorAction() ErrorAction {
+	return ErrorDrop
+}
+
+// JSONSchema returns a ValidateFunc that checks payloads against the given JSON Schema.
+//
+// A subset of JSON Schema is supported: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minLength, maxLength, pattern,
+// minimum, maximum, exclusiveMinimum and exclusiveMaximum.
+// Annotations like title and description are ignored, a schema with any other keyword
+// (like $ref, allOf or format) is rejected with an error
+func JSONSchema(schema []byte) (ValidateFunc, error) {
+	compiled, err := compileJSONSchema(schema)
+	if err != nil {
+		return nil, err
+	}
+
+	return compiled.validate, nil
+}
+
+// MustJSONSchema works like JSONSchema but panics if the schema is invalid
+func MustJSONSchema(schema string) ValidateFunc {
+	validate, err := JSONSchema([]byte(schema))
+	if err != nil {
+		panic(err)
+	}
+
+	return validate
+}
+
+// Validation is a middleware that validates the payloads of incoming routed messages
+type Validation struct {
+	rules ValidationRules
+	reply bool
+
+	mutex    *sync.Mutex
+	stats    ValidationStats
+	rejected map[string]uint64
+}
+
+// ValidationStats contains the counters of the Validate middleware
+type ValidationStats struct {
+	// Validated is the number of payloads that passed all rules
+	Validated uint64
+	// Rejected is the number of rejected payloads
+	Rejected uint64
+	// RejectedByRoute contains the number of rejected payloads per route
+	RejectedByRoute map[string]uint64
+}
+
+var _ MiddlewareHandler = (*Validation)(nil)
+
+// Validate creates a middleware that validates payloads by the rules.
+// See ValidateWith for details
+func Validate(rules ValidationRules) (string, *Validation) {
+	return ValidateWith(rules, false)
+}
+
+// ValidateWith creates a middleware that checks the payload of each incoming message
+// with the rules of its route, before the route handler is called.
+//
+// Invalid messages are dropped and reported with a ValidationError,
+// if reply is true an ErrorReply is sent back to the peer on the ErrorRoute.
+// Messages without a route or without a matching rule are not checked.
+// The middleware should be placed between Routes and Headers
+func ValidateWith(rules ValidationRules, reply bool) (string, *Validation) {
+	v := new(Validation)
+	v.rules = rules
+	v.reply = reply
+	v.mutex = new(sync.Mutex)
+	v.rejected = make(map[string]uint64)
+
+	return "validate", v
+}
+
+// Stats returns the current counters
+func (v *Validation) Stats() ValidationStats {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	stats := v.stats
+	stats.RejectedByRoute = make(map[string]uint64, len(v.rejected))
+	for route, count := range v.rejected {
+		stats.RejectedByRoute[route] = count
+	}
+
+	return stats
+}
+
+// OnConnect implements MiddlewareHandler
+func (v *Validation) OnConnect(peer *Peer, pipe *Pipe) error {
+	return nil
+}
+
+// OnSend implements MiddlewareHandler, outgoing messages are not validated
+func (v *Validation) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	return Next, nil
+}
+
+// OnReceive validates the payload with the rules of the message route
+func (v *Validation) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	routeHdr, found := msg.Metadata().Get(annotationKey)
+	if !found {
+		return Next, nil
+	}
+
+	route, _ := routeHdr.(string)
+	checked, err := v.validate(route, msg.PayloadGet())
+	if !checked {
+		return Next, nil
+	}
+
+	v.count(route, err)
+	if err == nil {
+		return Next, nil
+	}
+
+	validationErr := &ValidationError{Peer: peer.RemoteAddress(), Route: route, Err: err}
+	if v.reply {
+		if replyErr := sendErrorReply(pipe, "validate", route, msg, validationErr); replyErr != nil {
+			return Stop, replyErr
+		}
+	}
+
+	return Stop, validationErr
+}
+
+// OnDisconnect implements MiddlewareHandler
+func (v *Validation) OnDisconnect(peer *Peer) {}
+
+// validate runs all rules that match the route in the order of their keys.
+// It returns false if no rule matches
+func (v *Validation) validate(route string, payload []byte) (bool, error) {
+	patterns := make([]string, 0, len(v.rules))
+	for pattern := range v.rules {
+		if matched, _ := path.Match(pattern, route); matched || pattern == route {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		if err := v.rules[pattern](payload); err != nil {
+			return true, err
+		}
+	}
+
+	return len(patterns) > 0, nil
+}
+
+func (v *Validation) count(route string, err error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if err == nil {
+		v.stats.Validated++
+		return
+	}
+
+	v.stats.Rejected++
+	v.rejected[route]++
+}
@@ -0,0 +1,63 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	adapter := new(MockAdapter)
+	adapter.On("RemoteAddress").Return("127.0.0.1:4000")
+	peer := newPeer(adapter, newMiddlewareChain(), &peerConfig{})
+	peer.io.send = make(chan *Message, 1)
+
+	errOdd := errors.New("odd length")
+	name, validation := ValidateWith(ValidationRules{
+		"config/set": MustJSONSchema(`{"type": "object", "required": ["key"]}`),
+		"config/*": func(payload []byte) error {
+			if len(payload)%2 == 1 {
+				return errOdd
+			}
+			return nil
+		},
+	}, true)
+	m := NewMiddlewareHandler(name, validation)
+
+	receive := func(msg *Message) (MiddlewareResult, error) {
+		return m.handler.OnReceive(peer, newPipe(peer, newMiddlewares(m), Receive, 0, 0, 1), msg)
+	}
+
+	res, err := receive(NewMessageRoutedFromString("config/set", `{"key": 1}`))
+	assert.NoError(t, err)
+	assert.Equal(t, Next, res)
+
+	res, err = receive(NewMessageRoutedFromString("config/set", `{"key":1}`))
+	assert.Equal(t, Stop, res)
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, errOdd, err.(*ValidationError).Err)
+	}
+	<-peer.io.send
+
+	rejected := NewMessageRoutedFromString("config/set", `{"other": 1}`)
+	_, err = receive(rejected)
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Equal(t, "config/set", err.(*ValidationError).Route)
+	}
+
+	reply, err := ParseErrorReply(<-peer.io.send)
+	assert.NoError(t, err)
+	assert.Equal(t, "validate", reply.Kind)
+	assert.Equal(t, rejected.ID(), reply.MessageID)
+
+	res, err = receive(NewMessageRoutedFromString("chat", `not json`))
+	assert.NoError(t, err)
+	assert.Equal(t, Next, res)
+
+	res, err = receive(NewMessageFromString(`not json`))
+	assert.NoError(t, err)
+	assert.Equal(t, Next, res)
+
+	assert.Equal(t, ValidationStats{Validated: 1, Rejected: 2, RejectedByRoute: map[string]uint64{"config/set": 2}}, validation.Stats())
+}
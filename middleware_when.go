@@ -0,0 +1,113 @@
+package go2p
+
+import (
+	"path"
+)
+
+// MiddlewarePredicate decides if a conditional middleware handles the message.
+// It is called for each message in both directions, the peer is the sender or receiver
+type MiddlewarePredicate func(peer *Peer, op PipeOperation, msg *Message) bool
+
+// ForRoutes returns a predicate that matches routed messages with one of the routes.
+// Patterns can be globs (see path.Match).
+// The route of an incoming message is only known after the Headers middleware
+// restored the metadata, so on the receive side this only matches
+// for middlewares that are placed between Routes and Headers
+func ForRoutes(patterns ...string) MiddlewarePredicate {
+	return func(peer *Peer, op PipeOperation, msg *Message) bool {
+		routeHdr, found := msg.Metadata().Get(annotationKey)
+		if !found {
+			return false
+		}
+
+		route, _ := routeHdr.(string)
+		return matchesAny(patterns, route)
+	}
+}
+
+// ForPeers returns a predicate that matches messages from and to peers
+// with one of the remote addresses or principals (see Auth).
+// Patterns can be globs (see path.Match), like "10.0.0.*"
+func ForPeers(patterns ...string) MiddlewarePredicate {
+	return func(peer *Peer, op PipeOperation, msg *Message) bool {
+		if peer == nil {
+			return false
+		}
+
+		if matchesAny(patterns, peer.RemoteAddress()) {
+			return true
+		}
+
+		principal := peer.Principal()
+		return principal != "" && matchesAny(patterns, principal)
+	}
+}
+
+// ForOperation returns a predicate that matches messages of one direction
+func ForOperation(op PipeOperation) MiddlewarePredicate {
+	return func(peer *Peer, current PipeOperation, msg *Message) bool {
+		return current == op
+	}
+}
+
+// When creates a middleware that calls impl only for messages that match the predicate,
+// all other messages are passed to the next middleware.
+// OnConnect and OnDisconnect of impl are always called.
+//
+// Middlewares that change the payload format (like Compress or Crypt) need a predicate
+// that selects the same messages on both sides of a connection,
+// otherwise the remote can not read the messages
+func When(predicate MiddlewarePredicate, name string, impl MiddlewareHandler) (string, MiddlewareHandler) {
+	return name, &conditionalHandler{handler: impl, predicate: predicate}
+}
+
+// NewMiddlewareWhen wraps the provided handler into a conditional Middleware instance.
+// See When for details
+func NewMiddlewareWhen(predicate MiddlewarePredicate, name string, impl MiddlewareHandler) *Middleware {
+	return NewMiddlewareHandler(When(predicate, name, impl))
+}
+
+type conditionalHandler struct {
+	handler   MiddlewareHandler
+	predicate MiddlewarePredicate
+}
+
+func (c *conditionalHandler) OnConnect(peer *Peer, pipe *Pipe) error {
+	return c.handler.OnConnect(peer, pipe)
+}
+
+func (c *conditionalHandler) OnSend(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if !c.predicate(peer, Send, msg) {
+		return Next, nil
+	}
+
+	return c.handler.OnSend(peer, pipe, msg)
+}
+
+func (c *conditionalHandler) OnReceive(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	if !c.predicate(peer, Receive, msg) {
+		return Next, nil
+	}
+
+	return c.handler.OnReceive(peer, pipe, msg)
+}
+
+func (c *conditionalHandler) OnDisconnect(peer *Peer) {
+	c.handler.OnDisconnect(peer)
+}
+
+// OrderIndependent implements OrderIndependentHandler for a wrapped order independent handler
+func (c *conditionalHandler) OrderIndependent() bool {
+	independent, ok := c.handler.(OrderIndependentHandler)
+	return ok && independent.OrderIndependent()
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched || pattern == value {
+			return true
+		}
+	}
+
+	return false
+}
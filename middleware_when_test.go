@@ -0,0 +1,53 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareWhenRoutes(t *testing.T) {
+	recorder := newRecordingMiddleware()
+	m := NewMiddlewareWhen(ForRoutes("sync/*"), "record", MiddlewareFunc(recorder.record))
+
+	assert.NoError(t, processMiddleware(Send, NewMessageRoutedFromString("sync/blocks", "a"), m))
+	assert.NoError(t, processMiddleware(Receive, NewMessageRoutedFromString("sync/headers", "b"), m))
+	assert.NoError(t, processMiddleware(Send, NewMessageRoutedFromString("chat", "c"), m))
+	assert.NoError(t, processMiddleware(Send, NewMessageFromString("d"), m))
+
+	assert.Equal(t, []string{"a", "b"}, recorder.payloads())
+}
+
+func TestMiddlewareWhenPeers(t *testing.T) {
+	adapter := new(MockAdapter)
+	adapter.On("RemoteAddress").Return("10.0.0.5:4000")
+	p := newPeer(adapter, newMiddlewareChain(), &peerConfig{})
+	msg := NewMessage()
+
+	assert.True(t, ForPeers("10.0.0.*")(p, Send, msg))
+	assert.False(t, ForPeers("10.0.1.*")(p, Send, msg))
+	assert.False(t, ForPeers("alice")(p, Send, msg))
+	assert.False(t, ForPeers("10.0.0.*")(nil, Send, msg))
+
+	p.setPrincipal("alice")
+	assert.True(t, ForPeers("alice")(p, Receive, msg))
+}
+
+func TestMiddlewareWhenOperation(t *testing.T) {
+	recorder := newRecordingMiddleware()
+	m := NewMiddlewareWhen(ForOperation(Receive), "record", MiddlewareFunc(recorder.record))
+
+	assert.NoError(t, processMiddleware(Send, NewMessageFromString("out"), m))
+	assert.NoError(t, processMiddleware(Receive, NewMessageFromString("in"), m))
+
+	assert.Equal(t, []string{"in"}, recorder.payloads())
+}
+
+func TestMiddlewareWhenOrderIndependent(t *testing.T) {
+	name, handler := OrderIndependent("slow", MiddlewareFunc(slowMiddleware))
+	independent := NewMiddlewareWhen(ForOperation(Send), name, handler)
+	assert.True(t, independent.orderIndependent)
+
+	dependent := NewMiddlewareWhen(ForOperation(Send), "slow", MiddlewareFunc(slowMiddleware))
+	assert.False(t, dependent.orderIndependent)
+}
@@ -9,8 +9,13 @@ type MockAdapter struct {
 	mock.Mock
 }
 
-// Address provides a mock function with given fields:
-func (_m *MockAdapter) Address() string {
+// Close provides a mock function with given fields:
+func (_m *MockAdapter) Close() {
+	_m.Called()
+}
+
+// LocalAddress provides a mock function with given fields:
+func (_m *MockAdapter) LocalAddress() string {
 	ret := _m.Called()
 
 	var r0 string
@@ -23,11 +28,6 @@ func (_m *MockAdapter) Address() string {
 	return r0
 }
 
-// Close provides a mock function with given fields:
-func (_m *MockAdapter) Close() {
-	_m.Called()
-}
-
 // ReadMessage provides a mock function with given fields:
 func (_m *MockAdapter) ReadMessage() (*Message, error) {
 	ret := _m.Called()
@@ -51,6 +51,20 @@ func (_m *MockAdapter) ReadMessage() (*Message, error) {
 	return r0, r1
 }
 
+// RemoteAddress provides a mock function with given fields:
+func (_m *MockAdapter) RemoteAddress() string {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
 // WriteMessage provides a mock function with given fields: m
 func (_m *MockAdapter) WriteMessage(m *Message) error {
 	ret := _m.Called(m)
@@ -8,18 +8,30 @@ import (
 NewNetworkConnectionTCP provides a full configured TCP based network
 It use the _DefaultMiddleware_ a TCP based operator and the following middleware:
 
-Routes, Headers, Crypt, Log
-
+Routes, Headers, Compress, Noise, Log
 
+The Noise channel uses a random static key and accepts any remote key.
+It encrypts the traffic but does not authenticate the peers,
+an active man in the middle is not detected.
+Use NewNetworkConnectionTCPWith to restrict the network to known keys
 */
 func NewNetworkConnectionTCP(localAddr string, routes RoutingTable) *NetworkConnection {
+	return NewNetworkConnectionTCPWith(localAddr, routes, NoiseConfig{})
+}
+
+// NewNetworkConnectionTCPWith provides the same network as NewNetworkConnectionTCP
+// with the given configuration of the Noise channel.
+// Set NoiseConfig.StaticKey and NoiseConfig.PeerKey or NoiseConfig.Authorize
+// to authenticate the peers
+func NewNetworkConnectionTCPWith(localAddr string, routes RoutingTable, noise NoiseConfig) *NetworkConnection {
 	op := NewTCPOperator("tcp", localAddr)
 
 	conn := NewNetworkConnection().
 		WithOperator(op).
 		WithMiddleware(Routes(routes)).
 		WithMiddleware(Headers()).
-		WithMiddleware(Crypt()).
+		WithHandler(Compress()).
+		WithHandler(NoiseWith(noise)).
 		WithMiddleware(Log()).
 		Build()
 
@@ -28,27 +40,38 @@ func NewNetworkConnectionTCP(localAddr string, routes RoutingTable) *NetworkConn
 
 // NetworkConnection is the main entry point to the p2p network
 type NetworkConnection struct {
-	middlewares middlewares
+	middlewares *middlewareChain
 	operators   []PeerOperator
 	emitter     *eventEmitter
 	log         *logrus.Entry
 	peers       *peers
+	peerConfig  *peerConfig
+}
+
+// Identity returns the identity of this NetworkConnection.
+// It is used as Message.Origin() for all messages sent by this connection
+func (nc *NetworkConnection) Identity() string {
+	return nc.peerConfig.identity
 }
 
 // Send will send the provided message to the given address
 func (nc *NetworkConnection) Send(msg *Message, addr string) {
-	nc.peers.lock(addr, func(peer *Peer) {
-		nc.log.WithFields(logrus.Fields{
-			"local":  peer.LocalAddress(),
-			"remote": peer.RemoteAddress(),
-			"len":    len(msg.PayloadGet()),
-		}).Debug("send messag")
+	peer := nc.peers.find(addr)
+	if peer == nil {
+		return
+	}
 
-		peer.send <- msg
-	})
+	nc.log.WithFields(logrus.Fields{
+		"local":  peer.LocalAddress(),
+		"remote": peer.RemoteAddress(),
+		"len":    len(msg.PayloadGet()),
+	}).Debug("send messag")
+
+	peer.enqueue(msg)
 }
 
-// SendBroadcast will send the given message to all peers
+// SendBroadcast will send the given message to all peers.
+// Each peer gets its own copy of the message (see Message.Clone)
 func (nc *NetworkConnection) SendBroadcast(msg *Message) {
 	nc.peers.iteratePeer(func(peer *Peer) {
 		nc.log.WithFields(logrus.Fields{
@@ -57,7 +80,7 @@ func (nc *NetworkConnection) SendBroadcast(msg *Message) {
 			"len":    len(msg.PayloadGet()),
 		}).Debug("send messag")
 
-		peer.send <- msg
+		peer.enqueue(msg.Clone())
 	})
 }
 
@@ -75,17 +98,69 @@ func (nc *NetworkConnection) ConnectTo(network string, addr string) {
 
 // DisconnectFrom will disconnects the given peer
 func (nc *NetworkConnection) DisconnectFrom(addr string) {
-	nc.peers.lock(addr, func(peer *Peer) {
-		nc.log.WithFields(logrus.Fields{
-			"local":  peer.LocalAddress(),
-			"remote": peer.RemoteAddress(),
-		}).Debug("disconnect")
+	peer := nc.peers.find(addr)
+	if peer == nil {
+		return
+	}
+
+	nc.log.WithFields(logrus.Fields{
+		"local":  peer.LocalAddress(),
+		"remote": peer.RemoteAddress(),
+	}).Debug("disconnect")
+
+	peer.stop()
+	nc.peers.rm(peer)
+}
 
-		peer.stop()
-		go func(n *NetworkConnection, p *Peer) {
-			n.peers.rm(p)
-		}(nc, peer)
+// Use inserts the given middleware while the network is running.
+// Without a position the middleware is added at the end, closest to the network.
+// Use Before(name) or After(name) to place it relative to an existing middleware:
+//
+//	conn.Use(go2p.NewMiddleware(go2p.Log()), go2p.Before("noise"))
+//
+// The change applies to new and existing peers with their next message,
+// messages that are already in process finish with the previous middlewares.
+// MiddlewareHandler.OnConnect of the new middleware is called for the existing peers
+// before Use returns, a peer is disconnected if it fails.
+// Until its OnConnect has finished for a peer, the messages of that peer skip the new middleware.
+// The message loops of these peers are already running,
+// so OnConnect must not exchange messages with pipe.Receive.
+// Middlewares that change the payload format or need a handshake (like Noise, Auth or Compress)
+// have to be added before the network is started
+func (nc *NetworkConnection) Use(m *Middleware, pos ...MiddlewarePosition) error {
+	var position MiddlewarePosition
+	if len(pos) > 0 {
+		position = pos[0]
+	}
+
+	err := nc.middlewares.insert(m, position)
+	if err != nil {
+		return err
+	}
+
+	nc.peers.iteratePeer(func(p *Peer) {
+		p.connectMiddleware(m.name)
+	})
+
+	nc.log.WithField("name", m.name).Debug("use middleware")
+	return nil
+}
+
+// Remove removes the middleware with the given name while the network is running.
+// MiddlewareHandler.OnDisconnect of the middleware is called for the existing peers
+// before Remove returns. See Use for details about how the change is applied
+func (nc *NetworkConnection) Remove(name string) error {
+	m, err := nc.middlewares.remove(name)
+	if err != nil {
+		return err
+	}
+
+	nc.peers.iteratePeer(func(p *Peer) {
+		p.disconnectMiddleware(m)
 	})
+
+	nc.log.WithField("name", name).Debug("remove middleware")
+	return nil
 }
 
 // Start will start up the p2p network stack
@@ -102,8 +177,8 @@ func (nc *NetworkConnection) Start() error {
 
 	for _, op := range nc.operators {
 		op.OnPeer(func(a Adapter) {
-			p := newPeer(a, nc.middlewares)
-			nc.peers.add(p)
+			p := newPeer(a, nc.middlewares, nc.peerConfig)
+			p.network = nc
 
 			p.emitter.On("message", func(args []interface{}) {
 				nc.emitter.EmitAsync("peer-message", args...)
@@ -114,6 +189,9 @@ func (nc *NetworkConnection) Start() error {
 				nc.peers.rm(p)
 				nc.emitter.EmitAsync("peer-disconnect", p)
 			})
+			p.emitter.On("middleware-error", func(args []interface{}) {
+				nc.emitter.EmitAsync("peer-error", args...)
+			})
 			p.emitter.On("error", func(args []interface{}) {
 				p := args[0].(*Peer)
 				err := args[1].(error)
@@ -122,7 +200,17 @@ func (nc *NetworkConnection) Start() error {
 				nc.emitter.EmitAsync("peer-error", p, err)
 			})
 
-			<-p.start()
+			// the peer becomes visible after its goroutines are registered,
+			// a peer that was stopped in between is removed again
+			done := p.start()
+			nc.peers.add(p)
+			if p.stopped() {
+				nc.peers.rm(p)
+			}
+
+			if err := <-done; err != nil {
+				return
+			}
 
 			nc.emitter.EmitAsync("peer-connect", p)
 		})
@@ -151,7 +239,9 @@ func (nc *NetworkConnection) OnMessage(handler func(p *Peer, msg *Message)) {
 }
 
 // OnPeerError regsiters the given handler and call it when an error
-// during the peer communication occurs
+// during the peer communication occurs.
+// Errors of middlewares are reported as *MiddlewareError,
+// the ErrorPolicy decides if the peer is disconnected afterwards
 func (nc *NetworkConnection) OnPeerError(handler func(p *Peer, err error)) {
 	nc.emitter.On("peer-error", func(args []interface{}) {
 		handler(args[0].(*Peer), args[1].(error))
@@ -1,10 +1,22 @@
 package go2p
 
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/v-braun/go-must"
+)
+
 // NetworkConnectionBuilder provides a fluent interface to
 // create a NetworkConnection
 type NetworkConnectionBuilder struct {
 	middlewares []*Middleware
 	operators   []PeerOperator
+	identity    string
+	batching    *writeBatching
+	errorPolicy ErrorPolicy
+	metrics     Metrics
+	concurrency int
 }
 
 // NewNetworkConnection creates a new NetworkBuilder instance to setup a new NetworkConnection
@@ -21,20 +33,94 @@ func (b *NetworkConnectionBuilder) WithMiddleware(name string, impl MiddlewareFu
 	return b
 }
 
+// WithHandler attach a new MiddlewareHandler to the NetworkConnection setup.
+// Use it for middlewares that take part in the peer lifecycle (OnConnect, OnDisconnect)
+func (b *NetworkConnectionBuilder) WithHandler(name string, impl MiddlewareHandler) *NetworkConnectionBuilder {
+	m := NewMiddlewareHandler(name, impl)
+	b.middlewares = append(b.middlewares, m)
+	return b
+}
+
+// WithMiddlewareWhen attach a new Middleware that only handles the messages
+// that match the predicate (see When)
+func (b *NetworkConnectionBuilder) WithMiddlewareWhen(predicate MiddlewarePredicate, name string, impl MiddlewareHandler) *NetworkConnectionBuilder {
+	b.middlewares = append(b.middlewares, NewMiddlewareWhen(predicate, name, impl))
+	return b
+}
+
 // WithOperator attach a new PeerOperator to the NetworkConnection setup
 func (b *NetworkConnectionBuilder) WithOperator(op PeerOperator) *NetworkConnectionBuilder {
 	b.operators = append(b.operators, op)
 	return b
 }
 
+// WithIdentity sets the identity of the NetworkConnection.
+// The identity is transmitted as the origin of all messages sent by this connection.
+// If no identity is provided a random one will be generated.
+// The identity must not be longer than MaxIdentityLength bytes
+func (b *NetworkConnectionBuilder) WithIdentity(identity string) *NetworkConnectionBuilder {
+	must.ArgBeValid(len(identity) <= MaxIdentityLength, "identity exceeds %d bytes", MaxIdentityLength)
+	b.identity = identity
+	return b
+}
+
+// WithWriteBatching enables the coalescing of outgoing messages.
+// Messages that are queued for a peer are written with a single flush
+// until maxBytes of payload are collected.
+// Under load the write loop waits up to maxDelay for more messages before it flushes,
+// a maxDelay of 0 coalesces only messages that are already queued
+func (b *NetworkConnectionBuilder) WithWriteBatching(maxBytes int, maxDelay time.Duration) *NetworkConnectionBuilder {
+	b.batching = &writeBatching{
+		maxBytes: maxBytes,
+		maxDelay: maxDelay,
+	}
+	return b
+}
+
+// WithErrorPolicy sets the policy that decides if an error returned by a middleware
+// disconnects the peer, drops the message or is only reported.
+// Without a policy the DefaultErrorPolicy is used
+func (b *NetworkConnectionBuilder) WithErrorPolicy(policy ErrorPolicy) *NetworkConnectionBuilder {
+	b.errorPolicy = policy
+	return b
+}
+
+// WithMetrics sets the Metrics implementation that receives the latency
+// and the outcome of each middleware execution.
+// Use NewMiddlewareStats for a built-in in memory implementation
+func (b *NetworkConnectionBuilder) WithMetrics(metrics Metrics) *NetworkConnectionBuilder {
+	b.metrics = metrics
+	return b
+}
+
+// WithPipelineConcurrency sets the number of messages that are processed at once
+// per peer and direction by middlewares that are marked as order independent
+// (see OrderIndependent). Order dependent middlewares and the delivery of the messages
+// still see the messages in the order they were sent or received.
+// 0 or 1 processes the messages one after another
+func (b *NetworkConnectionBuilder) WithPipelineConcurrency(workers int) *NetworkConnectionBuilder {
+	b.concurrency = workers
+	return b
+}
+
 // Build finalize the NetworkConnection setup and creates the new instance
 func (b *NetworkConnectionBuilder) Build() *NetworkConnection {
 	nc := new(NetworkConnection)
 	nc.peers = newPeers()
-	nc.middlewares = newMiddlewares(b.middlewares...)
+	nc.middlewares = newMiddlewareChain(b.middlewares...)
 	nc.operators = b.operators
 	nc.emitter = newEventEmitter()
 	nc.log = newLogger("network-connection")
+	nc.peerConfig = &peerConfig{
+		identity:    b.identity,
+		batching:    b.batching,
+		errorPolicy: b.errorPolicy,
+		metrics:     b.metrics,
+		concurrency: b.concurrency,
+	}
+	if nc.peerConfig.identity == "" {
+		nc.peerConfig.identity = uuid.New().String()
+	}
 
 	return nc
 }
@@ -1,8 +1,15 @@
 package go2p_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -300,3 +307,975 @@ func genLargeMessage(chars int) string {
 	}
 	return string(b)
 }
+
+func TestUseMiddleware(t *testing.T) {
+	p1, _ := freeport.GetFreePort()
+	p2, _ := freeport.GetFreePort()
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	conn1 := go2p.NewNetworkConnection().WithOperator(go2p.NewTCPOperator("tcp", fmt.Sprintf("127.0.0.1:%d", p1))).Build()
+	conn2 := go2p.NewNetworkConnection().WithOperator(go2p.NewTCPOperator("tcp", addr2)).Build()
+
+	peerConnectedWg := sync.WaitGroup{}
+	peerConnectedWg.Add(2)
+	var conn2Peer *go2p.Peer
+	conn1.OnPeer(func(peer *go2p.Peer) {
+		conn2Peer = peer
+		peerConnectedWg.Done()
+	})
+	conn2.OnPeer(func(peer *go2p.Peer) {
+		peerConnectedWg.Done()
+	})
+
+	registerPeerErrorHandlers(t, conn1, conn2)
+	if !startNetworks(t, conn1, conn2) {
+		return
+	}
+
+	conn1.ConnectTo("tcp", addr2)
+	peerConnectedWg.Wait()
+
+	counted := 0
+	err := conn2.Use(go2p.NewMiddleware("count", func(peer *go2p.Peer, pipe *go2p.Pipe, msg *go2p.Message) (go2p.MiddlewareResult, error) {
+		counted++
+		return go2p.Next, nil
+	}))
+	assert.NoError(t, err)
+
+	received := make(chan string)
+	conn2.OnMessage(func(p *go2p.Peer, m *go2p.Message) {
+		received <- m.PayloadGetString()
+	})
+
+	conn1.Send(go2p.NewMessageFromString("counted"), conn2Peer.RemoteAddress())
+	assert.Equal(t, "counted", <-received)
+	assert.Equal(t, 1, counted)
+
+	assert.NoError(t, conn2.Remove("count"))
+	conn1.Send(go2p.NewMessageFromString("not counted"), conn2Peer.RemoteAddress())
+	assert.Equal(t, "not counted", <-received)
+	assert.Equal(t, 1, counted)
+
+	conn1.Stop()
+	conn2.Stop()
+}
+
+type lifecycleRecorder struct {
+	events      chan string
+	failConnect bool
+}
+
+func (r *lifecycleRecorder) OnConnect(peer *go2p.Peer, pipe *go2p.Pipe) error {
+	r.events <- "connect"
+	if r.failConnect {
+		return errors.New("rejected")
+	}
+
+	return nil
+}
+
+func (r *lifecycleRecorder) OnSend(peer *go2p.Peer, pipe *go2p.Pipe, msg *go2p.Message) (go2p.MiddlewareResult, error) {
+	return go2p.Next, nil
+}
+
+func (r *lifecycleRecorder) OnReceive(peer *go2p.Peer, pipe *go2p.Pipe, msg *go2p.Message) (go2p.MiddlewareResult, error) {
+	return go2p.Next, nil
+}
+
+func (r *lifecycleRecorder) OnDisconnect(peer *go2p.Peer) {
+	r.events <- "disconnect"
+}
+
+func createLifecycleNetworks(t *testing.T, recorder *lifecycleRecorder) (*networkConnWithAddress, *networkConnWithAddress) {
+	p1, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	p2, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	addr1 := fmt.Sprintf("127.0.0.1:%d", p1)
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	conn1 := go2p.NewNetworkConnection().
+		WithOperator(go2p.NewTCPOperator("tcp", addr1)).
+		WithHandler("recorder", recorder).
+		Build()
+	conn2 := go2p.NewNetworkConnection().
+		WithOperator(go2p.NewTCPOperator("tcp", addr2)).
+		Build()
+
+	return &networkConnWithAddress{net: conn1, addr: addr1, fullAddr: "tcp:" + addr1}, &networkConnWithAddress{net: conn2, addr: addr2, fullAddr: "tcp:" + addr2}
+}
+
+func TestLifecycleMiddleware(t *testing.T) {
+	recorder := &lifecycleRecorder{events: make(chan string, 10)}
+	conn1, conn2 := createLifecycleNetworks(t, recorder)
+
+	conn1.net.OnPeer(func(peer *go2p.Peer) {
+		recorder.events <- "peer"
+		conn1.net.DisconnectFrom(peer.RemoteAddress())
+	})
+
+	if !startNetworks(t, conn1.net, conn2.net) {
+		return
+	}
+
+	conn1.net.ConnectTo("tcp", conn2.addr)
+
+	assert.Equal(t, "connect", <-recorder.events)
+	assert.Equal(t, "peer", <-recorder.events)
+	assert.Equal(t, "disconnect", <-recorder.events)
+
+	conn1.net.Stop()
+	conn2.net.Stop()
+}
+
+func TestLifecycleMiddlewareConnectError(t *testing.T) {
+	recorder := &lifecycleRecorder{events: make(chan string, 10), failConnect: true}
+	conn1, conn2 := createLifecycleNetworks(t, recorder)
+
+	conn1.net.OnPeer(func(peer *go2p.Peer) {
+		recorder.events <- "peer"
+	})
+	conn1.net.OnPeerError(func(peer *go2p.Peer, err error) {
+		recorder.events <- "error"
+	})
+
+	if !startNetworks(t, conn1.net, conn2.net) {
+		return
+	}
+
+	conn1.net.ConnectTo("tcp", conn2.addr)
+
+	assert.Equal(t, "connect", <-recorder.events)
+	events := []string{<-recorder.events, <-recorder.events}
+	assert.ElementsMatch(t, []string{"disconnect", "error"}, events)
+
+	conn1.net.Stop()
+	conn2.net.Stop()
+}
+
+func TestLifecycleMiddlewareRuntime(t *testing.T) {
+	conn1, conn2 := createLifecycleNetworks(t, &lifecycleRecorder{events: make(chan string, 10)})
+
+	connected := make(chan *go2p.Peer, 1)
+	conn2.net.OnPeer(func(peer *go2p.Peer) {
+		connected <- peer
+	})
+
+	registerPeerErrorHandlers(t, conn1.net, conn2.net)
+	if !startNetworks(t, conn1.net, conn2.net) {
+		return
+	}
+
+	conn1.net.ConnectTo("tcp", conn2.addr)
+	<-connected
+
+	recorder := &lifecycleRecorder{events: make(chan string, 10)}
+	runtime := func() *go2p.Middleware {
+		return go2p.NewMiddlewareHandler("runtime", recorder)
+	}
+
+	// the hooks run for the existing peer
+	assert.NoError(t, conn2.net.Use(runtime()))
+	assert.Equal(t, "connect", <-recorder.events)
+	assert.NoError(t, conn2.net.Remove("runtime"))
+	assert.Equal(t, "disconnect", <-recorder.events)
+
+	assert.NoError(t, conn2.net.Use(runtime()))
+	assert.Equal(t, "connect", <-recorder.events)
+
+	conn1.net.Stop()
+	conn2.net.Stop()
+	assert.Equal(t, "disconnect", <-recorder.events)
+	assert.Len(t, recorder.events, 0)
+}
+
+func TestMiddlewareMetrics(t *testing.T) {
+	p1, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+	p2, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	stats := go2p.NewMiddlewareStats()
+	create := func(addr string) *go2p.NetworkConnection {
+		return go2p.NewNetworkConnection().
+			WithOperator(go2p.NewTCPOperator("tcp", addr)).
+			WithMiddleware(go2p.Headers()).
+			WithHandler(go2p.CryptHandler()).
+			WithMiddleware(go2p.Log()).
+			WithMetrics(stats).
+			Build()
+	}
+
+	conn1 := create(fmt.Sprintf("127.0.0.1:%d", p1))
+	conn2 := create(addr2)
+
+	received := make(chan string, 1)
+	conn2.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+		received <- msg.PayloadGetString()
+	})
+	conn1.OnPeer(func(peer *go2p.Peer) {
+		conn1.Send(go2p.NewMessageFromString("hello"), peer.RemoteAddress())
+	})
+
+	registerPeerErrorHandlers(t, conn1, conn2)
+	if !startNetworks(t, conn1, conn2) {
+		return
+	}
+
+	conn1.ConnectTo("tcp", addr2)
+	assert.Equal(t, "hello", <-received)
+
+	crypt, found := stats.Get("Crypt", go2p.Send)
+	assert.True(t, found)
+	assert.Equal(t, crypt.Count, crypt.Outcomes[go2p.OutcomeNext])
+
+	crypt, found = stats.Get("Crypt", go2p.Receive)
+	assert.True(t, found)
+	assert.Equal(t, crypt.Count, crypt.Outcomes[go2p.OutcomeNext])
+
+	crypt, found = stats.Get("Crypt", go2p.Connect)
+	assert.True(t, found)
+	assert.Equal(t, uint64(2), crypt.Count)
+
+	for _, stat := range stats.Snapshot() {
+		t.Logf("%s %s: count %d mean %s p99 <= %s", stat.Name, stat.Op, stat.Count, stat.Mean(), stat.Quantile(0.99))
+	}
+
+	conn1.Stop()
+	conn2.Stop()
+}
+
+func TestCryptFunc(t *testing.T) {
+	tests := map[string]func(b *go2p.NetworkConnectionBuilder) *go2p.NetworkConnectionBuilder{
+		"func": func(b *go2p.NetworkConnectionBuilder) *go2p.NetworkConnectionBuilder {
+			return b.WithMiddleware(go2p.Crypt())
+		},
+		"handler": func(b *go2p.NetworkConnectionBuilder) *go2p.NetworkConnectionBuilder {
+			return b.WithHandler(go2p.CryptHandler())
+		},
+	}
+
+	for name, withCrypt := range tests {
+		t.Run(name, func(t *testing.T) {
+			p1, err := freeport.GetFreePort()
+			assert.NoError(t, err)
+			p2, err := freeport.GetFreePort()
+			assert.NoError(t, err)
+
+			addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+			// the first connection exchanges the keys with its first message
+			conn1 := go2p.NewNetworkConnection().
+				WithOperator(go2p.NewTCPOperator("tcp", fmt.Sprintf("127.0.0.1:%d", p1))).
+				WithMiddleware(go2p.Headers()).
+				WithMiddleware(go2p.Crypt()).
+				Build()
+			conn2 := withCrypt(go2p.NewNetworkConnection().
+				WithOperator(go2p.NewTCPOperator("tcp", addr2)).
+				WithMiddleware(go2p.Headers())).
+				Build()
+
+			received := make(chan string, 2)
+			conn1.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+				received <- msg.PayloadGetString()
+			})
+			conn2.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+				received <- msg.PayloadGetString()
+				conn2.Send(go2p.NewMessageFromString("world"), peer.RemoteAddress())
+			})
+			conn1.OnPeer(func(peer *go2p.Peer) {
+				conn1.Send(go2p.NewMessageFromString("hello"), peer.RemoteAddress())
+			})
+
+			registerPeerErrorHandlers(t, conn1, conn2)
+			if !startNetworks(t, conn1, conn2) {
+				return
+			}
+
+			conn1.ConnectTo("tcp", addr2)
+			assert.Equal(t, "hello", <-received)
+			assert.Equal(t, "world", <-received)
+
+			conn1.Stop()
+			conn2.Stop()
+		})
+	}
+}
+
+func createAuthNetworks(t *testing.T, scheme1 go2p.AuthScheme, scheme2 go2p.AuthScheme) (*networkConnWithAddress, *networkConnWithAddress) {
+	p1, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	p2, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	addr1 := fmt.Sprintf("127.0.0.1:%d", p1)
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	create := func(addr string, scheme go2p.AuthScheme) *go2p.NetworkConnection {
+		return go2p.NewNetworkConnection().
+			WithOperator(go2p.NewTCPOperator("tcp", addr)).
+			WithMiddleware(go2p.Headers()).
+			WithHandler(go2p.AuthWith(scheme, time.Second)).
+			WithHandler(go2p.Noise()).
+			Build()
+	}
+
+	conn1 := create(addr1, scheme1)
+	conn2 := create(addr2, scheme2)
+
+	return &networkConnWithAddress{net: conn1, addr: addr1, fullAddr: "tcp:" + addr1}, &networkConnWithAddress{net: conn2, addr: addr2, fullAddr: "tcp:" + addr2}
+}
+
+func TestAuth(t *testing.T) {
+	conn1, conn2 := createAuthNetworks(t, go2p.AuthHMAC("node1", []byte("secret")), go2p.AuthHMAC("node2", []byte("secret")))
+
+	principals := make(chan string, 2)
+	bindings := make(chan []byte, 2)
+	received := make(chan string, 1)
+	conn1.net.OnPeer(func(peer *go2p.Peer) {
+		principals <- peer.Principal()
+		bindings <- peer.ChannelBinding()
+		conn1.net.Send(go2p.NewMessageFromString("hello"), peer.RemoteAddress())
+	})
+	conn2.net.OnPeer(func(peer *go2p.Peer) {
+		principals <- peer.Principal()
+		bindings <- peer.ChannelBinding()
+	})
+	conn2.net.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+		received <- msg.PayloadGetString()
+	})
+
+	registerPeerErrorHandlers(t, conn1.net, conn2.net)
+	if !startNetworks(t, conn1.net, conn2.net) {
+		return
+	}
+
+	conn1.net.ConnectTo("tcp", conn2.addr)
+
+	assert.ElementsMatch(t, []string{"node1", "node2"}, []string{<-principals, <-principals})
+	assert.Equal(t, "hello", <-received)
+
+	// the proofs are bound to the same Noise channel on both sides
+	binding := <-bindings
+	assert.NotEmpty(t, binding)
+	assert.Equal(t, binding, <-bindings)
+
+	conn1.net.Stop()
+	conn2.net.Stop()
+}
+
+func TestAuthRejected(t *testing.T) {
+	conn1, conn2 := createAuthNetworks(t, go2p.AuthHMAC("node1", []byte("secret")), go2p.AuthHMAC("node2", []byte("other secret")))
+
+	events := make(chan string, 10)
+	for _, conn := range []*go2p.NetworkConnection{conn1.net, conn2.net} {
+		conn.OnPeer(func(peer *go2p.Peer) {
+			events <- "peer"
+		})
+		conn.OnPeerError(func(peer *go2p.Peer, err error) {
+			if _, ok := errors.Cause(err).(*go2p.AuthError); ok {
+				events <- "auth-error"
+			}
+		})
+	}
+
+	if !startNetworks(t, conn1.net, conn2.net) {
+		return
+	}
+
+	conn1.net.ConnectTo("tcp", conn2.addr)
+
+	assert.Equal(t, "auth-error", <-events)
+	assert.Equal(t, "auth-error", <-events)
+	select {
+	case event := <-events:
+		assert.Fail(t, "unexpected event", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn1.net.Stop()
+	conn2.net.Stop()
+}
+
+func TestACL(t *testing.T) {
+	p1, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+	p2, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	replies := make(chan *go2p.ErrorReply, 1)
+	called := make(chan string, 1)
+	routes := go2p.RoutingTable(&map[string]func(peer *go2p.Peer, msg *go2p.Message){
+		go2p.ErrorRoute: func(peer *go2p.Peer, msg *go2p.Message) {
+			reply, err := go2p.ParseErrorReply(msg)
+			assert.NoError(t, err)
+			replies <- reply
+		},
+		"config/set": func(peer *go2p.Peer, msg *go2p.Message) {
+			called <- msg.PayloadGetString()
+		},
+	})
+
+	policy := &go2p.ACLPolicy{Rules: []go2p.ACLRule{{Principals: []string{"admin"}, Routes: []string{"config/*"}, Allow: true}}, DefaultAllow: false}
+	policy.Rules = append(policy.Rules, go2p.ACLRule{Routes: []string{go2p.ErrorRoute}, Allow: true})
+
+	create := func(addr string, principal string) *go2p.NetworkConnection {
+		return go2p.NewNetworkConnection().
+			WithOperator(go2p.NewTCPOperator("tcp", addr)).
+			WithMiddleware(go2p.Routes(routes)).
+			WithMiddleware(go2p.ACLWith(policy, true)).
+			WithMiddleware(go2p.Headers()).
+			WithHandler(go2p.Auth(go2p.AuthHMAC(principal, []byte("secret")))).
+			Build()
+	}
+
+	conn1 := create(fmt.Sprintf("127.0.0.1:%d", p1), "guest")
+	conn2 := create(addr2, "node")
+
+	denied := make(chan *go2p.ACLError, 1)
+	conn2.OnPeerError(func(peer *go2p.Peer, err error) {
+		if aclErr, ok := errors.Cause(err).(*go2p.ACLError); ok {
+			denied <- aclErr
+		}
+	})
+
+	msg := go2p.NewMessageRoutedFromString("config/set", "value")
+	conn1.OnPeer(func(peer *go2p.Peer) {
+		conn1.Send(msg, peer.RemoteAddress())
+	})
+
+	if !startNetworks(t, conn1, conn2) {
+		return
+	}
+
+	conn1.ConnectTo("tcp", addr2)
+
+	aclErr := <-denied
+	assert.Equal(t, "guest", aclErr.Principal)
+	assert.Equal(t, "config/set", aclErr.Route)
+
+	reply := <-replies
+	assert.Equal(t, "acl", reply.Kind)
+	assert.Equal(t, "config/set", reply.Route)
+	assert.Equal(t, msg.ID(), reply.MessageID)
+
+	select {
+	case <-called:
+		assert.Fail(t, "route was called")
+	default:
+	}
+
+	conn1.Stop()
+	conn2.Stop()
+}
+
+func TestRelayMiddleware(t *testing.T) {
+	addrs := make([]string, 3)
+	for i := range addrs {
+		port, err := freeport.GetFreePort()
+		assert.NoError(t, err)
+		addrs[i] = fmt.Sprintf("127.0.0.1:%d", port)
+	}
+
+	relayed := make(chan *go2p.Message, 1)
+	routes := go2p.RoutingTable(&map[string]func(peer *go2p.Peer, msg *go2p.Message){
+		"gossip": func(peer *go2p.Peer, msg *go2p.Message) {
+			relayed <- msg
+		},
+	})
+
+	relay := func(peer *go2p.Peer, pipe *go2p.Pipe, msg *go2p.Message) (go2p.MiddlewareResult, error) {
+		_, errs := pipe.Network().Broadcast(msg)
+		if len(errs) > 0 {
+			return go2p.Stop, errs[0]
+		}
+		return go2p.Stop, nil
+	}
+
+	create := func(addr string, withRelay bool) *go2p.NetworkConnection {
+		builder := go2p.NewNetworkConnection().
+			WithOperator(go2p.NewTCPOperator("tcp", addr)).
+			WithMiddleware(go2p.Routes(routes))
+		if withRelay {
+			builder = builder.WithMiddlewareWhen(go2p.ForOperation(go2p.Receive), "relay", go2p.MiddlewareFunc(relay))
+		}
+
+		return builder.WithMiddleware(go2p.Headers()).Build()
+	}
+
+	conn1 := create(addrs[0], false)
+	conn2 := create(addrs[1], true)
+	conn3 := create(addrs[2], false)
+	registerPeerErrorHandlers(t, conn1, conn2, conn3)
+
+	connected := make(chan *go2p.Peer, 2)
+	conn2.OnPeer(func(peer *go2p.Peer) {
+		connected <- peer
+	})
+
+	msg := go2p.NewMessageRoutedFromString("gossip", "block 42")
+	conn1.OnPeer(func(peer *go2p.Peer) {
+		conn1.Send(msg, peer.RemoteAddress())
+	})
+
+	if !startNetworks(t, conn1, conn2, conn3) {
+		return
+	}
+
+	conn3.ConnectTo("tcp", addrs[1])
+	<-connected
+	conn1.ConnectTo("tcp", addrs[1])
+
+	result := <-relayed
+	assert.Equal(t, "block 42", result.PayloadGetString())
+	assert.Equal(t, msg.ID(), result.ID())
+	assert.Equal(t, conn1.Identity(), result.Origin())
+
+	conn1.Stop()
+	conn2.Stop()
+	conn3.Stop()
+}
+
+func TestTracing(t *testing.T) {
+	collected := make(chan []interface{}, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		var request struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []interface{} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		assert.NoError(t, json.Unmarshal(body, &request))
+		collected <- request.ResourceSpans[0].ScopeSpans[0].Spans
+	}))
+	defer collector.Close()
+
+	p1, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+	p2, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	var conn2 *go2p.NetworkConnection
+	acked := make(chan go2p.SpanContext, 1)
+	routes := go2p.RoutingTable(&map[string]func(peer *go2p.Peer, msg *go2p.Message){
+		"ping": func(peer *go2p.Peer, msg *go2p.Message) {
+			reply := go2p.NewMessageRoutedFromString("pong", "pong")
+			go2p.ContinueTrace(reply, msg)
+			conn2.Send(reply, peer.RemoteAddress())
+		},
+		"pong": func(peer *go2p.Peer, msg *go2p.Message) {
+			ctx, _ := go2p.TraceContext(msg)
+			acked <- ctx
+		},
+	})
+
+	create := func(addr string, service string) (*go2p.NetworkConnection, *go2p.Tracer) {
+		name, tracer := go2p.Tracing(go2p.NewOTLPExporter(collector.URL+"/v1/traces", service))
+		conn := go2p.NewNetworkConnection().
+			WithOperator(go2p.NewTCPOperator("tcp", addr)).
+			WithMiddleware(go2p.Routes(routes)).
+			WithHandler(name, tracer).
+			WithMiddleware(go2p.Headers()).
+			Build()
+
+		return conn, tracer
+	}
+
+	conn1, tracer1 := create(fmt.Sprintf("127.0.0.1:%d", p1), "node-1")
+	conn2, tracer2 := create(addr2, "node-2")
+	registerPeerErrorHandlers(t, conn1, conn2)
+
+	msg := go2p.NewMessageRoutedFromString("ping", "ping")
+	conn1.OnPeer(func(peer *go2p.Peer) {
+		conn1.Send(msg, peer.RemoteAddress())
+	})
+
+	if !startNetworks(t, conn1, conn2) {
+		return
+	}
+
+	conn1.ConnectTo("tcp", addr2)
+	ctx := <-acked
+
+	assert.NoError(t, tracer1.Flush())
+	assert.NoError(t, tracer2.Flush())
+
+	spans := map[string]map[string]interface{}{}
+	for len(spans) < 4 {
+		for _, span := range <-collected {
+			encoded := span.(map[string]interface{})
+			spans[encoded["name"].(string)] = encoded
+		}
+	}
+
+	traceID := ctx.TraceID.String()
+	for _, name := range []string{"send ping", "receive ping", "send pong", "receive pong"} {
+		assert.Equal(t, traceID, spans[name]["traceId"], name)
+	}
+	assert.Nil(t, spans["send ping"]["parentSpanId"])
+	assert.Equal(t, spans["send ping"]["spanId"], spans["receive ping"]["parentSpanId"])
+	assert.Equal(t, spans["receive ping"]["spanId"], spans["send pong"]["parentSpanId"])
+	assert.Equal(t, spans["send pong"]["spanId"], spans["receive pong"]["parentSpanId"])
+	assert.Equal(t, ctx.SpanID.String(), spans["receive pong"]["spanId"])
+
+	conn1.Stop()
+	conn2.Stop()
+}
+
+func TestCaptureReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go2p-capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.jsonl")
+
+	capture, err := go2p.NewCapture(path)
+	assert.NoError(t, err)
+
+	received := make(chan string, 10)
+	routes := go2p.RoutingTable(&map[string]func(peer *go2p.Peer, msg *go2p.Message){
+		"cmd": func(peer *go2p.Peer, msg *go2p.Message) {
+			received <- msg.PayloadGetString()
+		},
+	})
+
+	p1, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+	p2, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	conn1 := go2p.NewNetworkConnection().
+		WithOperator(go2p.NewTCPOperator("tcp", fmt.Sprintf("127.0.0.1:%d", p1))).
+		WithMiddleware(go2p.Routes(routes)).
+		WithMiddleware(go2p.Headers()).
+		Build()
+	conn2 := go2p.NewNetworkConnection().
+		WithOperator(capture.Operator(go2p.NewTCPOperator("tcp", addr2))).
+		WithMiddleware(go2p.Routes(routes)).
+		WithMiddleware(capture.Middleware()).
+		WithMiddleware(go2p.Headers()).
+		Build()
+	registerPeerErrorHandlers(t, conn1, conn2)
+
+	commands := []string{"start", "status", "stop"}
+	conn1.OnPeer(func(peer *go2p.Peer) {
+		for _, command := range commands {
+			conn1.Send(go2p.NewMessageRoutedFromString("cmd", command), peer.RemoteAddress())
+		}
+	})
+
+	if !startNetworks(t, conn1, conn2) {
+		return
+	}
+
+	conn1.ConnectTo("tcp", addr2)
+	for range commands {
+		<-received
+	}
+
+	conn1.Stop()
+	conn2.Stop()
+	assert.NoError(t, capture.Close())
+
+	replay := func(kind go2p.CaptureKind, middlewares ...func() (string, go2p.MiddlewareFunc)) {
+		op, err := go2p.NewReplayOperator(path, go2p.ReplayConfig{Kind: kind, Speed: 10})
+		assert.NoError(t, err)
+
+		builder := go2p.NewNetworkConnection().WithOperator(op).WithMiddleware(go2p.Routes(routes))
+		for _, m := range middlewares {
+			builder = builder.WithMiddleware(m())
+		}
+		conn := builder.Build()
+		assert.NoError(t, conn.Start())
+
+		replayed := []string{}
+		for range commands {
+			replayed = append(replayed, <-received)
+		}
+		assert.ElementsMatch(t, commands, replayed, string(kind))
+		<-op.Adapter().Done()
+		conn.Stop()
+	}
+
+	replay(go2p.CaptureMessage)
+	replay(go2p.CaptureFrame, go2p.Headers)
+}
+
+// createCompressNetworks creates two connections with the given compress middlewares (nil for none).
+// The returned channels receive the payload size of each message as it was received from the wire
+func createCompressNetworks(t *testing.T, compress ...func() (string, go2p.MiddlewareHandler)) ([]*networkConnWithAddress, []chan int) {
+	conns := []*networkConnWithAddress{}
+	sizes := []chan int{}
+	for _, c := range compress {
+		port, err := freeport.GetFreePort()
+		assert.NoError(t, err)
+		addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+		size := make(chan int, 10)
+		builder := go2p.NewNetworkConnection().
+			WithOperator(go2p.NewTCPOperator("tcp", addr)).
+			WithMiddleware(go2p.Headers())
+		if c != nil {
+			builder = builder.WithHandler(c())
+		}
+		builder = builder.WithMiddleware("wire", func(peer *go2p.Peer, pipe *go2p.Pipe, msg *go2p.Message) (go2p.MiddlewareResult, error) {
+			if pipe.Operation() == go2p.Receive {
+				size <- len(msg.PayloadGet())
+			}
+			return go2p.Next, nil
+		})
+
+		conns = append(conns, &networkConnWithAddress{net: builder.Build(), addr: addr, fullAddr: "tcp:" + addr})
+		sizes = append(sizes, size)
+	}
+
+	return conns, sizes
+}
+
+// exchangeCompressed lets the second connection greet the first one, which answers with a large message
+// and returns the wire sizes of the answer and of its echo
+func exchangeCompressed(t *testing.T, conns []*networkConnWithAddress, sizes []chan int, large string) (int, int) {
+	received := []chan string{make(chan string, 10), make(chan string, 10)}
+	for i, conn := range conns {
+		i := i
+		conn.net.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+			received[i] <- msg.PayloadGetString()
+		})
+	}
+	remote := make(chan string, 1)
+	conns[1].net.OnPeer(func(peer *go2p.Peer) {
+		remote <- peer.RemoteAddress()
+		conns[1].net.Send(go2p.NewMessageFromString("hello"), peer.RemoteAddress())
+	})
+
+	registerPeerErrorHandlers(t, conns[0].net, conns[1].net)
+	if !startNetworks(t, conns[0].net, conns[1].net) {
+		return 0, 0
+	}
+
+	conns[0].net.ConnectTo("tcp", conns[1].addr)
+
+	// the hello of the second connection is received after its announcement
+	assert.Equal(t, "hello", <-received[0])
+	conns[0].net.Send(go2p.NewMessageFromString(large), conns[1].fullAddr)
+	assert.Equal(t, large, <-received[1])
+	conns[1].net.Send(go2p.NewMessageFromString(large), <-remote)
+	assert.Equal(t, large, <-received[0])
+
+	wire := func(size chan int) int {
+		result := 0
+		for len(size) > 0 {
+			result = <-size
+		}
+		return result
+	}
+	forward, backward := wire(sizes[1]), wire(sizes[0])
+
+	conns[0].net.Stop()
+	conns[1].net.Stop()
+
+	return forward, backward
+}
+
+func TestCompressNetworks(t *testing.T) {
+	conns, sizes := createCompressNetworks(t,
+		func() (string, go2p.MiddlewareHandler) {
+			return go2p.CompressWith(64, go2p.CompressionZstd, go2p.CompressionGzip)
+		},
+		func() (string, go2p.MiddlewareHandler) {
+			return go2p.CompressWith(64, go2p.CompressionSnappy, go2p.CompressionGzip)
+		})
+
+	large := strings.Repeat(`{"key": "value"}`, 100)
+	forward, backward := exchangeCompressed(t, conns, sizes, large)
+	assert.True(t, forward > 0 && forward < len(large)/5, forward)
+	assert.True(t, backward > 0 && backward < len(large)/5, backward)
+}
+
+func TestCompressWithoutRemoteCompress(t *testing.T) {
+	conns, sizes := createCompressNetworks(t, go2p.Compress, nil)
+
+	large := strings.Repeat(`{"key": "value"}`, 100)
+	forward, backward := exchangeCompressed(t, conns, sizes, large)
+	assert.True(t, forward > len(large), forward)
+	assert.True(t, backward > len(large), backward)
+}
+
+func createNoiseNetworks(t *testing.T, config1 go2p.NoiseConfig, config2 go2p.NoiseConfig) (*networkConnWithAddress, *networkConnWithAddress) {
+	p1, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	p2, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	addr1 := fmt.Sprintf("127.0.0.1:%d", p1)
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	conn1 := go2p.NewNetworkConnectionTCPWith(addr1, go2p.EmptyRoutesTable, config1)
+	conn2 := go2p.NewNetworkConnectionTCPWith(addr2, go2p.EmptyRoutesTable, config2)
+
+	return &networkConnWithAddress{net: conn1, addr: addr1, fullAddr: "tcp:" + addr1}, &networkConnWithAddress{net: conn2, addr: addr2, fullAddr: "tcp:" + addr2}
+}
+
+func TestNoiseIK(t *testing.T) {
+	key1, err := go2p.GenerateNoiseKey()
+	assert.NoError(t, err)
+	key2, err := go2p.GenerateNoiseKey()
+	assert.NoError(t, err)
+
+	known := func(key go2p.NoiseKey) func(peer *go2p.Peer) ([]byte, bool) {
+		return func(peer *go2p.Peer) ([]byte, bool) {
+			return key.Public, true
+		}
+	}
+
+	conn1, conn2 := createNoiseNetworks(t,
+		go2p.NoiseConfig{Pattern: go2p.NoiseIK, StaticKey: key1, PeerKey: known(key2)},
+		go2p.NoiseConfig{Pattern: go2p.NoiseIK, StaticKey: key2, PeerKey: known(key1)})
+
+	received := make(chan string, 1)
+	conn1.net.OnPeer(func(peer *go2p.Peer) {
+		conn1.net.Send(go2p.NewMessageFromString("hello"), peer.RemoteAddress())
+	})
+	conn2.net.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+		received <- msg.PayloadGetString()
+	})
+
+	registerPeerErrorHandlers(t, conn1.net, conn2.net)
+	if !startNetworks(t, conn1.net, conn2.net) {
+		return
+	}
+
+	conn1.net.ConnectTo("tcp", conn2.addr)
+	assert.Equal(t, "hello", <-received)
+
+	conn1.net.Stop()
+	conn2.net.Stop()
+}
+
+func TestNoiseRejected(t *testing.T) {
+	trusted, err := go2p.GenerateNoiseKey()
+	assert.NoError(t, err)
+
+	conn1, conn2 := createNoiseNetworks(t, go2p.NoiseConfig{}, go2p.NoiseConfig{
+		Authorize: func(peer *go2p.Peer, remoteStatic []byte) error {
+			if string(remoteStatic) != string(trusted.Public) {
+				return errors.New("unknown key")
+			}
+			return nil
+		},
+	})
+
+	rejected := make(chan *go2p.NoiseError, 1)
+	conn2.net.OnPeerError(func(peer *go2p.Peer, err error) {
+		if noiseErr, ok := errors.Cause(err).(*go2p.NoiseError); ok {
+			rejected <- noiseErr
+		}
+	})
+	received := make(chan string, 1)
+	conn2.net.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+		received <- msg.PayloadGetString()
+	})
+	conn1.net.OnPeer(func(peer *go2p.Peer) {
+		conn1.net.Send(go2p.NewMessageFromString("hello"), peer.RemoteAddress())
+	})
+
+	if !startNetworks(t, conn1.net, conn2.net) {
+		return
+	}
+
+	conn1.net.ConnectTo("tcp", conn2.addr)
+
+	noiseErr := <-rejected
+	assert.NotEmpty(t, noiseErr.RemoteStatic)
+	select {
+	case msg := <-received:
+		assert.Fail(t, "unexpected message", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn1.net.Stop()
+	conn2.net.Stop()
+}
+
+func TestNoiseRekey(t *testing.T) {
+	p1, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+	p2, err := freeport.GetFreePort()
+	assert.NoError(t, err)
+
+	addr2 := fmt.Sprintf("127.0.0.1:%d", p2)
+
+	create := func(addr string, rekeys chan go2p.RekeyEvent) *go2p.NetworkConnection {
+		return go2p.NewNetworkConnection().
+			WithOperator(go2p.NewTCPOperator("tcp", addr)).
+			WithMiddleware(go2p.Headers()).
+			WithHandler(go2p.NoiseWith(go2p.NoiseConfig{
+				Rekey: go2p.NoiseRekey{Messages: 10},
+				OnRekey: func(event go2p.RekeyEvent) {
+					rekeys <- event
+				},
+			})).
+			WithPipelineConcurrency(4).
+			Build()
+	}
+
+	rekeys1 := make(chan go2p.RekeyEvent, 100)
+	rekeys2 := make(chan go2p.RekeyEvent, 100)
+	conn1 := create(fmt.Sprintf("127.0.0.1:%d", p1), rekeys1)
+	conn2 := create(addr2, rekeys2)
+
+	// ping pong, so the rekey responses arrive between the messages
+	const count = 50
+	done := make(chan int, 1)
+	conn2.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+		conn2.Send(go2p.NewMessageFromString(msg.PayloadGetString()), peer.RemoteAddress())
+	})
+	conn1.OnMessage(func(peer *go2p.Peer, msg *go2p.Message) {
+		var i int
+		fmt.Sscanf(msg.PayloadGetString(), "ping %d", &i)
+		if i == count {
+			done <- i
+			return
+		}
+		conn1.Send(go2p.NewMessageFromString(fmt.Sprintf("ping %d", i+1)), peer.RemoteAddress())
+	})
+	conn1.OnPeer(func(peer *go2p.Peer) {
+		conn1.Send(go2p.NewMessageFromString("ping 1"), peer.RemoteAddress())
+	})
+
+	registerPeerErrorHandlers(t, conn1, conn2)
+	if !startNetworks(t, conn1, conn2) {
+		return
+	}
+
+	conn1.ConnectTo("tcp", addr2)
+	assert.Equal(t, count, <-done)
+
+	// both sides replaced the keys of both directions several times and in order
+	for _, rekeys := range []chan go2p.RekeyEvent{rekeys1, rekeys2} {
+		generations := map[go2p.PipeOperation]uint32{}
+		for len(rekeys) > 0 {
+			event := <-rekeys
+			assert.Equal(t, go2p.RekeyMessages, event.Reason)
+			assert.Equal(t, generations[event.Direction]+1, event.Generation)
+			generations[event.Direction] = event.Generation
+		}
+
+		assert.True(t, generations[go2p.Send] >= 3, "send generation %d", generations[go2p.Send])
+		assert.True(t, generations[go2p.Receive] >= 3, "receive generation %d", generations[go2p.Receive])
+	}
+
+	conn1.Stop()
+	conn2.Stop()
+}
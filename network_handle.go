@@ -0,0 +1,86 @@
+package go2p
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrPeerNotFound is returned when a message is sent to an address without a connected peer
+// or to a peer that was stopped
+var ErrPeerNotFound = errors.New("peer not found")
+
+// ErrSendQueueFull is returned by the NetworkHandle when the send queue of the peer is full
+var ErrSendQueueFull = errors.New("send queue full")
+
+// NetworkHandle gives middlewares access to the NetworkConnection of a pipe,
+// to forward, relay or gossip messages to other peers (see Pipe.Network).
+//
+// Middlewares run on the workers of a peer, so the handle never blocks:
+// the peer list is copied before it is used and messages are only enqueued
+// if the send queue of the receiver has room, otherwise ErrSendQueueFull is returned.
+// Each send enqueues a copy of the message (see Message.Clone)
+type NetworkHandle struct {
+	nc   *NetworkConnection
+	peer *Peer
+}
+
+// Identity returns the identity of the NetworkConnection
+func (h *NetworkHandle) Identity() string {
+	return h.nc.Identity()
+}
+
+// Peer returns the current peer of the pipe
+func (h *NetworkHandle) Peer() *Peer {
+	return h.peer
+}
+
+// Peers returns the connected peers, including the current peer of the pipe
+func (h *NetworkHandle) Peers() []*Peer {
+	return h.nc.peers.list()
+}
+
+// Lookup returns the peer with the given remote address
+func (h *NetworkHandle) Lookup(addr string) (*Peer, bool) {
+	peer := h.nc.peers.find(addr)
+	return peer, peer != nil
+}
+
+// Send enqueues a copy of the message for the peer with the given remote address
+func (h *NetworkHandle) Send(msg *Message, addr string) error {
+	peer := h.nc.peers.find(addr)
+	if peer == nil {
+		return errors.Wrapf(ErrPeerNotFound, "send to %s", addr)
+	}
+
+	return h.SendTo(msg, peer)
+}
+
+// SendTo enqueues a copy of the message for the given peer.
+// It returns ErrPeerNotFound if the peer was stopped
+func (h *NetworkHandle) SendTo(msg *Message, peer *Peer) error {
+	if err := peer.tryEnqueue(msg.Clone()); err != nil {
+		return errors.Wrapf(err, "send to %s", peer.RemoteAddress())
+	}
+
+	return nil
+}
+
+// Broadcast enqueues a copy of the message for all peers except the current peer of the pipe.
+// It returns the number of peers the message was enqueued for
+// and the errors of the peers with a full send queue or that were stopped
+func (h *NetworkHandle) Broadcast(msg *Message) (int, []error) {
+	sent := 0
+	var errs []error
+	for _, peer := range h.nc.peers.list() {
+		if peer == h.peer {
+			continue
+		}
+
+		if err := h.SendTo(msg, peer); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		sent++
+	}
+
+	return sent, errs
+}
@@ -0,0 +1,93 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func newHandleTestPeer(nc *NetworkConnection, addr string) *Peer {
+	adapter := new(MockAdapter)
+	adapter.On("RemoteAddress").Return(addr)
+	p := newPeer(adapter, nc.middlewares, nc.peerConfig)
+	p.network = nc
+	nc.peers.add(p)
+
+	return p
+}
+
+func TestNetworkHandle(t *testing.T) {
+	nc := NewNetworkConnection().Build()
+	source := newHandleTestPeer(nc, "10.0.0.1:4000")
+	target1 := newHandleTestPeer(nc, "10.0.0.2:4000")
+	target2 := newHandleTestPeer(nc, "10.0.0.3:4000")
+
+	var handle *NetworkHandle
+	relay := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		handle = pipe.Network()
+		sent, errs := handle.Broadcast(msg)
+		assert.Equal(t, 2, sent)
+		assert.Empty(t, errs)
+		return Next, nil
+	}
+
+	msg := NewMessageFromString("gossip")
+	pipe := newPipe(source, newMiddlewares(NewMiddleware("relay", relay)), Receive, 0, 0, 1)
+	assert.NoError(t, pipe.process(msg))
+
+	assert.Equal(t, nc.Identity(), handle.Identity())
+	assert.Equal(t, source, handle.Peer())
+	assert.Len(t, handle.Peers(), 3)
+	assert.Nil(t, source.send.pop())
+
+	for _, target := range []*Peer{target1, target2} {
+		forwarded := target.send.pop()
+		assert.NotNil(t, forwarded)
+		assert.Equal(t, msg.ID(), forwarded.ID())
+		assert.Equal(t, "gossip", forwarded.PayloadGetString())
+		assert.False(t, forwarded == msg)
+	}
+
+	found, ok := handle.Lookup("10.0.0.2:4000")
+	assert.True(t, ok)
+	assert.Equal(t, target1, found)
+
+	err := handle.Send(msg, "10.0.0.9:4000")
+	assert.Equal(t, ErrPeerNotFound, errors.Cause(err))
+}
+
+func TestNetworkHandleQueueFull(t *testing.T) {
+	nc := NewNetworkConnection().Build()
+	source := newHandleTestPeer(nc, "10.0.0.1:4000")
+	target := newHandleTestPeer(nc, "10.0.0.2:4000")
+	handle := &NetworkHandle{nc: nc, peer: source}
+
+	var err error
+	for i := 0; i < 11 && err == nil; i++ {
+		err = handle.Send(NewMessageFromString("msg"), target.RemoteAddress())
+	}
+	assert.Equal(t, ErrSendQueueFull, errors.Cause(err))
+
+	sent, errs := handle.Broadcast(NewMessageFromString("msg"))
+	assert.Equal(t, 0, sent)
+	assert.Len(t, errs, 1)
+}
+
+func TestNetworkHandleStoppedPeer(t *testing.T) {
+	nc := NewNetworkConnection().Build()
+	source := newHandleTestPeer(nc, "10.0.0.1:4000")
+	target := newHandleTestPeer(nc, "10.0.0.2:4000")
+	handle := &NetworkHandle{nc: nc, peer: source}
+
+	target.awaiter.Cancel()
+
+	err := handle.SendTo(NewMessageFromString("msg"), target)
+	assert.Equal(t, ErrPeerNotFound, errors.Cause(err))
+	assert.Nil(t, target.send.pop())
+}
+
+func TestPipeNetworkWithoutConnection(t *testing.T) {
+	pipe := newPipe(nil, newMiddlewares(), Send, 0, 0, 0)
+	assert.Nil(t, pipe.Network())
+}
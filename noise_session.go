@@ -0,0 +1,464 @@
+package go2p
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/flynn/noise"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+)
+
+// DefaultNoiseRekey is the rekey policy used for zero values in NoiseRekey
+var DefaultNoiseRekey = NoiseRekey{
+	Messages: 1 << 20,
+	Bytes:    1 << 30,
+	Interval: time.Hour,
+}
+
+// noiseFrameHeaderLen is the length of [type][generation][nonce]
+const noiseFrameHeaderLen = 1 + 4 + 8
+
+const noiseKeyLen = 32
+
+var noiseRekeyInfo = []byte("go2p-noise-rekey")
+
+// frame types of the transport
+const (
+	noiseFrameData byte = iota
+	noiseFrameRekeyRequest
+	noiseFrameRekeyResponse
+)
+
+// NoiseRekey configures when a side replaces the key of its outgoing frames.
+// A zero value uses the value of DefaultNoiseRekey, a negative value disables the limit.
+//
+// The rekey is started when a limit is reached and takes one round trip,
+// frames that are sent in the meantime still use the current key
+type NoiseRekey struct {
+	// Messages is the number of frames after that the key is replaced
+	Messages int64
+	// Bytes is the number of encrypted payload bytes after that the key is replaced
+	Bytes int64
+	// Interval is the time after that the key is replaced,
+	// it is checked when a frame is sent so an idle channel keeps its key
+	Interval time.Duration
+}
+
+func (r NoiseRekey) withDefaults() NoiseRekey {
+	if r.Messages == 0 {
+		r.Messages = DefaultNoiseRekey.Messages
+	}
+	if r.Bytes == 0 {
+		r.Bytes = DefaultNoiseRekey.Bytes
+	}
+	if r.Interval == 0 {
+		r.Interval = DefaultNoiseRekey.Interval
+	}
+
+	return r
+}
+
+// RekeyReason is the limit that caused a rekey
+type RekeyReason byte
+
+const (
+	// RekeyMessages is reported when the message limit was reached
+	RekeyMessages RekeyReason = iota + 1
+	// RekeyBytes is reported when the byte limit was reached
+	RekeyBytes
+	// RekeyInterval is reported when the key was older than the interval
+	RekeyInterval
+)
+
+func (r RekeyReason) String() string {
+	switch r {
+	case RekeyMessages:
+		return "messages"
+	case RekeyBytes:
+		return "bytes"
+	case RekeyInterval:
+		return "interval"
+	}
+
+	return fmt.Sprintf("RekeyReason(%d)", byte(r))
+}
+
+// RekeyEvent is reported when a key of a Noise session was replaced
+type RekeyEvent struct {
+	Peer *Peer
+	// Direction is Send for the key of the outgoing frames
+	// and Receive for the key of the incoming frames
+	Direction PipeOperation
+	// Generation is the number of the new key, the key of the handshake is generation 0
+	Generation uint32
+	// Reason is the limit that was reached by the sending side
+	Reason RekeyReason
+	// Messages and Bytes are the number of frames and payload bytes
+	// that were encrypted with the replaced key
+	Messages uint64
+	Bytes    uint64
+}
+
+// StaleKeyError is reported when a frame was encrypted with a key that was already discarded
+type StaleKeyError struct {
+	// Generation of the key of the frame
+	Generation uint32
+	// Current is the generation of the current key
+	Current uint32
+}
+
+func (e *StaleKeyError) Error() string {
+	return fmt.Sprintf("frame with a discarded key (generation: %d, current: %d)", e.Generation, e.Current)
+}
+
+// ErrorAction implements ErrorActioner, frames with discarded keys are dropped
+func (e *StaleKeyError) ErrorAction() ErrorAction {
+	return ErrorDrop
+}
+
+// noiseSession holds the transport keys of an established channel.
+//
+// Each frame carries its type, the generation of its key and its nonce explicitly,
+// so frames can be decrypted out of order and replayed frames are detected
+// by the replay window of the key.
+//
+// Each side replaces the key of its outgoing frames independently: it sends a request with
+// a new ephemeral key, the remote answers with its own ephemeral key and prepares the
+// receiving side for the next generation. The sender switches to the next key when
+// the response arrived. The new key is derived from the Diffie-Hellman result of the
+// ephemeral keys and the replaced key, so a compromised key exposes only the frames of its
+// generation: the previous keys can not be derived from it and the next keys require
+// the ephemeral keys that never leave the sides
+type noiseSession struct {
+	remoteStatic []byte
+	// channelBinding is the hash of the handshake transcript, it is the same on both sides
+	channelBinding []byte
+	rekey          NoiseRekey
+	now            func() time.Time
+	onRekey        func(event RekeyEvent)
+
+	out *noiseSendState
+	in  *noiseReceiveState
+}
+
+type noiseSendState struct {
+	mutex      *sync.Mutex
+	generation uint32
+	cipher     noise.Cipher
+	nonce      uint64
+	messages   uint64
+	bytes      uint64
+	since      time.Time
+	pending    *noisePendingRekey
+}
+
+// noisePendingRekey is a sent rekey request that waits for its response
+type noisePendingRekey struct {
+	generation uint32
+	reason     RekeyReason
+	ephemeral  noise.DHKey
+}
+
+type noiseReceiveState struct {
+	mutex *sync.Mutex
+	// previous is kept for frames that were reordered around the rekey
+	previous *noiseReceiveKey
+	current  *noiseReceiveKey
+	// next is prepared by a rekey request and used with the first frame of its generation
+	next *noiseReceiveKey
+}
+
+type noiseReceiveKey struct {
+	generation uint32
+	cipher     noise.Cipher
+	window     *replayWindow
+	reason     RekeyReason
+	messages   uint64
+	bytes      uint64
+}
+
+func newNoiseSession(remoteStatic []byte, send noise.Cipher, receive noise.Cipher, rekey NoiseRekey, now func() time.Time) *noiseSession {
+	s := new(noiseSession)
+	s.remoteStatic = remoteStatic
+	s.rekey = rekey
+	s.now = now
+	s.out = &noiseSendState{mutex: new(sync.Mutex), cipher: send, since: now()}
+	s.in = &noiseReceiveState{mutex: new(sync.Mutex), current: &noiseReceiveKey{cipher: receive, window: newReplayWindow()}}
+
+	return s
+}
+
+// seal returns the data frame of content and a rekey request frame
+// if a limit of the current key was reached
+func (s *noiseSession) seal(content []byte) ([]byte, []byte, error) {
+	s.out.mutex.Lock()
+	request, err := s.requestRekey()
+	generation, cipher, nonce := s.out.next(len(content))
+	s.out.mutex.Unlock()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return sealNoiseFrame(cipher, noiseFrameData, generation, nonce, content), request, nil
+}
+
+// requestRekey returns the sealed rekey request if a limit was reached and no request is pending.
+// The caller has to hold the mutex of the send state
+func (s *noiseSession) requestRekey() ([]byte, error) {
+	if s.out.pending != nil {
+		return nil, nil
+	}
+
+	reason := s.rekeyReason()
+	if reason == 0 {
+		return nil, nil
+	}
+
+	ephemeral, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate rekey key")
+	}
+
+	s.out.pending = &noisePendingRekey{generation: s.out.generation + 1, reason: reason, ephemeral: ephemeral}
+
+	content := make([]byte, 0, 4+1+noiseKeyLen)
+	content = binary.BigEndian.AppendUint32(content, s.out.pending.generation)
+	content = append(content, byte(reason))
+	content = append(content, ephemeral.Public...)
+
+	generation, cipher, nonce := s.out.next(0)
+	return sealNoiseFrame(cipher, noiseFrameRekeyRequest, generation, nonce, content), nil
+}
+
+// rekeyReason returns the reached limit of the current send key or 0
+func (s *noiseSession) rekeyReason() RekeyReason {
+	if s.rekey.Messages > 0 && s.out.messages >= uint64(s.rekey.Messages) {
+		return RekeyMessages
+	}
+	if s.rekey.Bytes > 0 && s.out.bytes >= uint64(s.rekey.Bytes) {
+		return RekeyBytes
+	}
+	if s.rekey.Interval > 0 && s.now().Sub(s.out.since) >= s.rekey.Interval {
+		return RekeyInterval
+	}
+
+	return 0
+}
+
+// next returns the key and the nonce of the next frame and counts it.
+// The caller has to hold the mutex
+func (o *noiseSendState) next(size int) (uint32, noise.Cipher, uint64) {
+	o.nonce++
+	o.messages++
+	o.bytes += uint64(size)
+
+	return o.generation, o.cipher, o.nonce
+}
+
+// open returns the type and the content of the frame
+func (s *noiseSession) open(frame []byte) (byte, []byte, error) {
+	if len(frame) < noiseFrameHeaderLen {
+		return 0, nil, errors.Errorf("invalid noise frame (len: %d)", len(frame))
+	}
+
+	frameType := frame[0]
+	generation := binary.BigEndian.Uint32(frame[1:])
+	nonce := binary.BigEndian.Uint64(frame[5:])
+
+	s.in.mutex.Lock()
+	content, event, err := s.in.open(frame[:noiseFrameHeaderLen], generation, nonce, frame[noiseFrameHeaderLen:])
+	s.in.mutex.Unlock()
+
+	if err != nil {
+		return 0, nil, err
+	}
+	if event != nil {
+		s.notify(*event)
+	}
+
+	return frameType, content, nil
+}
+
+// open decrypts the ciphertext with the key of the generation and returns an event
+// if it is the first frame of the next generation.
+// The caller has to hold the mutex
+func (in *noiseReceiveState) open(header []byte, generation uint32, nonce uint64, ciphertext []byte) ([]byte, *RekeyEvent, error) {
+	key, err := in.key(generation)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	content, err := key.cipher.Decrypt(nil, nonce, header, ciphertext)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "could not decrypt (len: %d, generation: %d, nonce: %d)", len(ciphertext), generation, nonce)
+	}
+
+	// the window is checked after the authentication so forged frames can not move it
+	if err := key.window.check(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	key.messages++
+	if header[0] == noiseFrameData {
+		key.bytes += uint64(len(content))
+	}
+
+	if key != in.next {
+		return content, nil, nil
+	}
+
+	replaced := in.current
+	in.previous, in.current, in.next = replaced, key, nil
+
+	return content, &RekeyEvent{Direction: Receive, Generation: key.generation, Reason: key.reason, Messages: replaced.messages, Bytes: replaced.bytes}, nil
+}
+
+// key returns the receive key of the generation.
+// The caller has to hold the mutex
+func (in *noiseReceiveState) key(generation uint32) (*noiseReceiveKey, error) {
+	for _, key := range []*noiseReceiveKey{in.current, in.next, in.previous} {
+		if key != nil && key.generation == generation {
+			return key, nil
+		}
+	}
+
+	if generation < in.current.generation {
+		return nil, &StaleKeyError{Generation: generation, Current: in.current.generation}
+	}
+
+	return nil, errors.Errorf("frame with an unknown key (generation: %d, current: %d)", generation, in.current.generation)
+}
+
+// control handles a rekey frame and returns the frame that has to be sent as answer
+func (s *noiseSession) control(frameType byte, content []byte) ([]byte, error) {
+	if len(content) != 4+1+noiseKeyLen {
+		return nil, errors.Errorf("invalid rekey frame (len: %d)", len(content))
+	}
+
+	generation := binary.BigEndian.Uint32(content)
+	reason := RekeyReason(content[4])
+	remote := content[5:]
+
+	switch frameType {
+	case noiseFrameRekeyRequest:
+		return s.acceptRekey(generation, reason, remote)
+	case noiseFrameRekeyResponse:
+		return nil, s.completeRekey(generation, remote)
+	}
+
+	return nil, errors.Errorf("unknown noise frame type %d", frameType)
+}
+
+// acceptRekey prepares the receive key of the next generation and returns the response
+func (s *noiseSession) acceptRekey(generation uint32, reason RekeyReason, remote []byte) ([]byte, error) {
+	ephemeral, err := noise.DH25519.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate rekey key")
+	}
+
+	s.in.mutex.Lock()
+	current := s.in.current
+	if generation != current.generation+1 {
+		s.in.mutex.Unlock()
+		return nil, errors.Errorf("unexpected rekey request (generation: %d, current: %d)", generation, current.generation)
+	}
+
+	cipher, err := deriveNoiseKey(current.cipher, ephemeral, remote, generation)
+	if err == nil {
+		s.in.next = &noiseReceiveKey{generation: generation, cipher: cipher, window: newReplayWindow(), reason: reason}
+	}
+	s.in.mutex.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	content := make([]byte, 0, 4+1+noiseKeyLen)
+	content = binary.BigEndian.AppendUint32(content, generation)
+	content = append(content, byte(reason))
+	content = append(content, ephemeral.Public...)
+
+	s.out.mutex.Lock()
+	sendGeneration, sendCipher, nonce := s.out.next(0)
+	s.out.mutex.Unlock()
+
+	return sealNoiseFrame(sendCipher, noiseFrameRekeyResponse, sendGeneration, nonce, content), nil
+}
+
+// completeRekey switches the send key to the generation of the pending request
+func (s *noiseSession) completeRekey(generation uint32, remote []byte) error {
+	s.out.mutex.Lock()
+
+	pending := s.out.pending
+	if pending == nil || pending.generation != generation {
+		s.out.mutex.Unlock()
+		return errors.Errorf("unexpected rekey response (generation: %d)", generation)
+	}
+
+	cipher, err := deriveNoiseKey(s.out.cipher, pending.ephemeral, remote, generation)
+	if err != nil {
+		s.out.mutex.Unlock()
+		return err
+	}
+
+	event := RekeyEvent{Direction: Send, Generation: generation, Reason: pending.reason, Messages: s.out.messages, Bytes: s.out.bytes}
+	s.out.generation = generation
+	s.out.cipher = cipher
+	s.out.nonce = 0
+	s.out.messages = 0
+	s.out.bytes = 0
+	s.out.since = s.now()
+	s.out.pending = nil
+	s.out.mutex.Unlock()
+
+	s.notify(event)
+	return nil
+}
+
+func (s *noiseSession) notify(event RekeyEvent) {
+	if s.onRekey != nil {
+		s.onRekey(event)
+	}
+}
+
+// deriveNoiseKey returns the cipher of the next generation.
+//
+// The Diffie-Hellman result of the ephemeral keys is the secret of a HKDF, salted with
+// the output of the Noise REKEY function of the current key
+func deriveNoiseKey(current noise.Cipher, ephemeral noise.DHKey, remote []byte, generation uint32) (noise.Cipher, error) {
+	secret, err := noise.DH25519.DH(ephemeral.Private, remote)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid rekey key")
+	}
+
+	var zeros [noiseKeyLen]byte
+	chain := current.Encrypt(nil, math.MaxUint64, nil, zeros[:])[:noiseKeyLen]
+
+	info := binary.BigEndian.AppendUint32(append([]byte{}, noiseRekeyInfo...), generation)
+
+	var key [noiseKeyLen]byte
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, chain, info), key[:]); err != nil {
+		return nil, errors.Wrap(err, "could not derive key")
+	}
+
+	return noise.CipherChaChaPoly.Cipher(key), nil
+}
+
+// sealNoiseFrame returns [type][generation][nonce][ciphertext],
+// the header is authenticated as additional data
+func sealNoiseFrame(cipher noise.Cipher, frameType byte, generation uint32, nonce uint64, content []byte) []byte {
+	frame := make([]byte, noiseFrameHeaderLen, noiseFrameHeaderLen+len(content)+16)
+	frame[0] = frameType
+	binary.BigEndian.PutUint32(frame[1:], generation)
+	binary.BigEndian.PutUint64(frame[5:], nonce)
+
+	return cipher.Encrypt(frame, nonce, frame[:noiseFrameHeaderLen], content)
+}
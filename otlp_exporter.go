@@ -0,0 +1,161 @@
+package go2p
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultOTLPEndpoint is the traces endpoint of a local OpenTelemetry collector
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// OTLPExporter exports spans with OTLP/HTTP in the JSON encoding
+// to an OpenTelemetry collector
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+
+	// Client is the http client used for the export requests
+	Client *http.Client
+	// Headers are added to each export request, like authorization headers
+	Headers map[string]string
+}
+
+var _ SpanExporter = (*OTLPExporter)(nil)
+
+// NewOTLPExporter creates an exporter that sends the spans to the endpoint
+// (the full url, like DefaultOTLPEndpoint).
+// The spans are reported with the service.name resource attribute serviceName
+func NewOTLPExporter(endpoint string, serviceName string) *OTLPExporter {
+	e := new(OTLPExporter)
+	e.endpoint = endpoint
+	e.serviceName = serviceName
+	e.Client = &http.Client{Timeout: 10 * time.Second}
+	e.Headers = make(map[string]string)
+
+	return e
+}
+
+// ExportSpans implements SpanExporter
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return errors.Wrap(err, "could not encode spans")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "could not create export request")
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not export spans")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		content, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("could not export spans (status: %d): %s", resp.StatusCode, content)
+	}
+
+	return nil
+}
+
+// OTLP JSON encoding of the ExportTraceServiceRequest,
+// see https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpSpanKinds maps SpanKind to the OTLP values (SPAN_KIND_PRODUCER and SPAN_KIND_CONSUMER)
+var otlpSpanKinds = [...]int{SpanKindProducer: 4, SpanKindConsumer: 5}
+
+func (e *OTLPExporter) request(spans []*Span) *otlpRequest {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: "github.com/v-braun/go2p"}}
+	for _, span := range spans {
+		encoded := otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              otlpSpanKinds[span.Kind],
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.Parent != (SpanID{}) {
+			encoded.ParentSpanID = span.Parent.String()
+		}
+
+		scope.Spans = append(scope.Spans, encoded)
+	}
+
+	resource := otlpResource{Attributes: otlpAttributes(map[string]string{"service.name": e.serviceName})}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{Resource: resource, ScopeSpans: []otlpScopeSpans{scope}}}}
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, otlpAttribute{Key: key, Value: otlpValue{StringValue: attributes[key]}})
+	}
+
+	return result
+}
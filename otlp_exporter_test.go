@@ -0,0 +1,73 @@
+package go2p
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("Authorization"))
+
+		body, _ := ioutil.ReadAll(r.Body)
+		var request map[string]interface{}
+		assert.NoError(t, json.Unmarshal(body, &request))
+		requests <- request
+
+		w.Write([]byte("{}"))
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL+"/v1/traces", "node-1")
+	exporter.Headers["Authorization"] = "secret"
+
+	ctx, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	start := time.Unix(1, 500)
+	span := &Span{
+		Name:       "send sync",
+		Kind:       SpanKindProducer,
+		Context:    ctx,
+		Parent:     SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+		Start:      start,
+		End:        start.Add(time.Millisecond),
+		Attributes: map[string]string{"messaging.system": "go2p"},
+	}
+
+	assert.NoError(t, exporter.ExportSpans([]*Span{span}))
+
+	request := <-requests
+	resourceSpans := request["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	resource := resourceSpans["resource"].(map[string]interface{})
+	assert.Equal(t, []interface{}{map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "node-1"}}}, resource["attributes"])
+
+	scopeSpans := resourceSpans["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	encoded := scopeSpans["spans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", encoded["traceId"])
+	assert.Equal(t, "00f067aa0ba902b7", encoded["spanId"])
+	assert.Equal(t, "0102030405060708", encoded["parentSpanId"])
+	assert.Equal(t, "send sync", encoded["name"])
+	assert.Equal(t, float64(4), encoded["kind"])
+	assert.Equal(t, "1000000500", encoded["startTimeUnixNano"])
+	assert.Equal(t, "1001000500", encoded["endTimeUnixNano"])
+}
+
+func TestOTLPExporterNegative(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "node-1")
+	err := exporter.ExportSpans([]*Span{{Name: "send"}})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "503")
+}
@@ -1,6 +1,9 @@
 package go2p
 
 import (
+	"sync"
+	"sync/atomic"
+
 	"github.com/v-braun/awaiter"
 
 	"github.com/emirpasic/gods/maps"
@@ -9,28 +12,57 @@ import (
 
 // Peer represents a connection to a remote peer
 type Peer struct {
+	stats      peerStats
 	io         *adapterIO
-	send       chan *Message
-	middleware middlewares
+	send       *sendQueue
+	middleware *middlewareChain
 	emitter    *eventEmitter
 	metadata   maps.Map
+	state      *peerStateStore
 	awaiter    awaiter.Awaiter
+	config     *peerConfig
+	disconnect *sync.Once
+	starting   *sync.Mutex
+	lifecycle  *peerLifecycle
+	principal  atomic.Value
+	binding    atomic.Value
+	network    *NetworkConnection
+}
+
+// peerConfig contains the settings of a NetworkConnection
+// that are applied to each of its peers
+type peerConfig struct {
+	identity    string
+	batching    *writeBatching
+	errorPolicy ErrorPolicy
+	metrics     Metrics
+	concurrency int
 }
 
-func newPeer(adapter Adapter, middleware middlewares) *Peer {
+func newPeer(adapter Adapter, middleware *middlewareChain, config *peerConfig) *Peer {
 	p := new(Peer)
-	p.send = make(chan *Message, 10)
-	p.io = newAdapterIO(adapter)
+	p.send = newSendQueue(10)
+	p.io = newAdapterIO(adapter, config.batching)
 	p.awaiter = awaiter.New()
 	p.middleware = middleware
 	p.metadata = hashmap.New()
+	p.state = newPeerStateStore()
 	p.emitter = newEventEmitter()
+	p.config = config
+	p.disconnect = new(sync.Once)
+	p.starting = new(sync.Mutex)
+	p.lifecycle = newPeerLifecycle()
 
 	return p
 }
 
-func (p *Peer) start() <-chan struct{} {
-	done := make(chan struct{})
+// start runs the OnConnect handshakes of all middlewares and starts the message loop.
+// The returned channel receives nil when the peer is ready or the handshake error
+func (p *Peer) start() <-chan error {
+	p.starting.Lock()
+	defer p.starting.Unlock()
+
+	done := make(chan error, 1)
 	p.io.emitter.On("disconnect", func(args []interface{}) {
 		p.emitter.EmitAsync("disconnect", p)
 	})
@@ -38,69 +70,281 @@ func (p *Peer) start() <-chan struct{} {
 		p.emitter.EmitAsync("error", p, args[0])
 	})
 
-	p.io.start()
-
+	// both loops are registered before the adapter is started,
+	// a loop is not started later on so stop can wait for all of them
+	ready := make(chan struct{})
 	p.awaiter.Go(func() {
-		close(done)
-		for {
-			select {
-			case m := <-p.io.receive:
-				p.processPipe(m, Receive)
-				continue
-			case m := <-p.send:
-				p.processPipe(m, Send)
-				continue
-			case <-p.awaiter.CancelRequested():
-				return
-			}
+		select {
+		case <-ready:
+			p.receiveLoop()
+		case <-p.awaiter.CancelRequested():
+		}
+	})
+	p.awaiter.Go(func() {
+		if err := p.connect(); err != nil {
+			done <- err
+			p.io.handleError(err, "connect")
+			p.stopInternal()
+			return
 		}
+
+		done <- nil
+		close(ready)
+		p.sendLoop()
 	})
 
+	p.io.start()
+
 	return done
 }
 
+// stopped returns true if the peer was stopped
+func (p *Peer) stopped() bool {
+	return p.awaiter.IsCancelRequested()
+}
+
+// receiveLoop is the worker for incoming messages
+func (p *Peer) receiveLoop() {
+	pl := newPipeline(p, Receive, p.config.concurrency)
+	for {
+		select {
+		case m := <-p.io.receive:
+			pl.dispatch(m)
+		case <-p.awaiter.CancelRequested():
+			pl.close()
+			return
+		}
+	}
+}
+
+// sendLoop is the worker for outgoing messages
+func (p *Peer) sendLoop() {
+	pl := newPipeline(p, Send, p.config.concurrency)
+	for {
+		select {
+		case <-p.send.Ready():
+			if m := p.send.pop(); m != nil {
+				pl.dispatch(m)
+			}
+		case <-p.awaiter.CancelRequested():
+			pl.close()
+			return
+		}
+	}
+}
+
+// connect calls OnConnect of all middlewares,
+// starting with the middleware closest to the network
+func (p *Peer) connect() error {
+	middleware := p.middleware.snapshot()
+	to := len(middleware)
+
+	for pos := to - 1; pos >= 0; pos-- {
+		if !p.lifecycle.connect(middleware[pos]) {
+			if p.stopped() {
+				return DisconnectedError
+			}
+
+			// already connected by NetworkConnection.Use
+			continue
+		}
+
+		pipe := newPipe(p, middleware, Connect, pos, pos, to)
+		if err := pipe.connect(middleware[pos]); err != nil {
+			return err
+		}
+		p.lifecycle.connectDone(middleware[pos].name)
+	}
+
+	p.lifecycle.start()
+	return nil
+}
+
+// connectMiddleware calls OnConnect of a middleware that was inserted while the peer is running.
+// The peer is disconnected if it fails
+func (p *Peer) connectMiddleware(name string) {
+	middleware := p.middleware.snapshot()
+	for pos, m := range middleware {
+		if m.name != name {
+			continue
+		}
+
+		if !p.lifecycle.connect(m) {
+			return
+		}
+
+		pipe := newPipe(p, middleware, Connect, pos, pos, len(middleware))
+		if err := pipe.connect(m); err != nil {
+			p.io.handleError(err, "connect")
+			p.stopInternal()
+			return
+		}
+		p.lifecycle.connectDone(name)
+		return
+	}
+}
+
+// disconnectMiddleware calls OnDisconnect of a middleware that was removed while the peer is running
+func (p *Peer) disconnectMiddleware(m *Middleware) {
+	if p.lifecycle.disconnect(m.name) {
+		m.handler.OnDisconnect(p)
+	}
+}
+
 func (p *Peer) processPipe(m *Message, op PipeOperation) {
-	from := 0
-	to := len(p.middleware)
-	pos := 0
 	if op == Receive {
-		pos = to
+		atomic.AddUint64(&p.stats.messagesReceived, 1)
+	}
+
+	if !p.admit(m, op) {
+		return
+	}
+
+	middleware := p.middleware.snapshot()
+	if p.runPipe(m, op, middleware, 0, len(middleware)) {
+		p.deliver(m, op)
+	}
+}
+
+// runPipe passes the message through the middlewares between from and to.
+// It returns false if the message was stopped or the pipe failed
+func (p *Peer) runPipe(m *Message, op PipeOperation, middleware middlewares, from int, to int) bool {
+	pos := from
+	if op == Receive {
+		pos = to - 1
 	}
 
-	pipe := newPipe(p, p.middleware, op, pos, from, to)
+	pipe := newPipe(p, middleware, op, pos, from, to)
 	err := pipe.process(m)
 
 	if err == ErrPipeStopProcessing {
-		return
+		return false
 	}
 
 	if err != nil {
 		p.io.handleError(err, "processPipe")
 		p.stopInternal()
+		return false
+	}
+
+	return true
+}
+
+// deliver emits a received message or writes a message that passed the send pipe.
+// The deadline is checked again because the message could have waited in the pipe
+// and a secure channel (see NoiseWith) replaces the unauthenticated deadline of a received message
+func (p *Peer) deliver(m *Message, op PipeOperation) {
+	if p.dropExpired(m, op) {
 		return
 	}
 
 	if op == Receive {
-		p.emitter.EmitAsync("message", p, m)
-	} else {
-		err := p.io.sendMsg(m)
-		if err != nil {
-			p.io.handleError(err, "processPipe")
-			p.stopInternal()
+		// control messages are never delivered to the application
+		if m.control != "" {
 			return
 		}
+
+		p.emitter.EmitAsync("message", p, m)
+		return
 	}
 
+	err := p.sendMsg(m)
+	if err != nil {
+		p.io.handleError(err, "processPipe")
+		p.stopInternal()
+		return
+	}
+
+	atomic.AddUint64(&p.stats.messagesSent, 1)
+}
+
+// admit returns false for messages that are dropped before the pipe
+func (p *Peer) admit(m *Message, op PipeOperation) bool {
+	if p.dropExpired(m, op) {
+		return false
+	}
+
+	return op != Receive || !p.unhandledControl(m)
+}
+
+// unhandledControl returns true for a control message that is addressed
+// to a middleware this peer does not use, these messages are dropped before the pipe
+// so a remote can announce a middleware to peers without it
+func (p *Peer) unhandledControl(m *Message) bool {
+	return m.control != "" && !p.middleware.contains(m.control)
+}
+
+// dropExpired returns true and updates the stats if the deadline of the message has passed
+func (p *Peer) dropExpired(m *Message, op PipeOperation) bool {
+	if !m.Expired() {
+		return false
+	}
+
+	if op == Send {
+		atomic.AddUint64(&p.stats.expiredSent, 1)
+	} else {
+		atomic.AddUint64(&p.stats.expiredReceived, 1)
+	}
+
+	return true
+}
+
+// enqueue adds the message to the send queue of the peer
+// it blocks while the queue for the message priority is full
+func (p *Peer) enqueue(m *Message) bool {
+	return p.send.push(m, p.awaiter.CancelRequested())
+}
+
+// tryEnqueue adds the message to the send queue of the peer without blocking,
+// it returns ErrPeerNotFound if the peer was stopped
+// and ErrSendQueueFull if the queue for the message priority is full
+func (p *Peer) tryEnqueue(m *Message) error {
+	if p.stopped() {
+		return ErrPeerNotFound
+	}
+
+	if !p.send.tryPush(m) {
+		return ErrSendQueueFull
+	}
+
+	return nil
+}
+
+// sendMsg stamps the local identity as origin (if not already set)
+// and pass the message to the adapter
+func (p *Peer) sendMsg(m *Message) error {
+	p.stampOrigin(m)
+
+	return p.io.sendMsg(m)
+}
+
+// stampOrigin sets the local identity as origin if the message has none
+func (p *Peer) stampOrigin(m *Message) {
+	if m.origin == "" {
+		m.origin = p.config.identity
+	}
 }
 
 func (p *Peer) stopInternal() {
-	p.io.adapter.Close()
 	p.io.awaiter.Cancel()
+	p.io.adapter.Close()
 	p.awaiter.Cancel()
+	p.disconnect.Do(func() {
+		for _, m := range p.lifecycle.close(p.middleware.snapshot()) {
+			m.handler.OnDisconnect(p)
+		}
+
+		p.state.clear()
+	})
 }
 
 func (p *Peer) stop() {
 	p.stopInternal()
+
+	// wait until start has registered all goroutines
+	p.starting.Lock()
+	p.starting.Unlock()
+
 	p.io.awaiter.AwaitSync()
 	p.awaiter.AwaitSync()
 }
@@ -115,6 +359,35 @@ func (p *Peer) LocalAddress() string {
 	return p.io.adapter.LocalAddress()
 }
 
+// Stats returns a snapshot of the traffic counters of this peer
+func (p *Peer) Stats() PeerStats {
+	return p.stats.snapshot()
+}
+
+// Principal returns the identity of the remote that was verified by
+// an authentication middleware (see Auth) or an empty string
+func (p *Peer) Principal() string {
+	principal, _ := p.principal.Load().(string)
+	return principal
+}
+
+func (p *Peer) setPrincipal(principal string) {
+	p.principal.Store(principal)
+}
+
+// ChannelBinding returns a value that identifies the secure channel of the connection
+// (the handshake hash of the Noise channel) or nil.
+// Both sides of a connection see the same value, a man in the middle can not create
+// two channels with the same value
+func (p *Peer) ChannelBinding() []byte {
+	binding, _ := p.binding.Load().([]byte)
+	return binding
+}
+
+func (p *Peer) setChannelBinding(binding []byte) {
+	p.binding.Store(binding)
+}
+
 // Metadata returns a map of metadata associated to this peer
 func (p *Peer) Metadata() maps.Map {
 	return p.metadata
@@ -0,0 +1,234 @@
+package go2p
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// pipeline processes the messages of one direction (Send or Receive) of a peer.
+//
+// Messages are processed one after another by the worker of the direction,
+// unless the concurrency of the NetworkConnection is greater than 1 and the middleware
+// stack contains order independent middlewares (see OrderIndependent).
+// Then each message is processed by its own goroutine (up to concurrency at once).
+// Order dependent middlewares and the delivery (write or message event) are guarded by gates
+// that admit the messages in the order they were dispatched,
+// so the order of the messages is kept for everything but the order independent middlewares
+type pipeline struct {
+	peer        *Peer
+	op          PipeOperation
+	concurrency int
+
+	slots    chan struct{}
+	inFlight *sync.WaitGroup
+	seq      uint64
+
+	middleware middlewares
+	segments   []pipelineSegment
+	delivery   *gate
+}
+
+// pipelineSegment is a range of middlewares that is executed in one pipe.
+// Segments of order dependent middlewares have a gate
+type pipelineSegment struct {
+	from int
+	to   int
+	gate *gate
+}
+
+func newPipeline(peer *Peer, op PipeOperation, concurrency int) *pipeline {
+	pl := new(pipeline)
+	pl.peer = peer
+	pl.op = op
+	pl.concurrency = concurrency
+	pl.inFlight = new(sync.WaitGroup)
+	if concurrency > 1 {
+		pl.slots = make(chan struct{}, concurrency)
+	}
+
+	return pl
+}
+
+// dispatch processes the message or starts its processing.
+// It must be called by a single worker goroutine
+func (pl *pipeline) dispatch(m *Message) {
+	middleware := pl.peer.middleware.snapshot()
+	if pl.concurrency <= 1 || !hasOrderIndependent(middleware) {
+		pl.drain()
+		pl.peer.processPipe(m, pl.op)
+		return
+	}
+
+	if pl.op == Receive {
+		atomic.AddUint64(&pl.peer.stats.messagesReceived, 1)
+	}
+
+	if !sameMiddlewares(pl.middleware, middleware) {
+		pl.drain()
+		pl.reset(middleware)
+	}
+
+	select {
+	case pl.slots <- struct{}{}:
+	case <-pl.peer.awaiter.CancelRequested():
+		return
+	}
+
+	seq := pl.seq
+	pl.seq++
+	pl.inFlight.Add(1)
+	go func() {
+		defer pl.inFlight.Done()
+		defer func() { <-pl.slots }()
+
+		pl.run(m, seq)
+	}()
+}
+
+// run passes the message through all segments and delivers it
+func (pl *pipeline) run(m *Message, seq uint64) {
+	deliver := pl.peer.admit(m, pl.op)
+
+	for _, segment := range pl.segments {
+		if segment.gate != nil && !segment.gate.enter(seq) {
+			return
+		}
+
+		if deliver {
+			deliver = pl.peer.runPipe(m, pl.op, pl.middleware, segment.from, segment.to)
+		}
+
+		if segment.gate != nil {
+			segment.gate.leave()
+		}
+	}
+
+	if !pl.delivery.enter(seq) {
+		return
+	}
+
+	if deliver {
+		pl.peer.deliver(m, pl.op)
+	}
+
+	pl.delivery.leave()
+}
+
+// reset creates the segments and gates for a new middleware snapshot
+func (pl *pipeline) reset(middleware middlewares) {
+	pl.middleware = middleware
+	pl.segments = nil
+	pl.delivery = newGate()
+	pl.seq = 0
+
+	order := make([]int, len(middleware))
+	for i := range order {
+		order[i] = i
+		if pl.op == Receive {
+			order[i] = len(middleware) - 1 - i
+		}
+	}
+
+	for _, idx := range order {
+		independent := middleware[idx].orderIndependent
+		last := len(pl.segments) - 1
+		if last >= 0 && (pl.segments[last].gate == nil) == independent {
+			if idx < pl.segments[last].from {
+				pl.segments[last].from = idx
+			} else {
+				pl.segments[last].to = idx + 1
+			}
+			continue
+		}
+
+		segment := pipelineSegment{from: idx, to: idx + 1}
+		if !independent {
+			segment.gate = newGate()
+		}
+		pl.segments = append(pl.segments, segment)
+	}
+}
+
+// drain waits until all started messages are processed
+func (pl *pipeline) drain() {
+	pl.inFlight.Wait()
+}
+
+// close releases all goroutines that are waiting at a gate and waits until they are done
+func (pl *pipeline) close() {
+	for _, segment := range pl.segments {
+		if segment.gate != nil {
+			segment.gate.close()
+		}
+	}
+	if pl.delivery != nil {
+		pl.delivery.close()
+	}
+
+	pl.drain()
+}
+
+func hasOrderIndependent(middleware middlewares) bool {
+	for _, m := range middleware {
+		if m.orderIndependent {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameMiddlewares returns true if both are the same snapshot of a middlewareChain
+func sameMiddlewares(a middlewares, b middlewares) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	return len(a) == 0 || &a[0] == &b[0]
+}
+
+// gate admits the holder of one sequence number after another
+type gate struct {
+	mutex  *sync.Mutex
+	cond   *sync.Cond
+	next   uint64
+	closed bool
+}
+
+func newGate() *gate {
+	g := new(gate)
+	g.mutex = new(sync.Mutex)
+	g.cond = sync.NewCond(g.mutex)
+
+	return g
+}
+
+// enter blocks until all lower sequence numbers have left the gate.
+// It returns false if the gate was closed
+func (g *gate) enter(seq uint64) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for g.next != seq && !g.closed {
+		g.cond.Wait()
+	}
+
+	return !g.closed
+}
+
+// leave admits the next sequence number
+func (g *gate) leave() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.next++
+	g.cond.Broadcast()
+}
+
+func (g *gate) close() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.closed = true
+	g.cond.Broadcast()
+}
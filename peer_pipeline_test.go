@@ -0,0 +1,185 @@
+package go2p
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingMiddleware records the payloads of the messages it sees
+type recordingMiddleware struct {
+	mutex *sync.Mutex
+	seen  []string
+}
+
+func newRecordingMiddleware() *recordingMiddleware {
+	return &recordingMiddleware{mutex: new(sync.Mutex)}
+}
+
+func (r *recordingMiddleware) record(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.seen = append(r.seen, msg.PayloadGetString())
+	return Next, nil
+}
+
+func (r *recordingMiddleware) payloads() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string{}, r.seen...)
+}
+
+func slowMiddleware(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+	time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+	return Next, nil
+}
+
+func numberedPayloads(count int) []string {
+	result := make([]string, count)
+	for i := range result {
+		result[i] = strconv.Itoa(i)
+	}
+
+	return result
+}
+
+func TestPipelineKeepsOrder(t *testing.T) {
+	for _, op := range []PipeOperation{Send, Receive} {
+		before := newRecordingMiddleware()
+		after := newRecordingMiddleware()
+		chain := newMiddlewareChain(
+			NewMiddleware("before", before.record),
+			NewMiddlewareHandler(OrderIndependent("slow", MiddlewareFunc(slowMiddleware))),
+			NewMiddleware("after", after.record),
+		)
+
+		p := newPeer(new(MockAdapter), chain, &peerConfig{})
+		p.io.send = make(chan *Message, 100)
+
+		pl := newPipeline(p, op, 8)
+		expected := numberedPayloads(100)
+		for _, payload := range expected {
+			pl.dispatch(NewMessageFromString(payload))
+		}
+		pl.drain()
+
+		assert.Equal(t, expected, before.payloads())
+		assert.Equal(t, expected, after.payloads())
+
+		if op == Send {
+			close(p.io.send)
+			sent := []string{}
+			for m := range p.io.send {
+				sent = append(sent, m.PayloadGetString())
+			}
+			assert.Equal(t, expected, sent)
+		}
+	}
+}
+
+func TestPipelineConcurrency(t *testing.T) {
+	mutex := new(sync.Mutex)
+	running, maxRunning := 0, 0
+	counting := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return Next, nil
+	}
+
+	chain := newMiddlewareChain(NewMiddlewareHandler(OrderIndependent("counting", MiddlewareFunc(counting))))
+	p := newPeer(new(MockAdapter), chain, &peerConfig{})
+	p.io.send = make(chan *Message, 20)
+
+	pl := newPipeline(p, Send, 4)
+	for i := 0; i < 20; i++ {
+		pl.dispatch(NewMessageFromString("msg"))
+	}
+	pl.drain()
+
+	assert.True(t, maxRunning > 1)
+	assert.True(t, maxRunning <= 4)
+	assert.Equal(t, uint64(20), p.Stats().MessagesSent)
+}
+
+func TestPipelineSequentialWithoutOrderIndependent(t *testing.T) {
+	recorder := newRecordingMiddleware()
+	chain := newMiddlewareChain(NewMiddleware("slow", slowMiddleware), NewMiddleware("record", recorder.record))
+	p := newPeer(new(MockAdapter), chain, &peerConfig{})
+	p.io.send = make(chan *Message, 10)
+
+	pl := newPipeline(p, Send, 4)
+	expected := numberedPayloads(10)
+	for _, payload := range expected {
+		pl.dispatch(NewMessageFromString(payload))
+	}
+
+	assert.Nil(t, pl.segments)
+	assert.Equal(t, expected, recorder.payloads())
+}
+
+func TestPeerSlowReceiveDoesNotBlockSend(t *testing.T) {
+	release := make(chan struct{})
+	blocking := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		if pipe.Operation() == Receive {
+			<-release
+		}
+		return Next, nil
+	}
+
+	adapter := new(MockAdapter)
+	adapter.On("Close").Return()
+	p := newPeer(adapter, newMiddlewareChain(NewMiddleware("blocking", blocking)), &peerConfig{})
+	p.io.receive = make(chan *Message, 1)
+	p.io.send = make(chan *Message, 1)
+
+	p.awaiter.Go(p.receiveLoop)
+	p.awaiter.Go(p.sendLoop)
+
+	p.io.receive <- NewMessageFromString("slow")
+	assert.True(t, p.enqueue(NewMessageFromString("fast")))
+
+	select {
+	case m := <-p.io.send:
+		assert.Equal(t, "fast", m.PayloadGetString())
+	case <-time.After(time.Second):
+		assert.Fail(t, "send was blocked by the receive pipe")
+	}
+
+	close(release)
+	p.stop()
+}
+
+func TestPipelineDropsUnhandledControl(t *testing.T) {
+	record := newRecordingMiddleware()
+	chain := newMiddlewareChain(
+		NewMiddleware("record", record.record),
+		NewMiddlewareHandler(OrderIndependent("slow", MiddlewareFunc(slowMiddleware))),
+	)
+	p := newPeer(new(MockAdapter), chain, &peerConfig{})
+
+	hello := NewMessageFromString("hello")
+	hello.control = compressName
+
+	pl := newPipeline(p, Receive, 4)
+	pl.dispatch(hello)
+	pl.dispatch(NewMessageFromString("message"))
+	pl.drain()
+
+	assert.Equal(t, []string{"message"}, record.payloads())
+}
@@ -0,0 +1,251 @@
+package go2p
+
+import "sync"
+
+// PeerState is a typed storage slot that holds one value per peer.
+//
+// Each PeerState instance is its own key, so middlewares can keep per peer state
+// isolated from other middlewares and from the application data in Peer.Metadata().
+// Create one instance per middleware instance and keep it unexported
+type PeerState[T any] struct {
+	owner   string
+	init    func(peer *Peer) T
+	cleanup func(peer *Peer, value T)
+}
+
+// NewPeerState creates a new state slot owned by the middleware with the given name.
+//
+// The optional init function creates the value on the first access for a peer,
+// without it the zero value of T is used.
+// The optional cleanup function is called with the stored value when the peer is stopped
+func NewPeerState[T any](owner string, init func(peer *Peer) T, cleanup func(peer *Peer, value T)) *PeerState[T] {
+	s := new(PeerState[T])
+	s.owner = owner
+	s.init = init
+	s.cleanup = cleanup
+
+	return s
+}
+
+// Owner returns the name of the middleware that owns this state
+func (s *PeerState[T]) Owner() string {
+	return s.owner
+}
+
+// Get returns the value for the given peer.
+// If there is no value it will be created by the init function
+func (s *PeerState[T]) Get(peer *Peer) T {
+	if value, found := s.Lookup(peer); found {
+		return value
+	}
+
+	var value T
+	if s.init != nil {
+		value = s.init(peer)
+	}
+
+	stored := peer.state.putIfAbsent(s, s.newEntry(peer, value))
+	return stored.value.(T)
+}
+
+// Lookup returns the value for the given peer and true
+// or the zero value and false if no value is stored
+func (s *PeerState[T]) Lookup(peer *Peer) (T, bool) {
+	entry, found := peer.state.get(s)
+	if !found {
+		var zero T
+		return zero, false
+	}
+
+	return entry.value.(T), true
+}
+
+// Set stores the value for the given peer.
+// A previous value is replaced without calling the cleanup function
+func (s *PeerState[T]) Set(peer *Peer, value T) {
+	peer.state.put(s, s.newEntry(peer, value))
+}
+
+// Delete removes the value of the given peer without calling the cleanup function
+func (s *PeerState[T]) Delete(peer *Peer) {
+	peer.state.delete(s)
+}
+
+func (s *PeerState[T]) newEntry(peer *Peer, value T) *peerStateEntry {
+	entry := &peerStateEntry{value: value}
+	if s.cleanup != nil {
+		entry.cleanup = func() {
+			s.cleanup(peer, value)
+		}
+	}
+
+	return entry
+}
+
+// peerLifecycle tracks the middlewares whose OnConnect was called for a peer,
+// so each of them gets exactly one OnDisconnect even if the chain changes while the peer runs.
+// After the peer was connected, middlewares whose OnConnect has not finished yet
+// (added by NetworkConnection.Use) are skipped by the pipes of the peer
+type peerLifecycle struct {
+	mutex     *sync.RWMutex
+	closed    bool
+	started   bool
+	connected map[string]*Middleware
+	ready     map[string]bool
+}
+
+func newPeerLifecycle() *peerLifecycle {
+	l := new(peerLifecycle)
+	l.mutex = new(sync.RWMutex)
+	l.connected = make(map[string]*Middleware)
+	l.ready = make(map[string]bool)
+
+	return l
+}
+
+// connect marks the middleware as connected,
+// it returns false if it was already connected or the peer was closed
+func (l *peerLifecycle) connect(m *Middleware) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, found := l.connected[m.name]; found || l.closed {
+		return false
+	}
+
+	l.connected[m.name] = m
+	return true
+}
+
+// connectDone marks that OnConnect of the middleware has finished
+func (l *peerLifecycle) connectDone(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, found := l.connected[name]; found {
+		l.ready[name] = true
+	}
+}
+
+// start marks that all middlewares of the peer were connected,
+// from now on middlewares that are not ready are skipped
+func (l *peerLifecycle) start() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.started = true
+}
+
+// admits returns false for a middleware that was added to a started peer
+// and whose OnConnect has not finished yet
+func (l *peerLifecycle) admits(name string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return !l.started || l.ready[name]
+}
+
+// disconnect removes the mark of the middleware,
+// it returns false if it was not connected
+func (l *peerLifecycle) disconnect(name string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, found := l.connected[name]; !found {
+		return false
+	}
+
+	delete(l.connected, name)
+	delete(l.ready, name)
+	return true
+}
+
+// close prevents further connects and returns all connected middlewares,
+// in the order of the given chain followed by the ones that are no longer part of it
+func (l *peerLifecycle) close(chain middlewares) []*Middleware {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.closed = true
+	result := []*Middleware{}
+	for _, m := range chain {
+		if _, found := l.connected[m.name]; found {
+			result = append(result, l.connected[m.name])
+			delete(l.connected, m.name)
+		}
+	}
+	for _, m := range l.connected {
+		result = append(result, m)
+	}
+	l.connected = make(map[string]*Middleware)
+	l.ready = make(map[string]bool)
+
+	return result
+}
+
+type peerStateEntry struct {
+	value   interface{}
+	cleanup func()
+}
+
+// peerStateStore holds the PeerState values of a single peer
+type peerStateStore struct {
+	mutex   *sync.Mutex
+	entries map[interface{}]*peerStateEntry
+}
+
+func newPeerStateStore() *peerStateStore {
+	s := new(peerStateStore)
+	s.mutex = new(sync.Mutex)
+	s.entries = make(map[interface{}]*peerStateEntry)
+
+	return s
+}
+
+func (s *peerStateStore) get(key interface{}) (*peerStateEntry, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, found := s.entries[key]
+	return entry, found
+}
+
+func (s *peerStateStore) put(key interface{}, entry *peerStateEntry) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.entries[key] = entry
+}
+
+func (s *peerStateStore) putIfAbsent(key interface{}, entry *peerStateEntry) *peerStateEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, found := s.entries[key]; found {
+		return existing
+	}
+
+	s.entries[key] = entry
+	return entry
+}
+
+func (s *peerStateStore) delete(key interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.entries, key)
+}
+
+// clear removes all values and calls their cleanup functions
+func (s *peerStateStore) clear() {
+	s.mutex.Lock()
+	entries := s.entries
+	s.entries = make(map[interface{}]*peerStateEntry)
+	s.mutex.Unlock()
+
+	for _, entry := range entries {
+		if entry.cleanup != nil {
+			entry.cleanup()
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package go2p
+
+import "sync/atomic"
+
+// PeerStats contains traffic counters of a peer
+type PeerStats struct {
+	// MessagesSent is the number of messages written to the peer
+	MessagesSent uint64
+	// MessagesReceived is the number of messages read from the peer
+	MessagesReceived uint64
+	// ExpiredSent is the number of outgoing messages dropped because their deadline passed
+	ExpiredSent uint64
+	// ExpiredReceived is the number of incoming messages discarded because their deadline passed
+	ExpiredReceived uint64
+}
+
+type peerStats struct {
+	messagesSent     uint64
+	messagesReceived uint64
+	expiredSent      uint64
+	expiredReceived  uint64
+}
+
+func (s *peerStats) snapshot() PeerStats {
+	return PeerStats{
+		MessagesSent:     atomic.LoadUint64(&s.messagesSent),
+		MessagesReceived: atomic.LoadUint64(&s.messagesReceived),
+		ExpiredSent:      atomic.LoadUint64(&s.expiredSent),
+		ExpiredReceived:  atomic.LoadUint64(&s.expiredReceived),
+	}
+}
@@ -0,0 +1,81 @@
+package go2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerDropExpired(t *testing.T) {
+	p := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+
+	expired := NewMessageFromString("too late")
+	expired.SetDeadline(time.Now().Add(-time.Second))
+
+	p.processPipe(expired, Send)
+	p.processPipe(expired, Receive)
+
+	stats := p.Stats()
+	assert.Equal(t, uint64(1), stats.ExpiredSent)
+	assert.Equal(t, uint64(1), stats.ExpiredReceived)
+	assert.Equal(t, uint64(1), stats.MessagesReceived)
+	assert.Equal(t, uint64(0), stats.MessagesSent)
+}
+
+func TestPeerDropExpiredAfterPipe(t *testing.T) {
+	// a middleware restores the sealed deadline that was stripped from the outer envelope
+	restore := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		msg.SetDeadline(time.Now().Add(-time.Second))
+		return Next, nil
+	}
+	p := newPeer(new(MockAdapter), newMiddlewareChain(NewMiddleware("restore", restore)), &peerConfig{})
+
+	delivered := make(chan *Message, 1)
+	p.emitter.On("message", func(args []interface{}) {
+		delivered <- args[1].(*Message)
+	})
+
+	p.processPipe(NewMessageFromString("too late"), Receive)
+
+	select {
+	case <-delivered:
+		assert.Fail(t, "expired message delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, uint64(1), p.Stats().ExpiredReceived)
+}
+
+func TestPeerState(t *testing.T) {
+	adapter := new(MockAdapter)
+	adapter.On("Close").Return()
+	p := newPeer(adapter, newMiddlewareChain(), &peerConfig{})
+
+	cleaned := []int{}
+	counter := NewPeerState("counter", func(peer *Peer) int {
+		return 10
+	}, func(peer *Peer, value int) {
+		cleaned = append(cleaned, value)
+	})
+	other := NewPeerState[int]("other", nil, nil)
+
+	_, found := counter.Lookup(p)
+	assert.False(t, found)
+	assert.Equal(t, 10, counter.Get(p))
+
+	counter.Set(p, 11)
+	assert.Equal(t, 11, counter.Get(p))
+	assert.Equal(t, 0, other.Get(p))
+	assert.Equal(t, "counter", counter.Owner())
+
+	other.Set(p, 1)
+	other.Delete(p)
+	_, found = other.Lookup(p)
+	assert.False(t, found)
+
+	p.stopInternal()
+	assert.Equal(t, []int{11}, cleaned)
+
+	_, found = counter.Lookup(p)
+	assert.False(t, found)
+}
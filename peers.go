@@ -49,24 +49,34 @@ func (p *peers) rm(peer *Peer) {
 
 // IteratePeer will call the given handler for each peer
 func (p *peers) iteratePeer(handler func(peer *Peer)) {
-	p.mutex.Lock()
-	peersCopy := make([]*Peer, len(p.peers))
-	copy(peersCopy, p.peers)
-	p.mutex.Unlock()
-
-	for _, p := range peersCopy {
+	for _, p := range p.list() {
 		handler(p)
 	}
 }
 
-func (p *peers) lock(addr string, handler func(peer *Peer)) {
+// list returns a copy of the current peers
+func (p *peers) list() []*Peer {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	result := make([]*Peer, len(p.peers))
+	copy(result, p.peers)
+
+	return result
+}
+
+// find returns the peer with the given remote address.
+// The lock is released before the peer is returned, so callers can block
+// on the peer (or call back into the NetworkConnection) without a deadlock
+func (p *peers) find(addr string) *Peer {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
 	for _, p := range p.peers {
 		if p.io.adapter.RemoteAddress() == addr {
-			handler(p)
-			return
+			return p
 		}
 	}
+
+	return nil
 }
@@ -1,8 +1,10 @@
 package go2p
 
 import (
-	"errors"
+	"runtime/debug"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -14,10 +16,12 @@ const (
 	Send PipeOperation = iota
 	// Receive represents an incoming message pipe processing
 	Receive PipeOperation = iota
+	// Connect represents the pipe passed to MiddlewareHandler.OnConnect
+	Connect PipeOperation = iota
 )
 
 func (po PipeOperation) String() string {
-	return [...]string{"Send", "Receive"}[po]
+	return [...]string{"Send", "Receive", "Connect"}[po]
 }
 
 // ErrPipeStopProcessing is returned when the pipe has stopped it execution
@@ -53,6 +57,12 @@ func (p *Pipe) process(msg *Message) error {
 	nextItems := p.executingActions.nextItems(p.op)
 
 	for _, m := range nextItems {
+		if p.peer != nil && !p.peer.lifecycle.admits(m.name) {
+			// OnConnect of a middleware added by NetworkConnection.Use has not finished for this peer
+			p.advance()
+			continue
+		}
+
 		p.log.WithFields(logrus.Fields{
 			"name":    m.name,
 			"pos":     m.pos,
@@ -60,30 +70,173 @@ func (p *Pipe) process(msg *Message) error {
 			"op":      p.op.String(),
 		}).Debug("execute middleware")
 
-		res, err := m.execute(p.peer, p, msg)
+		res, err := p.execute(m, msg)
 		if err != nil {
+			mwErr := newMiddlewareError(m, p.op, err)
+			action := p.decide(mwErr)
+
 			p.log.WithFields(logrus.Fields{
 				"name":    m.name,
 				"pos":     m.pos,
 				"msg-len": len(msg.PayloadGet()),
 				"err":     err,
+				"action":  action.String(),
 			}).Error("middleware error")
-			return err
-		} else if res == Stop {
+
+			switch action {
+			case ErrorContinue:
+				p.reportError(mwErr)
+				res = Next
+			case ErrorDrop:
+				p.reportError(mwErr)
+				return ErrPipeStopProcessing
+			default:
+				return mwErr
+			}
+		}
+
+		if res == Stop {
 			return ErrPipeStopProcessing
 		}
 
-		if p.op == Send {
-			p.pos++
-		} else {
-			p.pos--
+		p.advance()
+	}
+
+	return nil
+}
+
+// advance moves the position to the next middleware in the direction of the pipe
+func (p *Pipe) advance() {
+	if p.op == Send {
+		p.pos++
+	} else {
+		p.pos--
+	}
+}
+
+// execute runs the middleware and converts a panic into a MiddlewareError
+func (p *Pipe) execute(m *Middleware, msg *Message) (res MiddlewareResult, err error) {
+	if metrics := p.metrics(); metrics != nil {
+		start := time.Now()
+		defer func() {
+			metrics.ObserveMiddleware(m.name, p.op, outcomeOf(res, err), time.Since(start))
+		}()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			p.log.WithFields(logrus.Fields{
+				"name":  m.name,
+				"pos":   m.pos,
+				"op":    p.op.String(),
+				"stack": string(debug.Stack()),
+			}).Errorf("middleware panic: %v", r)
+
+			res = Stop
+			err = &MiddlewareError{Name: m.name, Op: p.op, Err: errors.Errorf("%v", r), Panic: true}
+		}
+	}()
+
+	return m.execute(p.peer, p, msg)
+}
+
+// decide runs the error policy and converts a panic
+// or an unknown action into ErrorDisconnect
+func (p *Pipe) decide(err *MiddlewareError) (action ErrorAction) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.log.WithFields(logrus.Fields{
+				"name":  err.Name,
+				"op":    p.op.String(),
+				"stack": string(debug.Stack()),
+			}).Errorf("error policy panic: %v", r)
+
+			action = ErrorDisconnect
+		}
+	}()
+
+	action = p.errorPolicy()(err)
+	if !action.valid() {
+		p.log.WithFields(logrus.Fields{
+			"name":   err.Name,
+			"op":     p.op.String(),
+			"action": action.String(),
+		}).Error("unknown error policy action")
+
+		return ErrorDisconnect
+	}
+
+	return action
+}
+
+// connect runs the OnConnect handler of the middleware
+// and converts an error or a panic into a MiddlewareError
+func (p *Pipe) connect(m *Middleware) (err error) {
+	if metrics := p.metrics(); metrics != nil {
+		start := time.Now()
+		defer func() {
+			metrics.ObserveMiddleware(m.name, Connect, outcomeOf(Next, err), time.Since(start))
+		}()
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = &MiddlewareError{Name: m.name, Op: Connect, Err: errors.Errorf("%v", r), Panic: true}
 		}
+	}()
 
+	if err := m.handler.OnConnect(p.peer, p); err != nil {
+		return newMiddlewareError(m, Connect, err)
 	}
 
 	return nil
 }
 
+func newMiddlewareError(m *Middleware, op PipeOperation, err error) *MiddlewareError {
+	if mwErr, ok := err.(*MiddlewareError); ok {
+		return mwErr
+	}
+
+	return &MiddlewareError{Name: m.name, Op: op, Err: err}
+}
+
+func outcomeOf(res MiddlewareResult, err error) MiddlewareOutcome {
+	if mwErr, ok := err.(*MiddlewareError); ok && mwErr.Panic {
+		return OutcomePanic
+	} else if err != nil {
+		return OutcomeError
+	} else if res == Stop {
+		return OutcomeStop
+	}
+
+	return OutcomeNext
+}
+
+func (p *Pipe) metrics() Metrics {
+	if p.peer == nil {
+		return nil
+	}
+
+	return p.peer.config.metrics
+}
+
+func (p *Pipe) errorPolicy() ErrorPolicy {
+	if p.peer == nil || p.peer.config.errorPolicy == nil {
+		return DefaultErrorPolicy
+	}
+
+	return p.peer.config.errorPolicy
+}
+
+// reportError emits the error without disconnecting the peer
+func (p *Pipe) reportError(err *MiddlewareError) {
+	if p.peer == nil {
+		return
+	}
+
+	p.peer.emitter.EmitAsync("middleware-error", p.peer, err)
+}
+
 // Send will send the provided message during the current pipe execution.
 //
 // The message goes only through middlewares that are after the current pipe position
@@ -93,7 +246,7 @@ func (p *Pipe) Send(msg *Message) error {
 	to := len(p.allActions)
 
 	if pos > to {
-		err := p.peer.io.sendMsg(msg)
+		err := p.peer.sendMsg(msg)
 		return err
 	}
 
@@ -103,34 +256,55 @@ func (p *Pipe) Send(msg *Message) error {
 		return err
 	}
 
-	err := p.peer.io.sendMsg(msg)
+	err := p.peer.sendMsg(msg)
 	return err
 }
 
 // Receive will block the current call until a message was read from the peer or
 // an error occurs.
 //
-// The message goes only through middlewares that are after the current pipe position
+// The message goes only through middlewares that are after the current pipe position.
+// Messages that are stopped by one of them are skipped
 func (p *Pipe) Receive() (*Message, error) {
-	msg, err := p.peer.io.receiveMsg()
-	if err == nil && msg == nil {
-		panic("unexpected nil result from peer.receive")
-	} else if err != nil {
-		return nil, err
-	} else {
-		pos := p.pos + 1
+	for {
+		msg, err := p.peer.io.receiveMsg()
+		if err == nil && msg == nil {
+			panic("unexpected nil result from peer.receive")
+		} else if err != nil {
+			return nil, err
+		}
+
+		if p.peer.unhandledControl(msg) {
+			continue
+		}
+
 		from := p.pos + 1
 		to := len(p.allActions)
-		if pos <= to {
-			subPipe := newPipe(p.peer, p.allActions, Receive, pos, from, to)
+		if from < to {
+			subPipe := newPipe(p.peer, p.allActions, Receive, to-1, from, to)
 			err = subPipe.process(msg)
 		}
-	}
 
-	return msg, err
+		if err == ErrPipeStopProcessing {
+			continue
+		}
+
+		return msg, err
+	}
 }
 
 // Operation returns the current pipe operation (Send or Receive)
 func (p *Pipe) Operation() PipeOperation {
 	return p.op
 }
+
+// Network returns a handle to the NetworkConnection of the peer,
+// to send messages to other peers from a middleware (see NetworkHandle).
+// It returns nil if the peer does not belong to a NetworkConnection
+func (p *Pipe) Network() *NetworkHandle {
+	if p.peer == nil || p.peer.network == nil {
+		return nil
+	}
+
+	return &NetworkHandle{nc: p.peer.network, peer: p.peer}
+}
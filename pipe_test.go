@@ -17,3 +17,137 @@ func TestMiddlewareError(t *testing.T) {
 	err := p.process(NewMessage())
 	assert.Error(t, err)
 }
+
+func TestMiddlewarePanic(t *testing.T) {
+	f := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		var data []byte
+		_ = data[8]
+		return Next, nil
+	}
+
+	p := newPipe(nil, newMiddlewares(NewMiddleware("panic", f)), Receive, 0, 0, 1)
+	err := p.process(NewMessage())
+	if assert.IsType(t, &MiddlewareError{}, err) {
+		mwErr := err.(*MiddlewareError)
+		assert.True(t, mwErr.Panic)
+		assert.Equal(t, "panic", mwErr.Name)
+		assert.Equal(t, Receive, mwErr.Op)
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	failErr := errors.New("fail")
+	executed := []string{}
+	fail := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		executed = append(executed, "fail")
+		return Stop, failErr
+	}
+	next := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		executed = append(executed, "next")
+		return Next, nil
+	}
+
+	process := func(policy ErrorPolicy) error {
+		executed = []string{}
+		peer := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{errorPolicy: policy})
+		p := newPipe(peer, newMiddlewares(NewMiddleware("fail", fail), NewMiddleware("next", next)), Send, 0, 0, 2)
+		return p.process(NewMessage())
+	}
+
+	err := process(nil)
+	assert.Equal(t, failErr, errors.Cause(err))
+	assert.Equal(t, []string{"fail"}, executed)
+
+	err = process(PolicyForMiddleware("fail", ErrorDrop, DefaultErrorPolicy))
+	assert.Equal(t, ErrPipeStopProcessing, err)
+	assert.Equal(t, []string{"fail"}, executed)
+
+	err = process(PolicyForError(func(cause error) bool {
+		return cause == failErr
+	}, ErrorContinue, DefaultErrorPolicy))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fail", "next"}, executed)
+
+	err = process(PolicyForMiddleware("other", ErrorContinue, DefaultErrorPolicy))
+	assert.IsType(t, &MiddlewareError{}, err)
+}
+
+func TestErrorPolicyInvalid(t *testing.T) {
+	fail := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		return Stop, errors.New("fail")
+	}
+
+	process := func(policy ErrorPolicy) error {
+		peer := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{errorPolicy: policy})
+		p := newPipe(peer, newMiddlewares(NewMiddleware("fail", fail)), Send, 0, 0, 1)
+		return p.process(NewMessage())
+	}
+
+	assert.Equal(t, "Unknown", ErrorAction(42).String())
+
+	err := process(func(err *MiddlewareError) ErrorAction {
+		return ErrorAction(42)
+	})
+	assert.IsType(t, &MiddlewareError{}, err)
+
+	err = process(func(err *MiddlewareError) ErrorAction {
+		panic("policy")
+	})
+	assert.IsType(t, &MiddlewareError{}, err)
+}
+
+func TestPipeSendDuringReceive(t *testing.T) {
+	peer := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+	peer.io.send = make(chan *Message, 1)
+
+	executed := []string{}
+	reply := func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+		if pipe.Operation() == Receive {
+			executed = append(executed, "reply-receive")
+			return Stop, pipe.Send(NewMessageFromString("reply"))
+		}
+		return Next, nil
+	}
+	record := func(name string) MiddlewareFunc {
+		return func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+			executed = append(executed, name+"-"+pipe.Operation().String())
+			return Next, nil
+		}
+	}
+
+	mws := newMiddlewares(NewMiddleware("reply", reply), NewMiddleware("first", record("first")), NewMiddleware("second", record("second")))
+	p := newPipe(peer, mws, Receive, len(mws)-1, 0, len(mws))
+	err := p.process(NewMessageFromString("request"))
+
+	assert.Equal(t, ErrPipeStopProcessing, err)
+	assert.Equal(t, []string{"second-Receive", "first-Receive", "reply-receive", "first-Send", "second-Send"}, executed)
+	assert.Equal(t, "reply", (<-peer.io.send).PayloadGetString())
+}
+
+func TestPipeSkipsMiddlewareBeforeConnect(t *testing.T) {
+	executed := []string{}
+	record := func(name string) MiddlewareFunc {
+		return func(peer *Peer, pipe *Pipe, msg *Message) (MiddlewareResult, error) {
+			executed = append(executed, name)
+			return Next, nil
+		}
+	}
+
+	mws := newMiddlewares(NewMiddleware("first", record("first")), NewMiddleware("late", record("late")))
+	peer := newPeer(new(MockAdapter), newMiddlewareChain(), &peerConfig{})
+	peer.lifecycle.connect(mws[0])
+	peer.lifecycle.connectDone("first")
+	peer.lifecycle.start()
+
+	// OnConnect of "late" is still running
+	peer.lifecycle.connect(mws[1])
+	err := newPipe(peer, mws, Send, 0, 0, len(mws)).process(NewMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first"}, executed)
+
+	executed = []string{}
+	peer.lifecycle.connectDone("late")
+	err = newPipe(peer, mws, Send, 0, 0, len(mws)).process(NewMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first", "late"}, executed)
+}
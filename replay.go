@@ -0,0 +1,220 @@
+package go2p
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReplayConfig selects the records of a capture file that are replayed and their timing
+type ReplayConfig struct {
+	// Kind selects frames (replayed through all middlewares) or decoded messages
+	// (replayed through the middlewares that were above the capture middleware)
+	Kind CaptureKind
+	// Peer replays only the records of the peer with this remote address, empty replays all
+	Peer string
+	// Speed is the factor of the replay speed: 1 (or 0) keeps the original timing,
+	// 10 replays ten times faster
+	Speed float64
+	// NoDelay replays all records without waiting
+	NoDelay bool
+}
+
+var _ Adapter = (*ReplayAdapter)(nil)
+
+// ReplayAdapter is an Adapter that feeds the received records of a capture file
+// into a NetworkConnection, see NewReplayOperator.
+//
+// Frames of a session that used Noise or Crypt can not be decrypted again because the session keys
+// were negotiated with the original peer, capture the decoded messages above the channel instead
+// and replay them into a NetworkConnection with the middlewares above the capture position
+type ReplayAdapter struct {
+	config   ReplayConfig
+	records  []*CaptureRecord
+	remote   string
+	position int
+	start    time.Time
+
+	mutex  *sync.Mutex
+	sent   []*Message
+	closed chan struct{}
+	done   chan struct{}
+	once   *sync.Once
+}
+
+// NewReplayAdapter creates an adapter that replays the received records of the capture file
+func NewReplayAdapter(path string, config ReplayConfig) (*ReplayAdapter, error) {
+	records, err := ReadCapture(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return newReplayAdapter(records, config), nil
+}
+
+func newReplayAdapter(records []*CaptureRecord, config ReplayConfig) *ReplayAdapter {
+	if config.Kind == "" {
+		config.Kind = CaptureMessage
+	}
+	if config.Speed <= 0 {
+		config.Speed = 1
+	}
+
+	a := new(ReplayAdapter)
+	a.config = config
+	a.remote = "replay:" + config.Peer
+	a.mutex = new(sync.Mutex)
+	a.closed = make(chan struct{})
+	a.done = make(chan struct{})
+	a.once = new(sync.Once)
+
+	for _, record := range records {
+		if record.Kind != config.Kind || record.Direction != "receive" {
+			continue
+		}
+		if config.Peer != "" && record.Peer != config.Peer {
+			continue
+		}
+
+		a.records = append(a.records, record)
+	}
+
+	if len(a.records) == 0 {
+		close(a.done)
+	}
+
+	return a
+}
+
+// ReadMessage returns the next record at its (scaled) time after the first record.
+// After the last record the call blocks until the adapter is closed
+func (a *ReplayAdapter) ReadMessage() (*Message, error) {
+	if a.position >= len(a.records) {
+		<-a.closed
+		return nil, DisconnectedError
+	}
+
+	record := a.records[a.position]
+	if a.position == 0 {
+		a.start = time.Now()
+	} else if !a.config.NoDelay {
+		offset := record.Time.Sub(a.records[0].Time)
+		wait := time.Until(a.start.Add(time.Duration(float64(offset) / a.config.Speed)))
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-a.closed:
+				timer.Stop()
+				return nil, DisconnectedError
+			}
+		}
+	}
+
+	m, err := record.Decode()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not replay record %d", a.position+1)
+	}
+
+	// keep the remaining time to live of the original message
+	if !m.deadline.IsZero() {
+		m.deadline = m.deadline.Add(time.Since(record.Time))
+	}
+
+	a.position++
+	if a.position == len(a.records) {
+		close(a.done)
+	}
+
+	return m, nil
+}
+
+// WriteMessage records the message, see Sent
+func (a *ReplayAdapter) WriteMessage(m *Message) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.sent = append(a.sent, m)
+	return nil
+}
+
+// Sent returns the messages that were sent to the replayed peer
+func (a *ReplayAdapter) Sent() []*Message {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return append([]*Message{}, a.sent...)
+}
+
+// Done returns a channel that is closed when all records were read
+func (a *ReplayAdapter) Done() <-chan struct{} {
+	return a.done
+}
+
+// Close ends the replay
+func (a *ReplayAdapter) Close() {
+	a.once.Do(func() {
+		close(a.closed)
+	})
+}
+
+// LocalAddress returns the local address of the replay
+func (a *ReplayAdapter) LocalAddress() string {
+	return "replay:local"
+}
+
+// RemoteAddress returns the address of the replayed peer
+func (a *ReplayAdapter) RemoteAddress() string {
+	return a.remote
+}
+
+var _ PeerOperator = (*ReplayOperator)(nil)
+
+// ReplayOperator is a PeerOperator that connects one ReplayAdapter when it is started
+type ReplayOperator struct {
+	adapter *ReplayAdapter
+	emitter *eventEmitter
+}
+
+// NewReplayOperator creates an operator that replays the capture file (see ReplayAdapter)
+func NewReplayOperator(path string, config ReplayConfig) (*ReplayOperator, error) {
+	adapter, err := NewReplayAdapter(path, config)
+	if err != nil {
+		return nil, err
+	}
+
+	o := new(ReplayOperator)
+	o.adapter = adapter
+	o.emitter = newEventEmitter()
+
+	return o, nil
+}
+
+// Adapter returns the adapter of the replayed peer
+func (o *ReplayOperator) Adapter() *ReplayAdapter {
+	return o.adapter
+}
+
+// Dial is not supported by the replay
+func (o *ReplayOperator) Dial(network string, addr string) error {
+	return ErrInvalidNetwork
+}
+
+// OnPeer registers the given handler and calls it when the replay is started
+func (o *ReplayOperator) OnPeer(handler func(p Adapter)) {
+	o.emitter.On("new-peer", func(args []interface{}) {
+		handler(args[0].(Adapter))
+	})
+}
+
+// Start connects the replayed peer
+func (o *ReplayOperator) Start() error {
+	o.emitter.EmitAsync("new-peer", o.adapter)
+	return nil
+}
+
+// Stop ends the replay
+func (o *ReplayOperator) Stop() {
+	o.adapter.Close()
+}
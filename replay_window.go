@@ -0,0 +1,86 @@
+package go2p
+
+import (
+	"fmt"
+	"sync"
+)
+
+// replayWindowSize is the number of sequence numbers below the highest received one
+// that are still accepted (out of order)
+const replayWindowSize = 1024
+
+const replayWindowBlocks = replayWindowSize/64 + 1
+
+// ReplayError is reported when a message was already received
+// or is too old to be checked by the replay window
+type ReplayError struct {
+	// Seq is the sequence number of the rejected message
+	Seq uint64
+	// Highest is the highest sequence number received so far
+	Highest uint64
+}
+
+func (e *ReplayError) Error() string {
+	if e.Highest >= replayWindowSize && e.Seq <= e.Highest-replayWindowSize {
+		return fmt.Sprintf("message outside of the replay window (seq: %d, highest: %d)", e.Seq, e.Highest)
+	}
+
+	return fmt.Sprintf("replayed message (seq: %d, highest: %d)", e.Seq, e.Highest)
+}
+
+// ErrorAction implements ErrorActioner, replayed messages are dropped
+func (e *ReplayError) ErrorAction() ErrorAction {
+	return ErrorDrop
+}
+
+// replayWindow is a sliding window over the received sequence numbers (see RFC 6479).
+// The bitmap is used as a ring of blocks so the window slides without shifting bits
+type replayWindow struct {
+	mutex   *sync.Mutex
+	highest uint64
+	bitmap  [replayWindowBlocks]uint64
+}
+
+func newReplayWindow() *replayWindow {
+	w := new(replayWindow)
+	w.mutex = new(sync.Mutex)
+
+	return w
+}
+
+// check records seq and returns a ReplayError if it was already recorded,
+// is 0 or is older than the window
+func (w *replayWindow) check(seq uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if seq == 0 {
+		return &ReplayError{Seq: seq, Highest: w.highest}
+	}
+
+	if seq > w.highest {
+		current := w.highest / 64
+		next := seq / 64
+		diff := next - current
+		if diff > replayWindowBlocks {
+			diff = replayWindowBlocks
+		}
+
+		for i := uint64(1); i <= diff; i++ {
+			w.bitmap[(current+i)%replayWindowBlocks] = 0
+		}
+
+		w.highest = seq
+	} else if w.highest-seq >= replayWindowSize {
+		return &ReplayError{Seq: seq, Highest: w.highest}
+	}
+
+	block := (seq / 64) % replayWindowBlocks
+	bit := uint64(1) << (seq % 64)
+	if w.bitmap[block]&bit != 0 {
+		return &ReplayError{Seq: seq, Highest: w.highest}
+	}
+
+	w.bitmap[block] |= bit
+	return nil
+}
@@ -0,0 +1,40 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := newReplayWindow()
+
+	assert.Error(t, w.check(0))
+	assert.NoError(t, w.check(1))
+	assert.NoError(t, w.check(3))
+	assert.NoError(t, w.check(2))
+	assert.Error(t, w.check(2))
+	assert.Error(t, w.check(3))
+
+	assert.NoError(t, w.check(2000))
+	assert.NoError(t, w.check(2000-replayWindowSize+1))
+	assert.Error(t, w.check(2000-replayWindowSize))
+	assert.Error(t, w.check(4))
+
+	assert.NoError(t, w.check(1_000_000))
+	assert.NoError(t, w.check(1_000_000-64))
+	assert.Error(t, w.check(2000))
+}
+
+func TestReplayWindowReorder(t *testing.T) {
+	w := newReplayWindow()
+
+	for seq := uint64(1); seq <= 5000; seq += 2 {
+		assert.NoError(t, w.check(seq+1))
+		assert.NoError(t, w.check(seq))
+	}
+
+	for seq := uint64(5000 - replayWindowSize + 1); seq <= 5000; seq++ {
+		assert.Error(t, w.check(seq))
+	}
+}
@@ -0,0 +1,168 @@
+package go2p
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Priority represents the scheduling class of an outgoing message
+type Priority int
+
+const (
+	// PriorityControl is used for latency sensitive traffic like heartbeats
+	PriorityControl Priority = iota
+
+	// PriorityNormal is the default priority of a message
+	PriorityNormal Priority = iota
+
+	// PriorityBulk is used for large transfers that should not delay other traffic
+	PriorityBulk Priority = iota
+)
+
+const priorityCount = 3
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityControl:
+		return "Control"
+	case PriorityNormal:
+		return "Normal"
+	case PriorityBulk:
+		return "Bulk"
+	}
+
+	return fmt.Sprintf("Priority(%d)", p)
+}
+
+// clamp returns the nearest priority class for values out of range
+func (p Priority) clamp() Priority {
+	if p < PriorityControl {
+		return PriorityControl
+	}
+	if p > PriorityBulk {
+		return PriorityBulk
+	}
+
+	return p
+}
+
+// priorityWeights are the shares of the send bandwidth
+// each priority class gets when all classes have pending messages
+var priorityWeights = [priorityCount]int{
+	PriorityControl: 16,
+	PriorityNormal:  4,
+	PriorityBulk:    1,
+}
+
+// sendQueue is a bounded, per priority class FIFO.
+// Messages are dequeued by a smooth weighted round robin over all non empty classes
+type sendQueue struct {
+	mutex   *sync.Mutex
+	queues  [priorityCount][]*Message
+	slots   [priorityCount]chan struct{}
+	current [priorityCount]int
+	ready   chan struct{}
+}
+
+func newSendQueue(capacity int) *sendQueue {
+	q := new(sendQueue)
+	q.mutex = new(sync.Mutex)
+	q.ready = make(chan struct{}, 1)
+	for i := range q.slots {
+		q.slots[i] = make(chan struct{}, capacity)
+	}
+
+	return q
+}
+
+// push adds the message to the queue of its priority class.
+// The call blocks while the class queue is full, returns false if cancel was closed before
+func (q *sendQueue) push(m *Message, cancel <-chan interface{}) bool {
+	prio := m.Priority()
+
+	select {
+	case q.slots[prio] <- struct{}{}:
+	case <-cancel:
+		return false
+	}
+
+	q.mutex.Lock()
+	q.queues[prio] = append(q.queues[prio], m)
+	q.mutex.Unlock()
+
+	q.signal()
+	return true
+}
+
+// tryPush adds the message to the queue of its priority class.
+// It returns false without blocking if the class queue is full
+func (q *sendQueue) tryPush(m *Message) bool {
+	prio := m.Priority()
+
+	select {
+	case q.slots[prio] <- struct{}{}:
+	default:
+		return false
+	}
+
+	q.mutex.Lock()
+	q.queues[prio] = append(q.queues[prio], m)
+	q.mutex.Unlock()
+
+	q.signal()
+	return true
+}
+
+// pop returns the next message based on the class weights
+// or nil if the queue is empty
+func (q *sendQueue) pop() *Message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	total := 0
+	selected := -1
+	for prio := range q.queues {
+		if len(q.queues[prio]) == 0 {
+			q.current[prio] = 0
+			continue
+		}
+
+		q.current[prio] += priorityWeights[prio]
+		total += priorityWeights[prio]
+		if selected == -1 || q.current[prio] > q.current[selected] {
+			selected = prio
+		}
+	}
+
+	if selected == -1 {
+		return nil
+	}
+
+	q.current[selected] -= total
+
+	m := q.queues[selected][0]
+	q.queues[selected][0] = nil
+	q.queues[selected] = q.queues[selected][1:]
+	<-q.slots[selected]
+
+	for prio := range q.queues {
+		if len(q.queues[prio]) > 0 {
+			q.signal()
+			break
+		}
+	}
+
+	return m
+}
+
+// Ready returns a channel that receives a value when messages are available
+func (q *sendQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
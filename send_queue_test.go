@@ -0,0 +1,74 @@
+package go2p
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPriorityMessage(prio Priority) *Message {
+	m := NewMessage()
+	m.SetPriority(prio)
+	return m
+}
+
+func TestSendQueuePriorities(t *testing.T) {
+	q := newSendQueue(100)
+	cancel := make(chan interface{})
+
+	for i := 0; i < 50; i++ {
+		q.push(newPriorityMessage(PriorityBulk), cancel)
+		q.push(newPriorityMessage(PriorityNormal), cancel)
+	}
+	q.push(newPriorityMessage(PriorityControl), cancel)
+
+	first := q.pop()
+	assert.Equal(t, PriorityControl, first.Priority())
+
+	counts := map[Priority]int{}
+	for i := 0; i < 25; i++ {
+		counts[q.pop().Priority()]++
+	}
+
+	assert.Equal(t, 20, counts[PriorityNormal])
+	assert.Equal(t, 5, counts[PriorityBulk])
+
+	for m := q.pop(); m != nil; m = q.pop() {
+		counts[m.Priority()]++
+	}
+
+	assert.Equal(t, 50, counts[PriorityNormal])
+	assert.Equal(t, 50, counts[PriorityBulk])
+}
+
+func TestSendQueueCancel(t *testing.T) {
+	q := newSendQueue(1)
+	cancel := make(chan interface{})
+
+	assert.True(t, q.push(NewMessage(), cancel))
+
+	close(cancel)
+	assert.False(t, q.push(NewMessage(), cancel))
+	assert.NotNil(t, q.pop())
+	assert.Nil(t, q.pop())
+}
+
+func TestSendQueuePriorityRange(t *testing.T) {
+	q := newSendQueue(1)
+
+	low := NewMessage()
+	low.SetPriority(Priority(-1))
+	assert.Equal(t, PriorityControl, low.Priority())
+
+	high := NewMessage()
+	high.SetPriority(Priority(42))
+	assert.Equal(t, PriorityBulk, high.Priority())
+
+	assert.True(t, q.tryPush(high))
+	assert.True(t, q.tryPush(low))
+	assert.Equal(t, low, q.pop())
+	assert.Equal(t, high, q.pop())
+
+	assert.Equal(t, "Bulk", PriorityBulk.String())
+	assert.Equal(t, "Priority(42)", Priority(42).String())
+}
@@ -1,32 +1,71 @@
 package go2p
 
 import (
+	"bufio"
 	"fmt"
 	"net"
 )
 
+var _ BufferedAdapter = (*adapterTCP)(nil)
+var _ FrameAdapter = (*adapterTCP)(nil)
+
 type adapterTCP struct {
-	conn net.Conn
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+
+	onFrame func(op PipeOperation, frame []byte)
 }
 
 // NewAdapter creates a new TCP adapter that wraps the given net.Conn instance
 func NewAdapter(conn net.Conn) Adapter {
 	a := new(adapterTCP)
 	a.conn = conn
+	a.reader = bufio.NewReader(conn)
+	a.writer = bufio.NewWriter(conn)
 	return a
 }
 
+func (a *adapterTCP) OnFrame(handler func(op PipeOperation, frame []byte)) {
+	a.onFrame = handler
+}
+
 func (a *adapterTCP) ReadMessage() (*Message, error) {
 	m := NewMessage()
-	err := m.ReadFromConn(a.conn)
+	frame, err := m.readFrame(a.reader)
+	if err == nil && a.onFrame != nil {
+		a.onFrame(Receive, frame)
+	}
+
 	return m, err
 }
 
 func (a *adapterTCP) WriteMessage(m *Message) error {
-	err := m.WriteIntoConn(a.conn)
+	if err := a.BufferMessage(m); err != nil {
+		return err
+	}
+
+	return a.writer.Flush()
+}
+
+func (a *adapterTCP) BufferMessage(m *Message) error {
+	frame, err := m.writeFrame(a.writer)
+	if err == nil && a.onFrame != nil {
+		a.onFrame(Send, frame)
+	}
+
 	return err
 }
 
+func (a *adapterTCP) Flush() error {
+	err := a.writer.Flush()
+	if err != nil {
+		return handleReadWriteErr(err, "failed flush")
+	}
+
+	return nil
+}
+
 func (a *adapterTCP) Close() {
 	a.conn.Close()
 }
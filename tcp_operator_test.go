@@ -77,6 +77,7 @@ func TestPingPong(t *testing.T) {
 
 	conn1.OnMessage(func(p *Peer, m *Message) {
 		assert.Equal(t, "hello back", m.PayloadGetString())
+		assert.Equal(t, conn2.Identity(), m.Origin())
 		fmt.Printf("from %s: %s\n", p.RemoteAddress(), m.PayloadGetString())
 		msgWg.Done()
 	})
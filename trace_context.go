@@ -0,0 +1,137 @@
+package go2p
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TraceparentKey is the message header that carries the W3C trace context
+// (see https://www.w3.org/TR/trace-context/)
+const TraceparentKey = "traceparent"
+
+// TraceID identifies a trace across all peers
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+// String returns the lower case hex representation
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// String returns the lower case hex representation
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// SpanContext is the part of a span that is propagated to remote peers
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid returns true if the trace and span id are not zero
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// Traceparent returns the W3C traceparent header value of the context
+func (c SpanContext) Traceparent() string {
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%s-%s-%s", c.TraceID, c.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, error) {
+	var result SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return result, errors.Errorf("invalid traceparent: %s", value)
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return result, errors.Errorf("invalid traceparent: %s", value)
+	}
+
+	if err := decodeTraceHex(result.TraceID[:], parts[1]); err != nil {
+		return result, errors.Wrapf(err, "invalid trace id in traceparent: %s", value)
+	}
+	if err := decodeTraceHex(result.SpanID[:], parts[2]); err != nil {
+		return result, errors.Wrapf(err, "invalid span id in traceparent: %s", value)
+	}
+
+	var flags [1]byte
+	if err := decodeTraceHex(flags[:], parts[3]); err != nil {
+		return result, errors.Wrapf(err, "invalid flags in traceparent: %s", value)
+	}
+	result.Sampled = flags[0]&1 == 1
+
+	if !result.IsValid() {
+		return result, errors.Errorf("invalid traceparent: %s", value)
+	}
+
+	return result, nil
+}
+
+// TraceContext returns the trace context of the message.
+// For received messages this is the context of the receive span of the Tracing middleware,
+// pass it to ContinueTrace to continue the trace with messages sent by a route handler
+func TraceContext(msg *Message) (SpanContext, bool) {
+	value, found := msg.Metadata().Get(TraceparentKey)
+	if !found {
+		return SpanContext{}, false
+	}
+
+	str, _ := value.(string)
+	ctx, err := ParseTraceparent(str)
+	return ctx, err == nil
+}
+
+// ContinueTrace sets the trace context of msg to the one of parent,
+// so the Tracing middleware records the send span of msg as a child of parent
+func ContinueTrace(msg *Message, parent *Message) {
+	if ctx, found := TraceContext(parent); found {
+		setTraceContext(msg, ctx)
+	}
+}
+
+func setTraceContext(msg *Message, ctx SpanContext) {
+	msg.Metadata().Put(TraceparentKey, ctx.Traceparent())
+}
+
+func decodeTraceHex(dst []byte, value string) error {
+	if len(value) != hex.EncodedLen(len(dst)) || strings.ToLower(value) != value {
+		return errors.Errorf("expected %d lower case hex characters", hex.EncodedLen(len(dst)))
+	}
+
+	_, err := hex.Decode(dst, []byte(value))
+	return err
+}
+
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		rand.Read(id[:])
+	}
+
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for id == (SpanID{}) {
+		rand.Read(id[:])
+	}
+
+	return id
+}